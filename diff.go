@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	monostat "github.com/radek-ryckowski/monofs/monoclient/stat"
+	pb "github.com/radek-ryckowski/monofs/proto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const diffUsage = `usage: monofs diff [--manager_address address] [--json] from [to]
+
+Print paths changed between snapshot from and snapshot to, or the head when to
+is omitted, as reported by the manager of a mounted filesystem. Every line is
+a kind (added, removed, modified or renamed) and a path, renamed paths are
+printed as old -> new. With --json a line is a JSON object carrying old and
+new attributes as well.
+`
+
+// runDiff prints changes between snapshots of a mounted filesystem, exit code
+// is 0 on success and 2 on failure
+func runDiff(args []string) int {
+	fset := flag.NewFlagSet("diff", flag.ExitOnError)
+	address := fset.String("manager_address", "localhost"+*fManagerPort, "Address of the manager of the mounted filesystem.")
+	certDir := fset.String("cert_dir", *fCertDir, "Certificate directory")
+	asJSON := fset.Bool("json", false, "Print a JSON object per changed path.")
+	fset.Usage = func() { fmt.Fprint(os.Stderr, diffUsage) }
+	fset.Parse(args)
+	if fset.NArg() < 1 || fset.NArg() > 2 {
+		fset.Usage()
+		return 2
+	}
+	conn, err := monostat.NewConnection(*address, *certDir, zap.NewNop().Sugar())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diff: %v\n", err)
+		return 2
+	}
+	defer conn.Close()
+	stream, err := pb.NewMonofsManagerClient(conn).DiffSnapshots(context.Background(), &pb.DiffSnapshotsRequest{
+		From: fset.Arg(0),
+		To:   fset.Arg(1),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diff: %v\n", err)
+		return 2
+	}
+	marshal := protojson.MarshalOptions{UseProtoNames: true}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "diff: %v\n", err)
+			return 2
+		}
+		if *asJSON {
+			buf, err := marshal.Marshal(resp)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "diff: %v\n", err)
+				return 2
+			}
+			fmt.Println(string(buf))
+			continue
+		}
+		switch {
+		case resp.Kind == "renamed":
+			fmt.Printf("%-8s %s -> %s\n", resp.Kind, resp.OldPath, resp.NewPath)
+		case resp.NewPath != "":
+			fmt.Printf("%-8s %s\n", resp.Kind, resp.NewPath)
+		default:
+			fmt.Printf("%-8s %s\n", resp.Kind, resp.OldPath)
+		}
+	}
+}
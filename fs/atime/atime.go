@@ -0,0 +1,213 @@
+package atime
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"go.uber.org/zap"
+)
+
+// Policy decides when a read updates the access time of an inode
+type Policy int
+
+const (
+	// Relatime updates atime only when it is not newer than mtime/ctime or older than RelatimeInterval
+	Relatime Policy = iota
+	// Noatime never updates atime on reads
+	Noatime
+	// Strictatime updates atime on every read
+	Strictatime
+)
+
+const (
+	// RelatimeInterval maximum age of atime before relatime updates it anyway
+	RelatimeInterval = 24 * time.Hour
+	// DefaultFlushInterval how often pending access times are persisted
+	DefaultFlushInterval = 10 * time.Second
+)
+
+// ParsePolicy converts mount option name to Policy
+func ParsePolicy(name string) (Policy, error) {
+	switch strings.ToLower(name) {
+	case "", "relatime":
+		return Relatime, nil
+	case "noatime":
+		return Noatime, nil
+	case "strictatime":
+		return Strictatime, nil
+	}
+	return Relatime, fmt.Errorf("unknown atime policy %q", name)
+}
+
+// String returns mount option name of policy
+func (p Policy) String() string {
+	switch p {
+	case Noatime:
+		return "noatime"
+	case Strictatime:
+		return "strictatime"
+	}
+	return "relatime"
+}
+
+// FlushFunc persists access time of a single inode. It has to exclude callers
+// of Forget for inode and write only while Flushing still reports atime, so a
+// time forgotten after the flush started is not written.
+type FlushFunc func(inode fuseops.InodeID, atime time.Time) error
+
+// Tracker keeps access times in memory and persists them lazily in batches,
+// so reads don't turn into metadata writes
+type Tracker struct {
+	mu       sync.Mutex
+	policy   Policy
+	interval time.Duration
+	pending  map[fuseops.InodeID]time.Time
+	// flushing access times taken by a running Flush and not forgotten since
+	flushing map[fuseops.InodeID]time.Time
+	flushMu  sync.Mutex
+	flush    FlushFunc
+	log      *zap.SugaredLogger
+	stop     chan bool
+	wg       sync.WaitGroup
+}
+
+// New creates a new access time tracker
+func New(policy Policy, interval time.Duration, flush FlushFunc, log *zap.SugaredLogger) *Tracker {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	return &Tracker{
+		policy:   policy,
+		interval: interval,
+		pending:  make(map[fuseops.InodeID]time.Time),
+		flush:    flush,
+		log:      log,
+		stop:     make(chan bool),
+	}
+}
+
+// Policy returns tracker policy
+func (t *Tracker) Policy() Policy {
+	return t.policy
+}
+
+// Start starts background flushing of pending access times
+func (t *Tracker) Start() {
+	if t.policy == Noatime {
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := t.Flush(); err != nil {
+					t.log.Errorf("atime flush: %v", err)
+				}
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Access records a read of inode with given attributes at time now
+func (t *Tracker) Access(inode fuseops.InodeID, attrs fuseops.InodeAttributes, now time.Time) {
+	if t.policy == Noatime {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[inode]; ok && p.After(attrs.Atime) {
+		attrs.Atime = p
+	}
+	if t.policy == Relatime && !needsRelatimeUpdate(attrs, now) {
+		return
+	}
+	t.pending[inode] = now
+}
+
+// needsRelatimeUpdate implements the relatime rule used by Linux
+func needsRelatimeUpdate(attrs fuseops.InodeAttributes, now time.Time) bool {
+	if !attrs.Atime.After(attrs.Mtime) || !attrs.Atime.After(attrs.Ctime) {
+		return true
+	}
+	return now.Sub(attrs.Atime) >= RelatimeInterval
+}
+
+// Apply overlays not yet persisted access time on attrs
+func (t *Tracker) Apply(inode fuseops.InodeID, attrs *fuseops.InodeAttributes) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.flushing[inode]; ok && p.After(attrs.Atime) {
+		attrs.Atime = p
+	}
+	if p, ok := t.pending[inode]; ok && p.After(attrs.Atime) {
+		attrs.Atime = p
+	}
+}
+
+// Forget drops pending access time of inode (explicitly set or removed), also
+// when a running Flush has taken it already
+func (t *Tracker) Forget(inode fuseops.InodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, inode)
+	delete(t.flushing, inode)
+}
+
+// Flushing reports whether a running Flush still has to write atime of inode
+func (t *Tracker) Flushing(inode fuseops.InodeID, atime time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.flushing[inode]
+	return ok && p.Equal(atime)
+}
+
+// Pending returns number of access times waiting for flush
+func (t *Tracker) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// Flush persists all pending access times
+func (t *Tracker) Flush() error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+	t.mu.Lock()
+	pending := t.pending
+	t.flushing = make(map[fuseops.InodeID]time.Time, len(pending))
+	for inode, at := range pending {
+		t.flushing[inode] = at
+	}
+	t.pending = make(map[fuseops.InodeID]time.Time)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.flushing = nil
+		t.mu.Unlock()
+	}()
+	var firstErr error
+	for inode, at := range pending {
+		if err := t.flush(inode, at); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("inode %d: %w", inode, err)
+		}
+	}
+	return firstErr
+}
+
+// Stop stops background flushing and persists remaining access times
+func (t *Tracker) Stop() error {
+	if t.policy != Noatime {
+		close(t.stop)
+		t.wg.Wait()
+	}
+	return t.Flush()
+}
@@ -0,0 +1,120 @@
+package atime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newTestTracker(t *testing.T, policy Policy, flushed map[fuseops.InodeID]time.Time) *Tracker {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(policy, time.Hour, func(inode fuseops.InodeID, at time.Time) error {
+		flushed[inode] = at
+		return nil
+	}, logger.Sugar())
+}
+
+func TestAtimePolicies(t *testing.T) {
+	base := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	fresh := fuseops.InodeAttributes{
+		Mtime: base,
+		Ctime: base,
+		Atime: base.Add(time.Minute),
+	}
+	stale := fuseops.InodeAttributes{
+		Mtime: base.Add(time.Minute),
+		Ctime: base.Add(time.Minute),
+		Atime: base,
+	}
+	now := base.Add(time.Hour)
+	tests := []struct {
+		name    string
+		policy  Policy
+		attrs   fuseops.InodeAttributes
+		now     time.Time
+		updated bool
+	}{
+		{"noatime", Noatime, stale, now, false},
+		{"strictatime", Strictatime, fresh, now, true},
+		{"relatime fresh", Relatime, fresh, now, false},
+		{"relatime older than mtime", Relatime, stale, now, true},
+		{"relatime older than a day", Relatime, fresh, base.Add(25 * time.Hour), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flushed := map[fuseops.InodeID]time.Time{}
+			tracker := newTestTracker(t, test.policy, flushed)
+			tracker.Access(1, test.attrs, test.now)
+			attrs := test.attrs
+			tracker.Apply(1, &attrs)
+			if err := tracker.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			_, ok := flushed[1]
+			assert.Equal(t, test.updated, ok)
+			if test.updated {
+				assert.Equal(t, test.now, attrs.Atime)
+			}
+		})
+	}
+}
+
+func TestAtimeForget(t *testing.T) {
+	flushed := map[fuseops.InodeID]time.Time{}
+	tracker := newTestTracker(t, Strictatime, flushed)
+	tracker.Access(1, fuseops.InodeAttributes{}, time.Now())
+	tracker.Access(2, fuseops.InodeAttributes{}, time.Now())
+	tracker.Forget(1)
+	assert.Equal(t, 1, tracker.Pending())
+	if err := tracker.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(flushed))
+	assert.Equal(t, 0, tracker.Pending())
+}
+
+func TestAtimeForgetDuringFlush(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracker *Tracker
+	started, release := make(chan struct{}), make(chan struct{})
+	written := false
+	tracker = New(Strictatime, time.Hour, func(inode fuseops.InodeID, at time.Time) error {
+		close(started)
+		<-release
+		written = tracker.Flushing(inode, at)
+		return nil
+	}, logger.Sugar())
+	now := time.Now()
+	tracker.Access(1, fuseops.InodeAttributes{}, now)
+	done := make(chan error)
+	go func() { done <- tracker.Flush() }()
+	<-started
+	// not persisted yet
+	attrs := fuseops.InodeAttributes{}
+	tracker.Apply(1, &attrs)
+	assert.Equal(t, now, attrs.Atime)
+	// an explicitly set access time arrives while the flush is running
+	tracker.Forget(1)
+	close(release)
+	assert.NoError(t, <-done)
+	assert.False(t, written)
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Relatime, Noatime, Strictatime} {
+		parsed, err := ParsePolicy(p.String())
+		assert.Nil(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePolicy("sometimes")
+	assert.NotNil(t, err)
+}
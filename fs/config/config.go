@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/jacobsa/fuse"
+	"github.com/radek-ryckowski/monofs/fs/atime"
 	monostat "github.com/radek-ryckowski/monofs/monoclient/stat"
 )
 
@@ -26,10 +27,52 @@ type Config struct {
 	ShutdownTimeout time.Duration
 	//CacheSize cache size
 	CacheSize int
+	//CacheBytes budget of cached attribute data, zero bounds the cache by CacheSize only
+	CacheBytes int64
+	//CachePolicy attribute cache eviction policy: lru, arc or 2q
+	CachePolicy string
 	//ManagerPort manager port
 	ManagerPort string
 	//BloomFilterSize bloom filter size
 	BloomFilterSize int
 	//LocalDataPath local data path
 	LocalDataPath string
+	//AtimePolicy when reads update access time
+	AtimePolicy atime.Policy
+	//AtimeFlushInterval how often pending access times are persisted
+	AtimeFlushInterval time.Duration
+	//AttrCacheTTL how long the kernel may cache inode attributes
+	AttrCacheTTL time.Duration
+	//EntryCacheTTL how long the kernel may cache name to inode lookups
+	EntryCacheTTL time.Duration
+	//NegativeEntryCacheTTL how long the kernel may cache failed lookups, zero disables negative entries
+	NegativeEntryCacheTTL time.Duration
+	//DentryCacheSize how many name lookups are cached, zero disables the cache
+	DentryCacheSize int
+	//DentryCacheTTL how long a found name is cached
+	DentryCacheTTL time.Duration
+	//NegativeDentryCacheTTL how long a missing name is cached, zero disables negative entries
+	NegativeDentryCacheTTL time.Duration
+	//GCInterval how often unreferenced attributes and data files are collected, zero disables it
+	GCInterval time.Duration
+	//GCGracePeriod how long an item has to stay unreferenced before it is collected
+	GCGracePeriod time.Duration
+	//InMemory keep metadata, the WAL and file blocks in memory, nothing outlives the process
+	InMemory bool
+	//MetaBackend metadata store backend, empty keeps the backend of an existing store
+	MetaBackend string
+	//WALSync when WAL files are synced: none, interval or always
+	WALSync string
+	//WALSyncInterval how often WAL files are synced in interval mode
+	WALSyncInterval time.Duration
+	//WALSegmentSize size after which a new WAL file is started, 0 is the default, negative disables it
+	WALSegmentSize int64
+	//WALSegmentAge age of the oldest entry after which a new WAL file is started, 0 is the default, negative disables it
+	WALSegmentAge time.Duration
+	//WALMaxPendingFiles rotated WAL files waiting to be written to the attribute store before writers are throttled, 0 is the default, negative disables it
+	WALMaxPendingFiles int
+	//Snapshot name of a snapshot served read-only instead of the head
+	Snapshot string
+	//FsckRepair repair problems found by the consistency check run after an unclean failure
+	FsckRepair bool
 }
@@ -1,100 +1,111 @@
 package dir
 
 import (
+	"encoding/binary"
+	"sync"
+
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/radek-ryckowski/monofs/fs/fsdb"
 )
 
+const (
+	// cookiePrefix bytes of a name kept in an offset, they fill 56 bits and
+	// leave the sign bit of the kernel loff_t clear
+	cookiePrefix = 7
+	// cookieSlotBits low bits of an offset which tell apart names sharing a prefix
+	cookieSlotBits = 7
+	// maxCookies offsets remembered by a handle, older ones fall back to the prefix
+	maxCookies = 4096
+)
+
 type FsDir struct {
-	db       *fsdb.Fsdb
-	inode    fuseops.InodeID
-	offset   int
-	name     string
-	dentries []*fsdb.Inode
+	db      *fsdb.Fsdb
+	inode   fuseops.InodeID
+	mu      sync.Mutex
+	cookies map[fuseops.DirOffset]string
+	order   []fuseops.DirOffset
 }
 
 // New creates new DirFile object
 func New(db *fsdb.Fsdb, inode fuseops.InodeID) *FsDir {
 	return &FsDir{
-		db:       db,
-		inode:    inode,
-		offset:   0,
-		name:     "",
-		dentries: []*fsdb.Inode{},
+		db:      db,
+		inode:   inode,
+		cookies: make(map[fuseops.DirOffset]string),
 	}
 }
 
-// GetDentries returns dentries
-func (dir *FsDir) GetDentries(offset fuseops.DirOffset, size int) ([]*fsdb.Inode, error) {
-	if offset == 0 && dir.offset > 0 {
-		return dir.Revind(offset, size)
-	} else if offset >= fuseops.DirOffset(size) || dir.CacheSize() == 0 {
-		return dir.DbEntries(offset, size)
-	}
-	return dir.CacheEntries(offset)
+// Cookie returns the directory offset which resumes a listing after name. It
+// holds the first bytes of name followed by a zero byte, so offsets follow key
+// order and stay valid while other entries are created or removed. Zero is
+// left for the start of the directory.
+func Cookie(name string) fuseops.DirOffset {
+	var p [8]byte
+	copy(p[1:], name+"\x00")
+	return fuseops.DirOffset(binary.BigEndian.Uint64(p[:]) << cookieSlotBits)
 }
 
-// Revind compare entries from and cache and compare changes
-func (dir *FsDir) Revind(offset fuseops.DirOffset, size int) ([]*fsdb.Inode, error) {
-	i, err := dir.DbEntries(offset, size)
-	if err != nil {
-		return nil, err
-	}
-	if len(i) != len(dir.dentries) {
-		return i, nil
-	}
-	// this could be faster. In majory of cases cache and db entries will be the same
-	// so we could create hash for db entres and compare it with cache hash
-	// if they are the same we could return empty ( [] *fsdb.Inode{})
+// cookieKey returns the key a listing resumes after when the offset isn't
+// remembered. For names shorter than the prefix it is the name itself, longer
+// ones resume at their prefix and may repeat entries sharing it, but never
+// skip one.
+func cookieKey(offset fuseops.DirOffset) string {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(offset)>>cookieSlotBits)
+	return string(p[1:])
+}
 
-	for x, inode := range i {
-		if inode.Name != dir.dentries[x].Name {
-			return i, nil
+// GetDentries returns up to size dentries which follow offset in key order
+func (dir *FsDir) GetDentries(offset fuseops.DirOffset, size int) ([]*fsdb.Inode, error) {
+	after := ""
+	if offset != 0 {
+		dir.mu.Lock()
+		name, ok := dir.cookies[offset]
+		dir.mu.Unlock()
+		if !ok {
+			name = cookieKey(offset)
 		}
+		after = name
 	}
-	return []*fsdb.Inode{}, nil
-}
-
-// DbEntries returns directory entries1
-func (dir *FsDir) DbEntries(offset fuseops.DirOffset, size int) ([]*fsdb.Inode, error) {
-	entries, currentOffset, err := dir.db.GetChildren(uint64(dir.inode), dir.offset, size, []byte(dir.name))
+	entries, err := dir.db.GetChildren(uint64(dir.inode), after, size)
 	if err != nil {
 		return nil, err
 	}
-	dir.offset += currentOffset
-	if len(entries) > 0 {
-		dir.name = entries[len(entries)-1].Name
-		dir.dentries = entries
-	}
 	return entries, nil
 }
 
-// UpdateOffset updates offset
-func (dir *FsDir) UpdateOffset(offset int) {
-	dir.offset = offset
-}
-
-// GetOffset returns offset
-func (dir *FsDir) GetOffset() int {
-	return dir.offset
-}
-
-// UpdateName updates name
-func (dir *FsDir) UpdateName(name string) {
-	dir.name = name
+// Offset returns offset of an entry and remembers it, so listing can resume
+// exactly after it. Names sharing a prefix get distinct offsets while free
+// slots last, the last maxCookies offsets are remembered.
+func (dir *FsDir) Offset(inode *fsdb.Inode) fuseops.DirOffset {
+	c := Cookie(inode.Name)
+	if len(inode.Name) < cookiePrefix {
+		// the offset is exact already
+		return c
+	}
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	// slot 0 is never remembered, it resumes at the prefix
+	for slot := fuseops.DirOffset(1); slot < 1<<cookieSlotBits; slot++ {
+		name, ok := dir.cookies[c|slot]
+		if ok && name == inode.Name {
+			return c | slot
+		}
+		if ok {
+			continue
+		}
+		if len(dir.order) >= maxCookies {
+			delete(dir.cookies, dir.order[0])
+			dir.order = dir.order[1:]
+		}
+		dir.cookies[c|slot] = inode.Name
+		dir.order = append(dir.order, c|slot)
+		return c | slot
+	}
+	return c
 }
 
 // GetInodeID returns inode id
 func (dir *FsDir) GetInodeID() fuseops.InodeID {
 	return dir.inode
 }
-
-// CacheSize returns cache size
-func (dir *FsDir) CacheSize() int {
-	return len(dir.dentries)
-}
-
-// CacheEntries returns entries from cache
-func (dir *FsDir) CacheEntries(offset fuseops.DirOffset) ([]*fsdb.Inode, error) {
-	return dir.dentries[offset:], nil
-}
@@ -0,0 +1,131 @@
+package dir
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDirInode = 100
+
+func newTestDb(t *testing.T, names ...string) *fsdb.Fsdb {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := fsdb.New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, name := range names {
+		addEntry(t, db, name)
+	}
+	return db
+}
+
+func addEntry(t *testing.T, db *fsdb.Fsdb, name string) *fsdb.Inode {
+	inode := fsdb.NewInode(1000+uint64(name[0]), testDirInode, name, fsdb.InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	if err := db.AddInode(inode, true); err != nil {
+		t.Fatal(err)
+	}
+	return inode
+}
+
+func names(entries []*fsdb.Inode) []string {
+	n := []string{}
+	for _, e := range entries {
+		n = append(n, e.Name)
+	}
+	return n
+}
+
+func TestDirOffsetsStable(t *testing.T) {
+	db := newTestDb(t, "a", "c", "e", "g")
+	dir := New(db, testDirInode)
+	entries, err := dir.GetDentries(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a", "c"}, names(entries))
+	offset := dir.Offset(entries[len(entries)-1])
+	// changes before and after the current position don't skip or repeat entries
+	addEntry(t, db, "b")
+	addEntry(t, db, "d")
+	if err := db.DeleteInode(entries[0], false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = dir.GetDentries(offset, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"d", "e", "g"}, names(entries))
+
+	// an offset from another handle (telldir/seekdir) resolves to the same position
+	other := New(db, testDirInode)
+	entries, err = other.GetDentries(Cookie("c"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"d"}, names(entries))
+	// the entry of an offset was removed, the listing goes on with the next one
+	if err := db.DeleteInode(entries[0], false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = other.GetDentries(Cookie("d"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"e", "g"}, names(entries))
+	// offsets follow key order
+	assert.Less(t, Cookie("b"), Cookie("ba"))
+	assert.Less(t, Cookie("ba"), Cookie("c"))
+}
+
+func TestDirOffsetsSharedPrefix(t *testing.T) {
+	db := newTestDb(t, "prefix-1", "prefix-2", "prefix-3", "z")
+	dir := New(db, testDirInode)
+	entries, err := dir.GetDentries(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"prefix-1", "prefix-2"}, names(entries))
+	first, second := dir.Offset(entries[0]), dir.Offset(entries[1])
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, second, dir.Offset(entries[1]))
+	entries, err = dir.GetDentries(second, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"prefix-3", "z"}, names(entries))
+	entries, err = dir.GetDentries(first, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"prefix-2"}, names(entries))
+
+	// a handle which doesn't know the offset repeats names sharing the prefix
+	// rather than skipping any
+	entries, err = New(db, testDirInode).GetDentries(second, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"prefix-1", "prefix-2", "prefix-3", "z"}, names(entries))
+}
+
+func TestDirOffsetsBounded(t *testing.T) {
+	dir := New(nil, testDirInode)
+	for i := 0; i < maxCookies+10; i++ {
+		dir.Offset(&fsdb.Inode{Name: fmt.Sprintf("%08d-entry", i)})
+	}
+	assert.Equal(t, maxCookies, len(dir.cookies))
+	assert.Equal(t, maxCookies, len(dir.order))
+}
@@ -10,6 +10,9 @@ import (
 	"github.com/radek-ryckowski/monofs/fs/fsdb"
 )
 
+// direntMinSize size of the smallest fuse dirent, it bounds entries fitting in a ReadDir buffer
+const direntMinSize = 32
+
 // MkDir creates a new directory.
 func (fs *Monofs) MkDir(
 	ctx context.Context,
@@ -26,24 +29,35 @@ func (fs *Monofs) MkDir(
 		fsdb.InodeAttributes{
 			Hash: "", // TODO FIXME
 			InodeAttributes: fuseops.InodeAttributes{
-				Size:  4096,
-				Nlink: 1,
-				Mode:  op.Mode,
-				Rdev:  0,
-				Uid:   fs.uid,
-				Gid:   fs.gid,
-				Atime: t,
-				Mtime: t,
-				Ctime: t,
+				Size:   4096,
+				Nlink:  2,
+				Mode:   op.Mode,
+				Rdev:   0,
+				Uid:    fs.uid,
+				Gid:    fs.gid,
+				Atime:  t,
+				Mtime:  t,
+				Ctime:  t,
+				Crtime: t,
 			},
 		},
 	)
-	if err = fs.AddInode(inode, true); err != nil {
-		return err
+	txn := fs.metadb.NewTxn()
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	txn.PutDentry(inode)
+	if err := fs.stageParent(txn, op.Parent, t, 1); err != nil {
+		fs.log.Errorf("MkDir(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
+	}
+	if err = txn.Commit(); err != nil {
+		fs.log.Errorf("MkDir(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
 	}
 	// Report the inode's attributes.
 	op.Entry.Child = inode.ID()
 	op.Entry.Attributes = inode.Attrs.InodeAttributes
+	fs.setEntryExpiration(&op.Entry)
+	fs.refs.Lookup(op.Entry.Child)
 	return nil
 }
 
@@ -76,10 +90,6 @@ func (fs *Monofs) OpenDir(
 func (fs *Monofs) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) error {
-	var (
-		inodeEntries []*fsdb.Inode
-		err          error
-	)
 	fs.fsHashLock.RLock(op.Inode)
 	defer fs.fsHashLock.RUnlock(op.Inode)
 	// Look up the directory.
@@ -91,34 +101,29 @@ func (fs *Monofs) ReadDir(
 		fs.log.Errorf("ReadDir(%d): wrong inode %d", op.Inode, dir.GetInodeID())
 		return fuse.EINVAL
 	}
-	inodeEntries, err = dir.GetDentries(op.Offset, len(op.Dst))
+	if op.Offset == 0 {
+		fs.touchAtime(op.Inode)
+	}
+	inodeEntries, err := dir.GetDentries(op.Offset, len(op.Dst)/direntMinSize+1)
 	if err != nil {
 		fs.log.Errorf("ReadDir(%d): %v", op.Inode, err)
 		return fuse.EIO
 	}
-	for x, inode := range inodeEntries {
+	for _, inode := range inodeEntries {
 		// Report the entry.
 		dirent := fuseutil.Dirent{
-			Offset: op.Offset + fuseops.DirOffset(x+1), // TODO FIXME
+			Offset: dir.Offset(inode),
 			Inode:  inode.ID(),
 			Name:   inode.Name,
 			Type:   fsdb.InodeDirentType(inode.Attrs.Mode),
 		}
-		op.BytesRead += fuseutil.WriteDirent(
-			op.Dst[op.BytesRead:],
-			dirent,
-		)
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], dirent)
 		// Stop if we've filled the buffer.
-		if op.BytesRead == len(op.Dst) {
-			op.Offset += fuseops.DirOffset(x + 1)
-			offset := int(op.Offset)
-			dir.UpdateOffset(offset)
-			dir.UpdateName(inode.Name)
-			return nil
+		if n == 0 {
+			break
 		}
+		op.BytesRead += n
 	}
-	// Advance the offset.
-	op.Offset += fuseops.DirOffset(len(inodeEntries))
 	return nil
 }
 
@@ -128,7 +133,7 @@ func (fs *Monofs) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	defer fs.fsHashLock.Unlock(op.Parent)
 	inode, err := fs.GetInode(op.Parent, op.Name, true)
 	if err != nil {
-		if err != fsdb.ErrNoSuchInode {
+		if err == fsdb.ErrNoSuchInode {
 			return fuse.ENOENT
 		}
 		fs.log.Errorf("RmDir(GetInode)(%d, %s): %v", op.Parent, op.Name, err)
@@ -139,16 +144,20 @@ func (fs *Monofs) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	}
 	children, err := fs.metadb.GetChildrenCount(inode.InodeID)
 	if err != nil {
-		if err != fsdb.ErrNoSuchInode {
-			return fuse.ENOENT
-		}
 		fs.log.Errorf("RmDir(GetChildrenCount)(%d): %v", inode.ID(), err)
 		return fuse.EIO
 	}
 	if children > 0 {
 		return fuse.ENOTEMPTY
 	}
-	if err = fs.metadb.DeleteInode(inode, true); err != nil {
+	txn := fs.metadb.NewTxn()
+	txn.DeleteDentry(inode)
+	txn.DeleteAttrs(inode.InodeID)
+	if err := fs.stageParent(txn, op.Parent, fs.Clock.Now(), -1); err != nil {
+		fs.log.Errorf("RmDir(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
+	}
+	if err = txn.Commit(); err != nil {
 		fs.log.Errorf("RmDir(RemoveInode)(%d): %v", inode.ID(), err)
 		return fuse.EIO
 	}
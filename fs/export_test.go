@@ -0,0 +1,9 @@
+package monofs
+
+import "github.com/radek-ryckowski/monofs/fs/fsdb"
+
+// DentryCacheStats returns counters of the dentry cache to tests using the
+// monofstest harness
+func (fs *Monofs) DentryCacheStats() fsdb.DentryCacheStats {
+	return fs.metadb.DentryCacheStats()
+}
@@ -22,8 +22,8 @@ type FsFile struct {
 }
 
 // New creates new FsFile object
-func New(name string, inode fuseops.InodeID, hash string, dataBasePath string) (*FsFile, error) {
-	fse, err := NewFsFileEngine(uint64(inode), dataBasePath, hash)
+func New(name string, inode fuseops.InodeID, hash string, dataBasePath string, blocks Blocks) (*FsFile, error) {
+	fse, err := NewFsFileEngine(uint64(inode), dataBasePath, hash, blocks)
 	if err != nil {
 		return nil, err
 	}
@@ -36,6 +36,11 @@ func New(name string, inode fuseops.InodeID, hash string, dataBasePath string) (
 	}, nil
 }
 
+// GetInodeID returns inode id
+func (file *FsFile) GetInodeID() fuseops.InodeID {
+	return file.inode
+}
+
 func (file *FsFile) Read(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
@@ -3,23 +3,93 @@ package file
 import (
 	"errors"
 	"path/filepath"
+	"sync"
 
 	"github.com/radek-ryckowski/monofs/kvstore"
 	"github.com/radek-ryckowski/monofs/utils"
 )
 
+// BlockStore keeps 4k blocks of file data
+type BlockStore interface {
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+}
+
+// Blocks opens the block store of data with the given hash
+type Blocks func(path string, hash string) (BlockStore, error)
+
+// DiskBlocks keeps blocks in a kvstore file per data hash under path
+func DiskBlocks(path string, hash string) (BlockStore, error) {
+	return kvstore.NewKVStore(filepath.Join(path, hash), 4096*2)
+}
+
+type memBlockStore struct {
+	index *kvstore.Index
+}
+
+func (m *memBlockStore) Get(key []byte) ([]byte, error) {
+	return m.index.Get(key)
+}
+
+func (m *memBlockStore) Put(key []byte, value []byte) error {
+	return m.index.Add(append([]byte{}, key...), append([]byte{}, value...))
+}
+
+// NewMemBlocks returns Blocks keeping data in memory, handles of the same
+// data hash share a store
+func NewMemBlocks() Blocks {
+	var mu sync.Mutex
+	stores := make(map[string]*memBlockStore)
+	return func(path string, hash string) (BlockStore, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s, ok := stores[hash]
+		if !ok {
+			s = &memBlockStore{index: kvstore.NewIndex()}
+			stores[hash] = s
+		}
+		return s, nil
+	}
+}
+
+// CopyBlocks copies blocks of size bytes of data kept under hash to newHash,
+// blocks never written are left out
+func CopyBlocks(blocks Blocks, path string, hash string, newHash string, size uint64) error {
+	src, err := blocks(path, hash)
+	if err != nil {
+		return err
+	}
+	dst, err := blocks(path, newHash)
+	if err != nil {
+		return err
+	}
+	for block := uint64(0); block*4096 < size; block++ {
+		data, err := src.Get(utils.Uint64ToBytes(block))
+		if err != nil {
+			if err != kvstore.ErrItemNotFound {
+				return err
+			}
+			continue
+		}
+		if err := dst.Put(utils.Uint64ToBytes(block), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FsFileEngine managing pool of files assign proper client to file handle and managing space on disk
 // it also managing locking and unlocking files
 type FsFileEngine struct {
 	hash  string
 	path  string
 	inode uint64
-	kvs   *kvstore.KVStore
+	kvs   BlockStore
 }
 
 // NewFsFileEngine creates new FsFileEngine object
-func NewFsFileEngine(inode uint64, path string, hash string) (*FsFileEngine, error) {
-	kvs, err := kvstore.NewKVStore(filepath.Join(path, hash), 4096*2)
+func NewFsFileEngine(inode uint64, path string, hash string, blocks Blocks) (*FsFileEngine, error) {
+	kvs, err := blocks(path, hash)
 	if err != nil {
 		return nil, err
 	}
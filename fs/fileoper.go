@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"os"
+	"strings"
 	"syscall"
 
 	"github.com/jacobsa/fuse"
@@ -21,13 +22,38 @@ func (fs *Monofs) CreateFile(
 	op *fuseops.CreateFileOp) error {
 	// Create a new inode.
 	fs.fsHashLock.Lock(op.Parent)
-	defer fs.fsHashLock.Unlock(op.Parent)
 	i, err := fs.GetInode(op.Parent, op.Name, true)
 	if err == nil {
+		fs.fsHashLock.Unlock(op.Parent)
+		// the file is opened for writing, the parent isn't held while the
+		// inode is locked
+		fs.fsHashLock.Lock(i.ID())
+		defer fs.fsHashLock.Unlock(i.ID())
+		attrs, err := fs.metadb.GetFsdbInodeAttributes(i.InodeID)
+		if err != nil {
+			if err == fsdb.ErrNoSuchInode {
+				return fuse.ENOENT
+			}
+			fs.log.Errorf("CreateFile(GetInodeAttrs)(%d:%s): %v", op.Parent, op.Name, err)
+			return fuse.EIO
+		}
+		if attrs, err = fs.ownData(i.ID(), attrs); err != nil {
+			fs.log.Errorf("CreateFile(ownData)(%d:%s): %v", op.Parent, op.Name, err)
+			return fuse.EIO
+		}
+		fsHandle, err := monofile.New(fs.Name, i.ID(), attrs.Hash, fs.localDataPath, fs.blocks)
+		if err != nil {
+			fs.log.Errorf("CreateFile(%d:%s): %v", op.Parent, op.Name, err)
+			return fuse.EIO
+		}
+		op.Handle = fs.AddFileHandle(fsHandle)
 		op.Entry.Child = i.ID()
-		op.Entry.Attributes = i.Attrs.InodeAttributes
+		op.Entry.Attributes = attrs.InodeAttributes
+		fs.setEntryExpiration(&op.Entry)
+		fs.refs.Lookup(op.Entry.Child)
 		return nil
 	}
+	defer fs.fsHashLock.Unlock(op.Parent)
 	t := fs.Clock.Now()
 	// add to sha256 name of file current time and some random string
 	sha256 := sha256.New()
@@ -38,30 +64,40 @@ func (fs *Monofs) CreateFile(
 		fsdb.InodeAttributes{
 			Hash: fmt.Sprintf("%x.%s", sha256.Sum(nil), fs.CurrentSnapshot),
 			InodeAttributes: fuseops.InodeAttributes{
-				Size:  0,
-				Nlink: 1,
-				Mode:  op.Mode,
-				Rdev:  0,
-				Uid:   fs.uid,
-				Gid:   fs.gid,
-				Atime: t,
-				Mtime: t,
-				Ctime: t,
+				Size:   0,
+				Nlink:  1,
+				Mode:   op.Mode,
+				Rdev:   0,
+				Uid:    fs.uid,
+				Gid:    fs.gid,
+				Atime:  t,
+				Mtime:  t,
+				Ctime:  t,
+				Crtime: t,
 			},
 		},
 	)
-	if err := fs.AddInode(inode, true); err != nil {
+	txn := fs.metadb.NewTxn()
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	txn.PutDentry(inode)
+	if err := fs.stageParent(txn, op.Parent, t, 0); err != nil {
+		fs.log.Errorf("CreateFile(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
+	}
+	if err := txn.Commit(); err != nil {
 		fs.log.Errorf("CreateFile(%d:%s): %v", op.Parent, op.Name, err)
 		return fuse.EIO
 	}
-	fsHandle, err := monofile.New(fs.Name, inode.ID(), inode.Attrs.Hash, fs.localDataPath)
+	fsHandle, err := monofile.New(fs.Name, inode.ID(), inode.Attrs.Hash, fs.localDataPath, fs.blocks)
 	if err != nil {
 		fs.log.Errorf("CreateFile(%d:%s): %v", op.Parent, op.Name, err)
 		return fuse.EIO
 	}
-	fs.fileHandles[op.Handle] = fsHandle
+	op.Handle = fs.AddFileHandle(fsHandle)
 	op.Entry.Child = inode.ID()
 	op.Entry.Attributes = inode.Attrs.InodeAttributes
+	fs.setEntryExpiration(&op.Entry)
+	fs.refs.Lookup(op.Entry.Child)
 	return nil
 }
 
@@ -70,8 +106,9 @@ func (fs *Monofs) CreateLink(
 	ctx context.Context,
 	op *fuseops.CreateLinkOp) error {
 	fs.log.Debugf("CreateLink(%d:%s)", op.Parent, op.Name)
-	fs.fsHashLock.Lock(op.Parent)
-	defer fs.fsHashLock.Unlock(op.Parent)
+	// the link count of the target is rewritten
+	fs.fsHashLock.LockSet(op.Parent, op.Target)
+	defer fs.fsHashLock.UnlockSet(op.Parent, op.Target)
 	iattr, err := fs.metadb.GetFsdbInodeAttributes(uint64(op.Target))
 	if err != nil {
 		if err == fsdb.ErrNoSuchInode {
@@ -80,19 +117,27 @@ func (fs *Monofs) CreateLink(
 		fs.log.Errorf("CreateLink(GetInodeAttr) %d: %v", op.Target, err)
 		return fuse.EIO
 	}
-	inode := fsdb.NewInode(uint64(op.Target), uint64(op.Parent), op.Name,
-		fsdb.InodeAttributes{
-			Hash:            iattr.Hash,
-			ParentID:        iattr.ParentID,
-			InodeAttributes: iattr.InodeAttributes,
-		})
+	inode := fsdb.NewInode(uint64(op.Target), uint64(op.Parent), op.Name, iattr)
+	// attributes keep the parent of the first name
+	inode.Attrs.ParentID = iattr.ParentID
+	t := fs.Clock.Now()
 	inode.Attrs.Nlink++
-	if err = fs.AddInode(inode, true); err != nil {
+	inode.Attrs.Ctime = t
+	txn := fs.metadb.NewTxn()
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	txn.PutDentry(inode)
+	if err := fs.stageParent(txn, op.Parent, t, 0); err != nil {
+		fs.log.Errorf("CreateLink(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
+	}
+	if err = txn.Commit(); err != nil {
 		fs.log.Errorf("CreateLink(AddInode)(%d:%s): %v", op.Target, op.Name, err)
 		return fuse.EIO
 	}
 	op.Entry.Child = inode.ID()
 	op.Entry.Attributes = inode.Attrs.InodeAttributes
+	fs.setEntryExpiration(&op.Entry)
+	fs.refs.Lookup(op.Entry.Child)
 	return nil
 }
 
@@ -108,23 +153,33 @@ func (fs *Monofs) CreateSymlink(
 		fsdb.InodeAttributes{
 			Hash: op.Target,
 			InodeAttributes: fuseops.InodeAttributes{
-				Size:  0,
-				Nlink: 1,
-				Mode:  0777 | os.ModeSymlink,
-				Rdev:  0,
-				Uid:   fs.uid,
-				Gid:   fs.gid,
-				Ctime: t,
-				Mtime: t,
-				Atime: t,
+				Size:   0,
+				Nlink:  1,
+				Mode:   0777 | os.ModeSymlink,
+				Rdev:   0,
+				Uid:    fs.uid,
+				Gid:    fs.gid,
+				Ctime:  t,
+				Mtime:  t,
+				Atime:  t,
+				Crtime: t,
 			},
 		})
-	if err := fs.AddInode(inode, true); err != nil {
+	txn := fs.metadb.NewTxn()
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	txn.PutDentry(inode)
+	if err := fs.stageParent(txn, op.Parent, t, 0); err != nil {
+		fs.log.Errorf("CreateSymlink(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
+	}
+	if err := txn.Commit(); err != nil {
 		fs.log.Errorf("CreateSymlink(AddInode)(%s:%s): %v", op.Target, op.Name, err)
 		return fuse.EIO
 	}
 	op.Entry.Child = inode.ID()
 	op.Entry.Attributes = inode.Attrs.InodeAttributes
+	fs.setEntryExpiration(&op.Entry)
+	fs.refs.Lookup(op.Entry.Child)
 	return nil
 }
 
@@ -152,82 +207,169 @@ func (fs *Monofs) ReadSymlink(
 func (fs *Monofs) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) error {
+	orphan, err := fs.rename(op)
+	if orphan != 0 {
+		// outside of the parent locks, reclaiming locks the inode
+		fs.orphaned(orphan)
+	}
+	return err
+}
+
+// rename Move the name, returns the replaced inode if it lost its last name.
+func (fs *Monofs) rename(op *fuseops.RenameOp) (fuseops.InodeID, error) {
 	fs.log.Debugf("Rename(%d:%s -> %d:%s)", op.OldParent, op.OldName, op.NewParent, op.NewName)
+	// attributes of the moved and the replaced inode are rewritten
+	locked := fs.lockEntries([]fuseops.InodeID{op.OldParent, op.NewParent},
+		dentryName{op.OldParent, op.OldName}, dentryName{op.NewParent, op.NewName})
+	defer fs.fsHashLock.UnlockSet(locked...)
 	// Look up the source inode.
-	fs.fsHashLock.Lock(op.OldParent)
 	inode, err := fs.GetInode(op.OldParent, op.OldName, true)
 	if err != nil {
-		fs.fsHashLock.Unlock(op.OldParent)
 		if err == fsdb.ErrNoSuchInode {
-			return fuse.ENOENT
+			return 0, fuse.ENOENT
 		}
-		fs.log.Errorf("Rename(GetInode) (%s:%d): %v", op.OldParent, op.OldName, err)
-		return fuse.EIO
+		fs.log.Errorf("Rename(GetInode) (%d:%s): %v", op.OldParent, op.OldName, err)
+		return 0, fuse.EIO
 	}
-	// Remove it from the source directory.
-	err = fs.DeleteInode(inode, false)
-	fs.fsHashLock.Unlock(op.OldParent)
-	if err != nil {
-		fs.log.Errorf("Rename(DeleteInode)(%d:%s): %v", inode.ParentID, inode.Name, err)
-		return fuse.EIO
+	isDir := inode.Attrs.Mode.IsDir()
+	t := fs.Clock.Now()
+	txn := fs.metadb.NewTxn()
+	// Replace the target if it exists.
+	newParentDelta := 0
+	var orphan fuseops.InodeID
+	target, err := fs.GetInode(op.NewParent, op.NewName, true)
+	switch {
+	case err == nil:
+		if target.InodeID == inode.InodeID {
+			return 0, nil
+		}
+		if target.Attrs.Mode.IsDir() {
+			if !isDir {
+				return 0, syscall.EISDIR
+			}
+			children, err := fs.metadb.GetChildrenCount(target.InodeID)
+			if err != nil {
+				fs.log.Errorf("Rename(GetChildrenCount)(%d): %v", target.InodeID, err)
+				return 0, fuse.EIO
+			}
+			if children > 0 {
+				return 0, fuse.ENOTEMPTY
+			}
+			txn.DeleteAttrs(target.InodeID)
+			newParentDelta--
+		} else {
+			if isDir {
+				return 0, fuse.ENOTDIR
+			}
+			if target.Attrs.Nlink > 0 {
+				target.Attrs.Nlink--
+			}
+			target.Attrs.Ctime = t
+			txn.PutAttrs(target.InodeID, target.Attrs)
+			if target.Attrs.Nlink == 0 {
+				txn.PutOrphan(target.InodeID)
+				orphan = target.ID()
+			}
+		}
+	case err != fsdb.ErrNoSuchInode:
+		fs.log.Errorf("Rename(GetInode) (%d:%s): %v", op.NewParent, op.NewName, err)
+		return 0, fuse.EIO
 	}
-
-	fs.fsHashLock.Lock(op.NewParent)
-	defer fs.fsHashLock.Lock(op.NewParent)
-	// Add it to the target directory.
+	// Move it from the source directory to the target directory.
+	txn.DeleteDentry(inode)
 	inode.SetParent(op.NewParent)
 	inode.SetName(op.NewName)
 	inode.SetAttrsParent(op.NewParent)
-	t := fs.Clock.Now()
-	inode.Attrs.Mtime = t
-	inode.Attrs.Atime = t
-	if err = fs.AddInode(inode, true); err != nil {
+	inode.Attrs.Ctime = t
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	txn.PutDentry(inode)
+	if op.OldParent == op.NewParent {
+		err = fs.stageParent(txn, op.NewParent, t, newParentDelta)
+	} else {
+		oldParentDelta := 0
+		if isDir {
+			oldParentDelta--
+			newParentDelta++
+		}
+		if err = fs.stageParent(txn, op.OldParent, t, oldParentDelta); err == nil {
+			err = fs.stageParent(txn, op.NewParent, t, newParentDelta)
+		}
+	}
+	if err != nil {
+		fs.log.Errorf("Rename(stageParent)(%d:%s -> %d:%s): %v", op.OldParent, op.OldName, op.NewParent, op.NewName, err)
+		return 0, fuse.EIO
+	}
+	if err = txn.Commit(); err != nil {
 		fs.log.Errorf("Rename(AddInode)(%d:%s): %v", inode.ParentID, inode.Name, err)
-		return fuse.EIO
+		return 0, fuse.EIO
 	}
-	return nil
+	return orphan, nil
 }
 
 // Unlink remove a file or directory
 func (fs *Monofs) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) error {
-	fs.fsHashLock.Lock(op.Parent)
-	defer fs.fsHashLock.Unlock(op.Parent)
+	orphan, err := fs.unlink(op)
+	if orphan != 0 {
+		// outside of the parent lock, reclaiming locks the inode
+		fs.orphaned(orphan)
+	}
+	return err
+}
+
+// unlink Remove the name, returns the inode if it lost its last name.
+func (fs *Monofs) unlink(op *fuseops.UnlinkOp) (fuseops.InodeID, error) {
+	locked := fs.lockEntries([]fuseops.InodeID{op.Parent}, dentryName{op.Parent, op.Name})
+	defer fs.fsHashLock.UnlockSet(locked...)
 	// Look up the source inode.
 	inode, err := fs.GetInode(op.Parent, op.Name, true)
 	if err != nil {
 		if err == fsdb.ErrNoSuchInode {
-			return fuse.ENOENT
+			return 0, fuse.ENOENT
 		}
 		fs.log.Errorf("Unlink(GetInode)(%d:%s): %v", op.Parent, op.Name, err)
-		return fuse.EIO
+		return 0, fuse.EIO
 	}
 	// check if it's directory
 	if inode.Attrs.Mode&os.ModeDir == os.ModeDir {
-		return syscall.EISDIR
-	}
-	if inode.Attrs.Mode&os.ModeSymlink != os.ModeSymlink {
-		if inode.Attrs.Nlink > 1 {
-			inode.Attrs.Nlink--
-			if err = fs.CreateInodeAttrs(inode); err != nil {
-				fs.log.Errorf("Unlink(CreateInodeAttrs)(%d): %v", inode.ID(), err)
-				return fuse.EIO
-			}
-		} else {
-			if err := fs.DeleteInode(inode, false); err != nil {
-				fs.log.Errorf("Unlink(DeleteInode)(%d:%s): %v", inode.ParentID, inode.Name, err)
-				return fuse.EIO
-			}
-		}
+		return 0, syscall.EISDIR
 	}
-	return nil
+	t := fs.Clock.Now()
+	txn := fs.metadb.NewTxn()
+	txn.DeleteDentry(inode)
+	if inode.Attrs.Nlink > 0 {
+		inode.Attrs.Nlink--
+	}
+	inode.Attrs.Ctime = t
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	// the inode stays until the kernel drops its last lookup and handle
+	if inode.Attrs.Nlink == 0 {
+		txn.PutOrphan(inode.InodeID)
+	}
+	if err := fs.stageParent(txn, op.Parent, t, 0); err != nil {
+		fs.log.Errorf("Unlink(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return 0, fuse.EIO
+	}
+	if err := txn.Commit(); err != nil {
+		fs.log.Errorf("Unlink(DeleteInode)(%d:%s): %v", inode.ParentID, inode.Name, err)
+		return 0, fuse.EIO
+	}
+	if inode.Attrs.Nlink == 0 {
+		return inode.ID(), nil
+	}
+	return 0, nil
 }
 
 // OpenFile open a file
 func (fs *Monofs) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
+	write := !op.OpenFlags.IsReadOnly()
+	if write {
+		fs.fsHashLock.Lock(op.Inode)
+		defer fs.fsHashLock.Unlock(op.Inode)
+	}
 	a, err := fs.metadb.GetFsdbInodeAttributes(uint64(op.Inode))
 	if err != nil {
 		if err == fsdb.ErrNoSuchInode {
@@ -241,13 +383,19 @@ func (fs *Monofs) OpenFile(
 		fs.log.Errorf("OpenFile(GetInodeAttrs)(%d): hash is empty", op.Inode)
 		return fuse.EIO
 	}
+	if write {
+		if a, err = fs.ownData(op.Inode, a); err != nil {
+			fs.log.Errorf("OpenFile(ownData)(%d): %v", op.Inode, err)
+			return fuse.EIO
+		}
+	}
 	// Create a handle.
-	fsh, err := monofile.New(fs.Name, op.Inode, a.GetHash(), fs.localDataPath)
+	fsh, err := monofile.New(fs.Name, op.Inode, a.GetHash(), fs.localDataPath, fs.blocks)
 	if err != nil {
 		fs.log.Errorf("OpenFile(NewFileHandle)(%d): %v", op.Inode, err)
 		return fuse.EIO
 	}
-	fs.fileHandles[op.Handle] = fsh
+	op.Handle = fs.AddFileHandle(fsh)
 	return nil
 }
 
@@ -257,10 +405,11 @@ func (fs *Monofs) ReadFile(
 	op *fuseops.ReadFileOp) error {
 	var err error
 	// Look up the file.
-	handle, ok := fs.fileHandles[op.Handle]
+	handle, ok := fs.GetFileHandle(op.Handle)
 	if !ok {
 		return fuse.EINVAL
 	}
+	fs.touchAtime(op.Inode)
 	// Read the file.
 	op.BytesRead, err = handle.ReadAt(op.Dst, op.Offset, op.Size)
 	return err
@@ -270,7 +419,7 @@ func (fs *Monofs) ReadFile(
 func (fs *Monofs) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) error {
-	handle, ok := fs.fileHandles[op.Handle]
+	handle, ok := fs.GetFileHandle(op.Handle)
 	if !ok {
 		return fuse.EINVAL
 	}
@@ -283,12 +432,16 @@ func (fs *Monofs) WriteFile(
 func (fs *Monofs) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) error {
-	handle, ok := fs.fileHandles[op.Handle]
+	handle, ok := fs.GetFileHandle(op.Handle)
 	if !ok {
 		return fuse.EINVAL
 	}
 	// Flush the file.
-	return handle.Sync()
+	if err := handle.Sync(); err != nil {
+		return err
+	}
+	// so are metadata changes of the file logged before when every WAL entry is synced
+	return fs.metadb.Sync()
 }
 
 // ReleaseFileHandle release a file handle
@@ -296,7 +449,12 @@ func (fs *Monofs) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) error {
 	// Release the file.
-	delete(fs.fileHandles, op.Handle)
+	handle, ok := fs.DeleteFileHandle(op.Handle)
+	if !ok {
+		return nil
+	}
+	inode := handle.GetInodeID()
+	fs.released(inode, fs.refs.Release(inode))
 	return nil
 }
 
@@ -304,10 +462,43 @@ func (fs *Monofs) ReleaseFileHandle(
 func (fs *Monofs) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) error {
-	handle, ok := fs.fileHandles[op.Handle]
+	handle, ok := fs.GetFileHandle(op.Handle)
 	if !ok {
 		return fuse.EINVAL
 	}
 	// Flush the file.
-	return handle.Sync()
+	if err := handle.Sync(); err != nil {
+		return err
+	}
+	// so are metadata changes of the file logged before when every WAL entry is synced
+	return fs.metadb.Sync()
+}
+
+// ownData Copy data of a file opened for writing which is shared with
+// snapshots. Data is named after the snapshot current when it was created,
+// data of an earlier snapshot is copied under a new name of the current one
+// and the snapshot keeps the old data. Must be called with inode locked.
+func (fs *Monofs) ownData(inode fuseops.InodeID, attrs fsdb.InodeAttributes) (fsdb.InodeAttributes, error) {
+	if attrs.Hash == "" || fs.readOnly {
+		return attrs, nil
+	}
+	current, err := fs.metadb.Snapshot.CurrentHash()
+	if err != nil {
+		return attrs, err
+	}
+	if current == "" || strings.HasSuffix(attrs.Hash, "."+current) {
+		return attrs, nil
+	}
+	sha256 := sha256.New()
+	sha256.Write([]byte(attrs.Hash))
+	sha256.Write([]byte(fs.Clock.Now().String()))
+	sha256.Write([]byte(utils.RandString(32)))
+	hash := fmt.Sprintf("%x.%s", sha256.Sum(nil), current)
+	if err := monofile.CopyBlocks(fs.blocks, fs.localDataPath, attrs.Hash, hash, attrs.Size); err != nil {
+		return attrs, err
+	}
+	attrs.Hash = hash
+	txn := fs.metadb.NewTxn()
+	txn.PutAttrs(uint64(inode), attrs)
+	return attrs, txn.Commit()
 }
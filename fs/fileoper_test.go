@@ -0,0 +1,95 @@
+package monofs
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/radek-ryckowski/monofs/fs/config"
+	monofile "github.com/radek-ryckowski/monofs/fs/file"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+func TestOpenFileCopiesSnapshotData(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewMonoFS(&config.Config{
+		Path:           dir,
+		LocalDataPath:  dir,
+		FilesystemName: "test",
+		InMemory:       true,
+
+		DentryCacheSize:        fsdb.DefaultDentryCacheSize,
+		DentryCacheTTL:         fsdb.DefaultDentryCacheTTL,
+		NegativeDentryCacheTTL: fsdb.DefaultNegativeDentryCacheTTL,
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Destroy()
+	if _, err := NewMonoFuseFS(fs); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "file", Mode: 0644}
+	assert.NoError(t, fs.CreateFile(ctx, create))
+	assert.NoError(t, fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle}))
+	file := create.Entry.Child
+	size := uint64(4096)
+	assert.NoError(t, fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: file, Size: &size}))
+
+	hash := func() string {
+		t.Helper()
+		attrs, err := fs.metadb.GetFsdbInodeAttributes(uint64(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return attrs.Hash
+	}
+	blocks := func(hash string) monofile.BlockStore {
+		t.Helper()
+		store, err := fs.blocks(fs.localDataPath, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	open := func(write bool) {
+		t.Helper()
+		op := &fuseops.OpenFileOp{Inode: file}
+		if write {
+			op.OpenFlags = syscall.O_RDWR
+		}
+		assert.NoError(t, fs.OpenFile(ctx, op))
+		assert.NoError(t, fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: op.Handle}))
+	}
+	old := hash()
+	assert.NoError(t, blocks(old).Put(utils.Uint64ToBytes(0), []byte("old")))
+	// data of the current snapshot isn't shared yet
+	open(true)
+	assert.Equal(t, old, hash())
+
+	current, err := fs.metadb.Snapshot.CreateSyncSnapshot("next")
+	assert.NoError(t, err)
+	open(false)
+	assert.Equal(t, old, hash())
+	open(true)
+	copied := hash()
+	assert.NotEqual(t, old, copied)
+	assert.True(t, strings.HasSuffix(copied, "."+current))
+	data, err := blocks(copied).Get(utils.Uint64ToBytes(0))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), data)
+	// writes of the head leave the data of the snapshot as it was
+	assert.NoError(t, blocks(copied).Put(utils.Uint64ToBytes(0), []byte("new")))
+	data, err = blocks(old).Get(utils.Uint64ToBytes(0))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), data)
+	open(true)
+	assert.Equal(t, copied, hash())
+}
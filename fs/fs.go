@@ -7,6 +7,8 @@ import (
 	"os"
 	"time"
 
+	"github.com/radek-ryckowski/monofs/fs/atime"
+	monofile "github.com/radek-ryckowski/monofs/fs/file"
 	"github.com/radek-ryckowski/monofs/fs/fsdb"
 
 	"github.com/jacobsa/fuse"
@@ -24,7 +26,7 @@ func NewMonoFuseFS(fs *Monofs) (fuse.Server, error) {
 	fs.nextInode = fuseops.RootInodeID + 1
 	rootInode, err := fs.GetInode(fuseops.RootInodeID-1, "", true)
 	if err != nil {
-		if !errors.Is(err, fsdb.ErrNoSuchInode) {
+		if !errors.Is(err, fsdb.ErrNoSuchInode) || fs.readOnly {
 			return nil, fmt.Errorf("failed to get root inode: %v", err)
 		}
 		// Create the root directory.
@@ -33,7 +35,7 @@ func NewMonoFuseFS(fs *Monofs) (fuse.Server, error) {
 			Hash: "",
 			InodeAttributes: fuseops.InodeAttributes{
 				Size:   4096,
-				Nlink:  1,
+				Nlink:  2,
 				Mode:   os.ModeDir | 0755,
 				Rdev:   0,
 				Atime:  t,
@@ -48,10 +50,18 @@ func NewMonoFuseFS(fs *Monofs) (fuse.Server, error) {
 			return nil, err
 		}
 	}
+	// a snapshot never allocates inodes nor has orphans of its own
+	if fs.readOnly {
+		fs.log.Debugf("root Inode: %d snapshot: %s read-only", rootInode.ID(), fs.CurrentSnapshot)
+		return fuseutil.NewFileSystemServer(fs), nil
+	}
 	if err = fs.lastInodeEngine.Init(); err != nil {
 		return nil, err
 	}
 	fs.GetLastInode()
+	if err = fs.reclaimOrphans(); err != nil {
+		return nil, fmt.Errorf("failed to reclaim orphans: %v", err)
+	}
 	fs.lockInode.RLock()
 	fs.log.Debugf("Last inode: %v root Inode: %d snapshot: %s", fs.nextInode, rootInode.ID(), fs.CurrentSnapshot)
 	fs.lockInode.RUnlock()
@@ -117,6 +127,37 @@ func (fs *Monofs) DeleteDirHandle(handle fuseops.HandleID) {
 	delete(fs.dirHandles, handle)
 }
 
+// AddFileHandle register file under an unused handle id
+func (fs *Monofs) AddFileHandle(file *monofile.FsFile) fuseops.HandleID {
+	fs.lockHandle.Lock()
+	defer fs.lockHandle.Unlock()
+	handle := fs.nextHandle
+	for _, ok := fs.fileHandles[handle]; ok; _, ok = fs.fileHandles[handle] {
+		handle++
+	}
+	fs.nextHandle = handle + 1
+	fs.fileHandles[handle] = file
+	fs.refs.Open(file.GetInodeID())
+	return handle
+}
+
+// GetFileHandle get file of an open handle
+func (fs *Monofs) GetFileHandle(handle fuseops.HandleID) (*monofile.FsFile, bool) {
+	fs.lockHandle.Lock()
+	defer fs.lockHandle.Unlock()
+	file, ok := fs.fileHandles[handle]
+	return file, ok
+}
+
+// DeleteFileHandle delete file handle
+func (fs *Monofs) DeleteFileHandle(handle fuseops.HandleID) (*monofile.FsFile, bool) {
+	fs.lockHandle.Lock()
+	defer fs.lockHandle.Unlock()
+	file, ok := fs.fileHandles[handle]
+	delete(fs.fileHandles, handle)
+	return file, ok
+}
+
 // NewInode Create a new inode.
 func (fs *Monofs) NewInode(parent fuseops.InodeID, name string, attr fsdb.InodeAttributes) *fsdb.Inode {
 	ID := fs.NextInode()
@@ -158,18 +199,112 @@ func (fs *Monofs) UpdateInodeAttrs(inode fuseops.InodeID, attr fuseops.InodeAttr
 	return fs.metadb.UpdateInodeAttrs(uint64(inode), attr)
 }
 
-// patchTime Update the inode attributes (not in db) with the current time.
-func (fs *Monofs) patchTime(attr *fuseops.InodeAttributes) time.Time {
-	now := fs.Clock.Now()
-	attr.Atime = now
-	return time.Now()
+// touchAtime Record a read access to the inode according to the atime policy.
+func (fs *Monofs) touchAtime(inode fuseops.InodeID) {
+	if fs.atime.Policy() == atime.Noatime {
+		return
+	}
+	attrs, err := fs.GetInodeAttrs(inode)
+	if err != nil {
+		if !errors.Is(err, fsdb.ErrNoSuchInode) {
+			fs.log.Errorf("touchAtime(%d): %v", inode, err)
+		}
+		return
+	}
+	fs.atime.Access(inode, attrs, fs.Clock.Now())
+}
+
+// flushAtime Persist a lazily updated access time.
+func (fs *Monofs) flushAtime(inode fuseops.InodeID, t time.Time) error {
+	fs.fsHashLock.Lock(inode)
+	defer fs.fsHashLock.Unlock(inode)
+	// set explicitly or reclaimed since the flush started
+	if !fs.atime.Flushing(inode, t) {
+		return nil
+	}
+	err := fs.metadb.UpdateInodeAtime(uint64(inode), t)
+	if errors.Is(err, fsdb.ErrNoSuchInode) {
+		return nil
+	}
+	return err
+}
+
+// dentryName Name of an entry in a directory.
+type dentryName struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// lockEntries Lock dirs and the inodes names point to in a stable order, so
+// operations rewriting attributes of a child exclude SetInodeAttributes of it.
+// Names are resolved before their inodes can be locked, the lookup is repeated
+// under the locks until it matches. Returns the keys to pass to UnlockSet.
+func (fs *Monofs) lockEntries(dirs []fuseops.InodeID, names ...dentryName) []fuseops.InodeID {
+	children := fs.lookupIDs(names)
+	for {
+		keys := append(append([]fuseops.InodeID{}, dirs...), children...)
+		fs.fsHashLock.LockSet(keys...)
+		current := fs.lookupIDs(names)
+		same := true
+		for i := range current {
+			same = same && current[i] == children[i]
+		}
+		if same {
+			return keys
+		}
+		fs.fsHashLock.UnlockSet(keys...)
+		children = current
+	}
+}
+
+// lookupIDs Inodes names point to, missing names are left out and reported by
+// the lookups made under the locks.
+func (fs *Monofs) lookupIDs(names []dentryName) []fuseops.InodeID {
+	ids := make([]fuseops.InodeID, 0, len(names))
+	for _, n := range names {
+		id := fuseops.InodeID(0)
+		if inode, err := fs.GetInode(n.parent, n.name, false); err == nil {
+			id = inode.ID()
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// stageParent Stage parent directory mtime/ctime update and link count change in txn.
+func (fs *Monofs) stageParent(txn *fsdb.Txn, parent fuseops.InodeID, t time.Time, nlinkDelta int) error {
+	attrs, err := fs.metadb.GetFsdbInodeAttributes(uint64(parent))
+	if err != nil {
+		return err
+	}
+	attrs.Mtime = t
+	attrs.Ctime = t
+	// directory link count is 2 (its name in the parent and ".") plus number of subdirectories
+	nlink := int(attrs.Nlink) + nlinkDelta
+	if nlink < 2 {
+		nlink = 2
+	}
+	attrs.Nlink = uint32(nlink)
+	txn.PutAttrs(uint64(parent), attrs)
+	return nil
 }
 
 // Destroy Stop the filesystem.
 func (fs *Monofs) Destroy() {
+	stats := fs.metadb.DentryCacheStats()
+	fs.log.Infof("dentry cache: %d hits, %d negative hits, %d misses, %d evictions",
+		stats.Hits, stats.NegativeHits, stats.Misses, stats.Evictions)
+	fs.gc.Stop()
+	fs.converter.Stop()
+	if err := fs.atime.Stop(); err != nil {
+		fs.log.Errorf("Error flushing access times: %v", err)
+	}
 	if err := fs.metadb.Close(); err != nil {
 		fs.log.Errorf("Error closing metadb: %v", err)
 	}
+	if fs.lastInodeEngine == nil {
+		return
+	}
 	if err := fs.lastInodeEngine.Close(); err != nil {
 		fs.log.Errorf("Error closing lastInodeEngine: %v", err)
 	}
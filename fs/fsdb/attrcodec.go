@@ -0,0 +1,118 @@
+package fsdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// attrsVersion is the first byte of binary attribute records. Records written
+// before it start with '{' and are JSON.
+const attrsVersion byte = 1
+
+var errShortAttrs = errors.New("truncated attribute record")
+
+// zeroUnix is the unix time of the zero time.Time
+var zeroUnix = time.Time{}.Unix()
+
+// isJSONAttrs reports whether an attribute record is in the legacy format
+func isJSONAttrs(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
+
+// encodeAttrs serialises attributes as: version byte, varints of parent id,
+// size, nlink, mode, rdev, uid and gid, the four timestamps as seconds and
+// nanoseconds, then the length prefixed data hash
+func encodeAttrs(ia *InodeAttributes) []byte {
+	buf := make([]byte, 0, 64+len(ia.Hash))
+	buf = append(buf, attrsVersion)
+	for _, v := range []uint64{
+		ia.ParentID,
+		ia.Size,
+		uint64(ia.Nlink),
+		uint64(ia.Mode),
+		uint64(ia.Rdev),
+		uint64(ia.Uid),
+		uint64(ia.Gid),
+	} {
+		buf = binary.AppendUvarint(buf, v)
+	}
+	for _, t := range []time.Time{ia.Atime, ia.Mtime, ia.Ctime, ia.Crtime} {
+		buf = binary.AppendVarint(buf, t.Unix())
+		buf = binary.AppendUvarint(buf, uint64(t.Nanosecond()))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(ia.Hash)))
+	return append(buf, ia.Hash...)
+}
+
+type attrsDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *attrsDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errShortAttrs
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *attrsDecoder) time() time.Time {
+	if d.err != nil {
+		return time.Time{}
+	}
+	sec, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errShortAttrs
+		return time.Time{}
+	}
+	d.data = d.data[n:]
+	nsec := d.uvarint()
+	if sec == zeroUnix && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+// decodeAttrs reads a record in any supported format
+func decodeAttrs(data []byte, ia *InodeAttributes) error {
+	if isJSONAttrs(data) {
+		return json.Unmarshal(data, ia)
+	}
+	if len(data) == 0 {
+		return errShortAttrs
+	}
+	if data[0] != attrsVersion {
+		return fmt.Errorf("unsupported attribute record version %d", data[0])
+	}
+	d := &attrsDecoder{data: data[1:]}
+	ia.ParentID = d.uvarint()
+	ia.Size = d.uvarint()
+	ia.Nlink = uint32(d.uvarint())
+	ia.Mode = os.FileMode(d.uvarint())
+	ia.Rdev = uint32(d.uvarint())
+	ia.Uid = uint32(d.uvarint())
+	ia.Gid = uint32(d.uvarint())
+	ia.Atime = d.time()
+	ia.Mtime = d.time()
+	ia.Ctime = d.time()
+	ia.Crtime = d.time()
+	n := d.uvarint()
+	if d.err != nil {
+		return d.err
+	}
+	if uint64(len(d.data)) < n {
+		return errShortAttrs
+	}
+	ia.Hash = string(d.data[:n])
+	return nil
+}
@@ -53,7 +53,7 @@ func TestCacheStore(t *testing.T) {
 			t.Errorf("item not in cache: %d", i)
 		}
 		// get item from badger
-		_, err := db.astore.Get(utils.Uint64ToBytes(uint64(i)), nil)
+		_, err := db.astore.Get(utils.Uint64ToBytes(uint64(i)))
 		if err == nil {
 			t.Errorf("item %d in db", i)
 		}
@@ -88,7 +88,7 @@ func TestCacheStore(t *testing.T) {
 				notFoundInodes++
 			}
 		}
-		_, err := db.astore.Get(utils.Uint64ToBytes(uint64(i)), nil)
+		_, err := db.astore.Get(utils.Uint64ToBytes(uint64(i)))
 		if err != nil {
 			t.Fatal(err)
 		}
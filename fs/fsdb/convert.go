@@ -0,0 +1,163 @@
+package fsdb
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	"github.com/radek-ryckowski/monofs/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultAttrsConvertInterval how often a batch of JSON attribute records is converted
+	DefaultAttrsConvertInterval = time.Second
+	// DefaultAttrsConvertBatch how many records are converted at once
+	DefaultAttrsConvertBatch = 1000
+)
+
+// AttrsConverter rewrites attribute records still stored as JSON in the binary
+// format. Converted records go through the cache like any other change, and a
+// record is skipped when the cache already holds a newer version of it.
+type AttrsConverter struct {
+	db    *Fsdb
+	batch int
+	log   *zap.SugaredLogger
+	mu    sync.Mutex
+	// next inode id to look at and records converted in the current pass
+	next      uint64
+	converted int
+	stop      chan bool
+	wg        sync.WaitGroup
+}
+
+// NewAttrsConverter creates a converter of attribute records in db
+func NewAttrsConverter(db *Fsdb, batch int, log *zap.SugaredLogger) *AttrsConverter {
+	return &AttrsConverter{
+		db:    db,
+		batch: batch,
+		log:   log,
+		stop:  make(chan bool),
+	}
+}
+
+// Start converts a batch every interval until no JSON record is left, a zero
+// interval disables it
+func (c *AttrsConverter) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		total := 0
+		for {
+			select {
+			case <-ticker.C:
+				n, done, err := c.Step()
+				if err != nil {
+					c.log.Errorf("attributes conversion: %v", err)
+					continue
+				}
+				total += n
+				if done {
+					if total > 0 {
+						c.log.Infof("converted %d attribute records to the binary format", total)
+					}
+					return
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background conversion
+func (c *AttrsConverter) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+// Step looks at up to a batch of records and converts the JSON ones, done is
+// reported once a whole pass over the attribute store converted nothing
+func (c *AttrsConverter) Step() (int, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	type record struct {
+		id   uint64
+		data []byte
+	}
+	records := []record{}
+	end := true
+	scanned := 0
+	iter := c.db.astore.NewIterator(nil)
+	for ok := iter.Seek(utils.Uint64ToBytes(c.next)); ok; ok = iter.Next() {
+		if scanned >= c.batch {
+			end = false
+			break
+		}
+		scanned++
+		if bytes.Equal(iter.Key(), wal.CheckpointKey) {
+			continue
+		}
+		id := utils.BytesToUint64(iter.Key())
+		c.next = id + 1
+		if isJSONAttrs(iter.Value()) {
+			records = append(records, record{id: id, data: append([]byte{}, iter.Value()...)})
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, false, err
+	}
+	n := 0
+	for _, r := range records {
+		var a InodeAttributes
+		if err := a.Unmarshall(r.data); err != nil {
+			c.log.Warnf("attributes of %d can't be converted: %v", r.id, err)
+			continue
+		}
+		buf, err := a.Marshall()
+		if err != nil {
+			return n, false, err
+		}
+		// the record may have been rewritten and evicted from the cache since
+		// it was read, it is compared while it can't be cached again
+		added, err := c.db.aCache.AddIfAbsentFunc(r.id, func() ([]byte, error) {
+			cur, err := c.db.astore.Get(utils.Uint64ToBytes(r.id))
+			if err != nil {
+				if errors.Is(err, metastore.ErrNotFound) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			if !bytes.Equal(cur, r.data) {
+				return nil, nil
+			}
+			return buf, nil
+		}, 0)
+		if err != nil {
+			return n, false, err
+		}
+		if added {
+			n++
+		}
+	}
+	c.converted += n
+	if !end {
+		return n, false, nil
+	}
+	// converted records reach the store after the cache is flushed, start
+	// over until a pass converts nothing. Records cached in the JSON format
+	// stay readable and are left as they are.
+	done := c.converted == 0
+	c.next = 0
+	c.converted = 0
+	return n, done, nil
+}
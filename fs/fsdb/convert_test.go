@@ -0,0 +1,67 @@
+package fsdb
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAttrsConverter(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for id := uint64(10); id < 15; id++ {
+		attrs := InodeAttributes{ParentID: 1, InodeAttributes: fuseops.InodeAttributes{Size: id, Nlink: 1, Mode: 0644}}
+		buf, _ := json.Marshal(&attrs)
+		if err := db.astore.Put(utils.Uint64ToBytes(id), buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a newer version in the cache wins over the stored record
+	if err := db.UpdateInodeAttrs(12, fuseops.InodeAttributes{Size: 100, Nlink: 1, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewAttrsConverter(db, 2, zap.NewNop().Sugar())
+	total := 0
+	for i := 0; i < 10; i++ {
+		n, done, err := c.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, 4, total)
+	for id := uint64(10); id < 15; id++ {
+		val, err := db.aCache.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, isJSONAttrs(val))
+		attrs, err := db.GetFsdbInodeAttributes(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 12 {
+			assert.Equal(t, uint64(100), attrs.Size)
+		} else {
+			assert.Equal(t, id, attrs.Size)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package fsdb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDentryCacheSize how many parent/name pairs are cached
+	DefaultDentryCacheSize = 100000
+	// DefaultDentryCacheTTL how long a found name is cached
+	DefaultDentryCacheTTL = time.Minute
+	// DefaultNegativeDentryCacheTTL how long a missing name is cached
+	DefaultNegativeDentryCacheTTL = 10 * time.Second
+)
+
+// DentryCacheStats counters of a dentry cache
+type DentryCacheStats struct {
+	// Hits lookups answered with an inode
+	Hits uint64
+	// NegativeHits lookups answered with a cached missing name
+	NegativeHits uint64
+	// Misses lookups which had to read the inode store
+	Misses uint64
+	// Evictions entries dropped to stay within the size
+	Evictions uint64
+	// Entries currently cached
+	Entries int
+}
+
+type dentryKey struct {
+	parent uint64
+	name   string
+}
+
+type dentryEntry struct {
+	key dentryKey
+	// inode is zero for a missing name
+	inode   uint64
+	expires time.Time
+}
+
+// DentryCache caches parent/name to inode lookups of the inode store,
+// including names which don't exist. Entries are dropped after their TTL,
+// least recently used ones go first when the cache is full.
+type DentryCache struct {
+	mu          sync.Mutex
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[dentryKey]*list.Element
+	lru         *list.List
+	// gen changes on every invalidation, lookups started before it must not
+	// add what they read
+	gen   uint64
+	stats DentryCacheStats
+	now   func() time.Time
+}
+
+// NewDentryCache creates a cache of up to size entries, a size of zero
+// disables caching and a zero negativeTTL disables negative entries
+func NewDentryCache(size int, ttl, negativeTTL time.Duration) *DentryCache {
+	return &DentryCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[dentryKey]*list.Element),
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+// Get returns the cached inode of name in parent, ok is false on a miss and
+// inode is zero when the name is known not to exist. gen has to be passed to
+// Add after a miss.
+func (c *DentryCache) Get(parent uint64, name string) (inode uint64, ok bool, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[dentryKey{parent: parent, name: name}]
+	if found {
+		e := elem.Value.(*dentryEntry)
+		if c.now().Before(e.expires) {
+			c.lru.MoveToFront(elem)
+			if e.inode == 0 {
+				c.stats.NegativeHits++
+			} else {
+				c.stats.Hits++
+			}
+			return e.inode, true, c.gen
+		}
+		c.remove(elem)
+	}
+	c.stats.Misses++
+	return 0, false, c.gen
+}
+
+// Add caches inode of name in parent, a zero inode caches a missing name.
+// Nothing is added when the cache was invalidated since gen was returned.
+func (c *DentryCache) Add(parent uint64, name string, inode uint64, gen uint64) {
+	ttl := c.ttl
+	if inode == 0 {
+		ttl = c.negativeTTL
+	}
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	key := dentryKey{parent: parent, name: name}
+	if elem, found := c.entries[key]; found {
+		e := elem.Value.(*dentryEntry)
+		e.inode, e.expires = inode, c.now().Add(ttl)
+		c.lru.MoveToFront(elem)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&dentryEntry{key: key, inode: inode, expires: c.now().Add(ttl)})
+}
+
+// Invalidate drops name in parent, it has to be called on every change of the name
+func (c *DentryCache) Invalidate(parent uint64, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if elem, found := c.entries[dentryKey{parent: parent, name: name}]; found {
+		c.remove(elem)
+	}
+}
+
+// Purge drops all entries
+func (c *DentryCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[dentryKey]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns the cache counters
+func (c *DentryCache) Stats() DentryCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// remove drops an entry, must be called with lock held
+func (c *DentryCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*dentryEntry).key)
+	c.lru.Remove(elem)
+}
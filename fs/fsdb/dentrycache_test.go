@@ -0,0 +1,124 @@
+package fsdb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+)
+
+func TestDentryCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := NewDentryCache(2, time.Minute, time.Second)
+	c.now = func() time.Time { return now }
+
+	_, ok, gen := c.Get(1, "a")
+	if ok {
+		t.Fatal("hit on empty cache")
+	}
+	c.Add(1, "a", 10, gen)
+	c.Add(1, "missing", 0, gen)
+	if id, ok, _ := c.Get(1, "a"); !ok || id != 10 {
+		t.Fatalf("got %d %v, want 10 true", id, ok)
+	}
+	if id, ok, _ := c.Get(1, "missing"); !ok || id != 0 {
+		t.Fatalf("got %d %v, want negative hit", id, ok)
+	}
+
+	// negative entries expire sooner
+	now = now.Add(2 * time.Second)
+	if _, ok, _ := c.Get(1, "missing"); ok {
+		t.Fatal("expired negative entry hit")
+	}
+
+	// a lookup racing an invalidation must not add what it read
+	_, _, gen = c.Get(1, "b")
+	c.Invalidate(1, "b")
+	c.Add(1, "b", 11, gen)
+	if _, ok, _ := c.Get(1, "b"); ok {
+		t.Fatal("stale entry added")
+	}
+
+	// least recently used goes first
+	_, _, gen = c.Get(1, "b")
+	c.Add(1, "b", 11, gen)
+	c.Get(1, "a")
+	c.Add(1, "c", 12, gen)
+	if _, ok, _ := c.Get(1, "b"); ok {
+		t.Fatal("least recently used entry kept")
+	}
+	if _, ok, _ := c.Get(1, "a"); !ok {
+		t.Fatal("recently used entry evicted")
+	}
+
+	c.Invalidate(1, "a")
+	if _, ok, _ := c.Get(1, "a"); ok {
+		t.Fatal("invalidated entry hit")
+	}
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.NegativeHits != 1 || stats.Evictions != 1 || stats.Entries != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	c.Purge()
+	if c.Stats().Entries != 0 {
+		t.Fatal("entries left after purge")
+	}
+}
+
+func TestFsdbDentryCache(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:                   t.TempDir(),
+		FilesystemName:         "test",
+		CacheSize:              10000,
+		DentryCacheSize:        100,
+		DentryCacheTTL:         time.Minute,
+		NegativeDentryCacheTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dir := NewInode(10, 1, "dir", InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+	})
+	if _, err := db.GetInode(1, "dir", true); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+	if _, err := db.GetInode(1, "dir", true); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+	if s := db.DentryCacheStats(); s.NegativeHits != 1 || s.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// creating the name drops the negative entry
+	if err := db.AddInode(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetInode(1, "dir", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := db.DentryCacheStats(); s.Hits != 1 || s.Misses != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// so does a rename
+	txn := db.NewTxn()
+	txn.DeleteDentry(dir)
+	dir.SetName("renamed")
+	txn.PutDentry(dir)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetInode(1, "dir", true); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+	if _, err := db.GetInode(1, "renamed", true); err != nil {
+		t.Fatal(err)
+	}
+}
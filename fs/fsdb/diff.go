@@ -0,0 +1,252 @@
+package fsdb
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"sort"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+const (
+	// DiffAdded path exists only in the new tree
+	DiffAdded = "added"
+	// DiffRemoved path exists only in the old tree
+	DiffRemoved = "removed"
+	// DiffModified path holds the same inode with changed attributes
+	DiffModified = "modified"
+	// DiffRenamed inode is reached by another path in the new tree
+	DiffRenamed = "renamed"
+)
+
+// DiffEntry is a path changed between two trees, Old is nil for added paths
+// and New for removed ones
+type DiffEntry struct {
+	Kind    string
+	Inode   uint64
+	OldPath string
+	NewPath string
+	Old     *InodeAttributes
+	New     *InodeAttributes
+}
+
+// Path returns the path the entry is ordered by, the new one unless removed
+func (e *DiffEntry) Path() string {
+	if e.NewPath != "" {
+		return e.NewPath
+	}
+	return e.OldPath
+}
+
+// Diff compares the tree of old with the tree of db and calls fn with changed
+// paths in path order. Inodes are matched by id, so moving a directory
+// reports everything under it renamed, names of a hard linked file are paired
+// in path order. Access and change times are ignored and so is the modification
+// time of directories, changes of their entries are reported on their own.
+func (db *Fsdb) Diff(old *Fsdb, fn func(*DiffEntry) error) error {
+	oldPaths, err := old.paths()
+	if err != nil {
+		return err
+	}
+	newPaths, err := db.paths()
+	if err != nil {
+		return err
+	}
+	entries := []*DiffEntry{}
+	for id, paths := range newPaths {
+		if _, ok := oldPaths[id]; !ok {
+			a, err := db.diffAttrs(id)
+			if err != nil {
+				return err
+			}
+			for _, p := range paths {
+				entries = append(entries, &DiffEntry{Kind: DiffAdded, Inode: id, NewPath: p, New: a})
+			}
+		}
+	}
+	for id, before := range oldPaths {
+		oldAttrs, err := old.diffAttrs(id)
+		if err != nil {
+			return err
+		}
+		after, ok := newPaths[id]
+		if !ok {
+			for _, p := range before {
+				entries = append(entries, &DiffEntry{Kind: DiffRemoved, Inode: id, OldPath: p, Old: oldAttrs})
+			}
+			continue
+		}
+		newAttrs, err := db.diffAttrs(id)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, diffNames(id, before, after, oldAttrs, newAttrs)...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path() < entries[j].Path()
+	})
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffSnapshots compares the snapshot from with the snapshot to, or with the
+// head when to is empty. Copies of the snapshots are opened read-only.
+func (db *Fsdb) DiffSnapshots(from, to string, fn func(*DiffEntry) error) error {
+	if from == "" {
+		return errors.New("snapshot to compare from not set")
+	}
+	old, err := db.openCopy(from)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	if to == "" {
+		return db.Diff(old, fn)
+	}
+	cur, err := db.openCopy(to)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	return cur.Diff(old, fn)
+}
+
+// openCopy opens the copy of snapshot name, attributes are read once so
+// nothing is cached
+func (db *Fsdb) openCopy(name string) (*Fsdb, error) {
+	return OpenSnapshot(&config.Config{Path: db.path, Snapshot: name})
+}
+
+// diffNames compares sorted paths of an inode present in both trees
+func diffNames(id uint64, before, after []string, oldAttrs, newAttrs *InodeAttributes) []*DiffEntry {
+	entries := []*DiffEntry{}
+	modified := attrsChanged(oldAttrs, newAttrs)
+	kept := map[string]bool{}
+	for _, p := range after {
+		kept[p] = true
+	}
+	removed := []string{}
+	for _, p := range before {
+		if !kept[p] {
+			removed = append(removed, p)
+			continue
+		}
+		delete(kept, p)
+		if modified {
+			entries = append(entries, &DiffEntry{Kind: DiffModified, Inode: id, OldPath: p, NewPath: p, Old: oldAttrs, New: newAttrs})
+		}
+	}
+	added := []string{}
+	for _, p := range after {
+		if kept[p] {
+			added = append(added, p)
+		}
+	}
+	for i := 0; i < len(removed) || i < len(added); i++ {
+		e := &DiffEntry{Inode: id, Old: oldAttrs, New: newAttrs}
+		switch {
+		case i >= len(added):
+			e.Kind, e.OldPath, e.New = DiffRemoved, removed[i], nil
+		case i >= len(removed):
+			e.Kind, e.NewPath, e.Old = DiffAdded, added[i], nil
+		default:
+			e.Kind, e.OldPath, e.NewPath = DiffRenamed, removed[i], added[i]
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// attrsChanged reports whether attributes differ in what Diff compares
+func attrsChanged(a, b *InodeAttributes) bool {
+	if a.Mode != b.Mode || a.Uid != b.Uid || a.Gid != b.Gid {
+		return true
+	}
+	if a.Mode.IsDir() {
+		return false
+	}
+	return a.Hash != b.Hash || a.Size != b.Size || a.Rdev != b.Rdev || !a.Mtime.Equal(b.Mtime)
+}
+
+// diffAttrs returns attributes of an inode, empty ones when it has none
+func (db *Fsdb) diffAttrs(id uint64) (*InodeAttributes, error) {
+	a, err := db.GetFsdbInodeAttributes(id)
+	if err != nil && !errors.Is(err, ErrNoSuchInode) {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// paths returns sorted paths of inodes reachable from the root by their ids,
+// read from a consistent view of the inode store
+func (db *Fsdb) paths() (map[uint64][]string, error) {
+	snap, err := db.istore.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	// a directory has a single name, the first one seen is used for files
+	parents := map[uint64]*fsckDentry{}
+	dentries := []*fsckDentry{}
+	iter := snap.NewIterator(nil)
+	for iter.Next() {
+		if bytes.HasPrefix(iter.Key(), metaPrefix) {
+			continue
+		}
+		parent, name, ok := ParseDbInodeKey(iter.Key())
+		// the root is stored under an empty name
+		if !ok || name == "" {
+			continue
+		}
+		d := &fsckDentry{parent: parent, name: name, id: utils.BytesToUint64(iter.Value())}
+		dentries = append(dentries, d)
+		if _, ok := parents[d.id]; !ok {
+			parents[d.id] = d
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	dirs := map[uint64]string{fuseops.RootInodeID: "/"}
+	resolving := map[uint64]bool{}
+	var dirPath func(id uint64) (string, bool)
+	dirPath = func(id uint64) (string, bool) {
+		if p, ok := dirs[id]; ok {
+			return p, true
+		}
+		d, ok := parents[id]
+		// entries disconnected from the root or looping are skipped
+		if !ok || resolving[id] {
+			return "", false
+		}
+		resolving[id] = true
+		p, ok := dirPath(d.parent)
+		delete(resolving, id)
+		if !ok {
+			return "", false
+		}
+		p = path.Join(p, d.name)
+		dirs[id] = p
+		return p, true
+	}
+	paths := map[uint64][]string{}
+	for _, d := range dentries {
+		p, ok := dirPath(d.parent)
+		if !ok {
+			continue
+		}
+		paths[d.id] = append(paths[d.id], path.Join(p, d.name))
+	}
+	for _, p := range paths {
+		sort.Strings(p)
+	}
+	return paths, nil
+}
@@ -0,0 +1,112 @@
+package fsdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	inodes := map[string]*Inode{}
+	add := func(id, parent uint64, name string, mode os.FileMode, hash string) {
+		t.Helper()
+		inode := NewInode(id, parent, name, InodeAttributes{
+			Hash:            hash,
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: mode},
+		})
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+		inodes[name] = inode
+	}
+	rename := func(inode *Inode, parent uint64, name string) {
+		t.Helper()
+		if err := db.DeleteInode(inode, false); err != nil {
+			t.Fatal(err)
+		}
+		inode.ParentID, inode.Name = parent, name
+		if err := db.AddInode(inode, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := func(name string) {
+		t.Helper()
+		if _, err := db.Snapshot.CreateSyncSnapshot(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diff := func(from, to string) []string {
+		t.Helper()
+		changes := []string{}
+		err := db.DiffSnapshots(from, to, func(e *DiffEntry) error {
+			changes = append(changes, e.Kind+" "+e.OldPath+" "+e.NewPath)
+			return nil
+		})
+		assert.NoError(t, err)
+		return changes
+	}
+
+	// a copy holds the tree as it was when the next snapshot was created
+	snapshot("first")
+	add(10, 1, "src", os.ModeDir|0755, "")
+	add(11, 10, "a", 0644, "a1")
+	add(12, 10, "b", 0644, "b1")
+	add(13, 1, "keep", 0644, "k1")
+	snapshot("second")
+	inodes["a"].Attrs.Hash = "a2"
+	if err := db.CreateInodeAttrs(inodes["a"]); err != nil {
+		t.Fatal(err)
+	}
+	rename(inodes["b"], 10, "c")
+	if err := db.DeleteInode(inodes["keep"], true); err != nil {
+		t.Fatal(err)
+	}
+	add(14, 10, "d", 0644, "d1")
+	snapshot("third")
+	// moving a directory renames everything under it
+	rename(inodes["src"], 1, "lib")
+
+	assert.Equal(t, []string{
+		"removed /keep ",
+		"modified /src/a /src/a",
+		"renamed /src/b /src/c",
+		"added  /src/d",
+	}, diff("first", "second"))
+	assert.Equal(t, []string{
+		"renamed /src /lib",
+		"renamed /src/a /lib/a",
+		"renamed /src/c /lib/c",
+		"renamed /src/d /lib/d",
+	}, diff("second", ""))
+
+	var moved *DiffEntry
+	err = db.DiffSnapshots("first", "", func(e *DiffEntry) error {
+		if e.Inode == 11 {
+			moved = e
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.NotNil(t, moved) {
+		assert.Equal(t, DiffRenamed, moved.Kind)
+		assert.Equal(t, "a1", moved.Old.Hash)
+		assert.Equal(t, "a2", moved.New.Hash)
+	}
+	// the current snapshot has no copy to compare
+	assert.Error(t, db.DiffSnapshots("third", "", func(*DiffEntry) error { return nil }))
+	assert.Error(t, db.DiffSnapshots("missing", "", func(*DiffEntry) error { return nil }))
+	assert.Error(t, db.DiffSnapshots("second", "missing", func(*DiffEntry) error { return nil }))
+}
@@ -0,0 +1,521 @@
+package fsdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+const (
+	// LostFoundInodeID inode of the directory disconnected entries are moved to.
+	// Allocated inodes start above utils.MaxUint40, so it never collides.
+	LostFoundInodeID = 2
+	// LostFoundName name of the lost+found directory in the root
+	LostFoundName = "lost+found"
+)
+
+// Kinds of problems found by Fsck
+const (
+	FsckWAL          = "wal"
+	FsckRoot         = "root"
+	FsckDangling     = "dangling"
+	FsckDisconnected = "disconnected"
+	FsckParent       = "parent"
+	FsckNlink        = "nlink"
+	FsckOrphan       = "orphan"
+	FsckAttrs        = "attrs"
+)
+
+// FsckProblem single inconsistency found by Fsck
+type FsckProblem struct {
+	Kind     string
+	Inode    uint64
+	Message  string
+	Repaired bool
+}
+
+// FsckReport result of Fsck
+type FsckReport struct {
+	Repair   bool
+	Dentries int
+	Inodes   int
+	// WALEntries entries of WAL files taken into account
+	WALEntries int
+	Problems   []FsckProblem
+	// Unreferenced attribute records without any name or orphan record, they are left to GC
+	Unreferenced []uint64
+}
+
+// Clean returns true if there are no problems left
+func (r *FsckReport) Clean() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *FsckReport) add(kind string, inode uint64, repaired bool, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, FsckProblem{
+		Kind:     kind,
+		Inode:    inode,
+		Message:  fmt.Sprintf(format, args...),
+		Repaired: repaired,
+	})
+}
+
+type fsckDentry struct {
+	parent uint64
+	name   string
+	id     uint64
+}
+
+func (d *fsckDentry) key() []byte {
+	return DbInodeKey(d.parent, d.name)
+}
+
+// fsck in-memory view of the metadata and the repairs staged on it
+type fsck struct {
+	db       *Fsdb
+	repair   bool
+	report   *FsckReport
+	dentries map[string]*fsckDentry
+	attrs    map[uint64]*InodeAttributes
+	orphans  map[uint64]bool
+	dirty    map[uint64]bool
+	batch    *metastore.Batch
+}
+
+// Fsck checks that every dentry points to an attribute record, directories
+// are connected to the root, ParentID and link counts match the dentries and
+// WAL files are readable. With repair set it fixes what it finds: dangling
+// dentries are removed, disconnected entries are moved to lost+found, counts
+// and parents are rewritten and damaged WAL files are cut at the last good
+// entry. The broken marker is removed once no problem is left.
+// It has to run before the filesystem is served.
+func (db *Fsdb) Fsck(repair bool) (*FsckReport, error) {
+	f := &fsck{
+		db:       db,
+		repair:   repair,
+		report:   &FsckReport{Repair: repair},
+		dentries: map[string]*fsckDentry{},
+		attrs:    map[uint64]*InodeAttributes{},
+		orphans:  map[uint64]bool{},
+		dirty:    map[uint64]bool{},
+		batch:    new(metastore.Batch),
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	if err := f.checkWAL(); err != nil {
+		return nil, err
+	}
+	f.checkDangling()
+	f.checkRoot()
+	f.checkConnected()
+	f.checkInodes()
+	if repair {
+		if err := f.commit(); err != nil {
+			return nil, err
+		}
+	}
+	f.report.Dentries = len(f.dentries)
+	f.report.Inodes = len(f.attrs)
+	if f.report.Clean() && db.CheckIfFailed() {
+		if err := os.Remove(db.failedFile); err != nil {
+			return nil, err
+		}
+	}
+	return f.report, nil
+}
+
+// load reads dentries, orphan records and attributes
+func (f *fsck) load() error {
+	iter := f.db.istore.NewIterator(nil)
+	for iter.Next() {
+		if bytes.HasPrefix(iter.Key(), orphanPrefix) {
+			f.orphans[utils.BytesToUint64(iter.Value())] = true
+			continue
+		}
+		if bytes.HasPrefix(iter.Key(), metaPrefix) {
+			continue
+		}
+		parent, name, ok := ParseDbInodeKey(iter.Key())
+		if !ok {
+			f.report.add(FsckDangling, 0, f.repair, "malformed dentry key %q", iter.Key())
+			if f.repair {
+				f.batch.Delete(append([]byte{}, iter.Key()...))
+			}
+			continue
+		}
+		d := &fsckDentry{parent: parent, name: name, id: utils.BytesToUint64(iter.Value())}
+		f.dentries[string(d.key())] = d
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	iter = f.db.astore.NewIterator(nil)
+	for iter.Next() {
+		if bytes.Equal(iter.Key(), wal.CheckpointKey) {
+			continue
+		}
+		id := utils.BytesToUint64(iter.Key())
+		a := &InodeAttributes{}
+		if err := a.Unmarshall(iter.Value()); err != nil {
+			// names pointing to it are reported as dangling
+			f.report.add(FsckAttrs, id, f.repair, "unreadable attributes: %v", err)
+			if f.repair {
+				f.dirty[id] = true
+			}
+			continue
+		}
+		f.attrs[id] = a
+	}
+	iter.Release()
+	return iter.Error()
+}
+
+// checkWAL applies readable WAL entries on top of the attributes and dentries,
+// so changes not yet written to astore or lost by istore are seen. Old WAL
+// files are left after a crash during a dump, in repair mode they are written
+// to the stores and removed.
+func (f *fsck) checkWAL() error {
+	files, err := f.db.Wal.Files()
+	if err != nil {
+		return err
+	}
+	current := filepath.Clean(f.db.Wal.WalFilename())
+	fsys := f.db.Wal.FS()
+	checkpoint, err := f.db.Wal.Checkpoint()
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		entries, size, serr := f.db.Wal.ScanFile(name)
+		if serr != nil && os.IsNotExist(serr) {
+			continue
+		}
+		f.report.WALEntries += len(entries)
+		// entries up to the checkpoint are in the stores already
+		pending := entries[:0]
+		for _, e := range entries {
+			if e.LSN == 0 || e.LSN > checkpoint {
+				pending = append(pending, e)
+			}
+		}
+		entries = pending
+		for _, e := range entries {
+			if e.Dentry {
+				f.applyDentry(e)
+				continue
+			}
+			id := utils.BytesToUint64(e.Key)
+			if e.Tombstoned {
+				delete(f.attrs, id)
+				delete(f.dirty, id)
+				continue
+			}
+			a := &InodeAttributes{}
+			if err := a.Unmarshall(e.Value); err != nil {
+				continue
+			}
+			f.attrs[id] = a
+			delete(f.dirty, id)
+		}
+		isCurrent := filepath.Clean(name) == current
+		if serr != nil {
+			f.report.add(FsckWAL, 0, f.repair, "%s: %v, %d entries readable", filepath.Base(name), serr, len(entries))
+		}
+		if !f.repair {
+			continue
+		}
+		if err := f.db.Wal.Apply(entries); err != nil {
+			return err
+		}
+		switch {
+		case isCurrent && serr != nil:
+			if err := fsys.Truncate(name, size); err != nil {
+				return err
+			}
+		case isCurrent:
+		case serr != nil:
+			// keep the damaged file for inspection, it is never replayed again
+			if err := fsys.Rename(name, name+".corrupt"); err != nil {
+				return err
+			}
+		default:
+			if err := fsys.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyDentry updates the view by a dentry change logged in the WAL
+func (f *fsck) applyDentry(e wal.Entry) {
+	if bytes.HasPrefix(e.Key, orphanPrefix) {
+		id := utils.BytesToUint64(e.Key[len(orphanPrefix):])
+		if e.Tombstoned {
+			delete(f.orphans, id)
+		} else {
+			f.orphans[id] = true
+		}
+		return
+	}
+	parent, name, ok := ParseDbInodeKey(e.Key)
+	if !ok {
+		return
+	}
+	d := &fsckDentry{parent: parent, name: name, id: utils.BytesToUint64(e.Value)}
+	if e.Tombstoned {
+		delete(f.dentries, string(d.key()))
+		return
+	}
+	f.dentries[string(d.key())] = d
+}
+
+// checkDangling removes dentries pointing to missing attributes
+func (f *fsck) checkDangling() {
+	for key, d := range f.dentries {
+		if _, ok := f.attrs[d.id]; ok {
+			continue
+		}
+		f.report.add(FsckDangling, d.id, f.repair, "dentry %d:%q points to missing attributes", d.parent, d.name)
+		if f.repair {
+			f.batch.Delete([]byte(key))
+			delete(f.dentries, key)
+		}
+	}
+}
+
+// checkRoot makes sure the root directory exists
+func (f *fsck) checkRoot() {
+	rootKey := string(DbInodeKey(fuseops.RootInodeID-1, ""))
+	if _, ok := f.attrs[fuseops.RootInodeID]; !ok {
+		if len(f.dentries) == 0 {
+			// new filesystem, the root is created on mount
+			return
+		}
+		f.report.add(FsckRoot, fuseops.RootInodeID, f.repair, "root attributes missing")
+		if !f.repair {
+			return
+		}
+		f.attrs[fuseops.RootInodeID] = newDirAttrs(0)
+		f.dirty[fuseops.RootInodeID] = true
+	}
+	if d, ok := f.dentries[rootKey]; !ok || d.id != fuseops.RootInodeID {
+		f.report.add(FsckRoot, fuseops.RootInodeID, f.repair, "root dentry missing")
+		if f.repair {
+			f.put(&fsckDentry{parent: fuseops.RootInodeID - 1, name: "", id: fuseops.RootInodeID})
+		}
+	}
+}
+
+// checkConnected finds entries which can't be reached from the root and moves
+// them to lost+found
+func (f *fsck) checkConnected() {
+	if _, ok := f.attrs[fuseops.RootInodeID]; !ok {
+		return
+	}
+	reported := map[string]bool{}
+	for {
+		reachable := f.reachable()
+		var lost []*fsckDentry
+		for _, d := range f.dentries {
+			if d.parent == fuseops.RootInodeID-1 || reachable[d.parent] {
+				continue
+			}
+			lost = append(lost, d)
+		}
+		if len(lost) == 0 {
+			return
+		}
+		if !f.repair {
+			for _, d := range lost {
+				f.report.add(FsckDisconnected, d.id, false, "dentry %d:%q is not connected to the root", d.parent, d.name)
+			}
+			return
+		}
+		// move the tops of disconnected trees first, then break cycles
+		sort.Slice(lost, func(i, j int) bool { return lost[i].id < lost[j].id })
+		top := lost[0]
+		for _, d := range lost {
+			if a, ok := f.attrs[d.parent]; !ok || !a.Mode.IsDir() {
+				top = d
+				break
+			}
+		}
+		key := string(top.key())
+		if !reported[key] {
+			f.report.add(FsckDisconnected, top.id, true, "dentry %d:%q moved to %s", top.parent, top.name, LostFoundName)
+			reported[key] = true
+		}
+		f.lostFound()
+		f.batch.Delete([]byte(key))
+		delete(f.dentries, key)
+		f.put(&fsckDentry{parent: LostFoundInodeID, name: fmt.Sprintf("#%d", top.id), id: top.id})
+	}
+}
+
+// reachable returns directories reachable from the root
+func (f *fsck) reachable() map[uint64]bool {
+	children := map[uint64][]uint64{}
+	for _, d := range f.dentries {
+		children[d.parent] = append(children[d.parent], d.id)
+	}
+	reachable := map[uint64]bool{fuseops.RootInodeID: true}
+	queue := []uint64{fuseops.RootInodeID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, child := range children[id] {
+			if a, ok := f.attrs[child]; ok && a.Mode.IsDir() && !reachable[child] {
+				reachable[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return reachable
+}
+
+// lostFound creates the lost+found directory if it doesn't exist
+func (f *fsck) lostFound() {
+	if _, ok := f.attrs[LostFoundInodeID]; !ok {
+		f.attrs[LostFoundInodeID] = newDirAttrs(fuseops.RootInodeID)
+		f.dirty[LostFoundInodeID] = true
+	}
+	for _, d := range f.dentries {
+		if d.id == LostFoundInodeID {
+			return
+		}
+	}
+	f.put(&fsckDentry{parent: fuseops.RootInodeID, name: LostFoundName, id: LostFoundInodeID})
+}
+
+// checkInodes verifies ParentID and link counts against the dentries
+func (f *fsck) checkInodes() {
+	names := map[uint64][]*fsckDentry{}
+	subdirs := map[uint64]uint32{}
+	for _, d := range f.dentries {
+		names[d.id] = append(names[d.id], d)
+		if a, ok := f.attrs[d.id]; ok && a.Mode.IsDir() && d.id != fuseops.RootInodeID {
+			subdirs[d.parent]++
+		}
+	}
+	ids := make([]uint64, 0, len(f.attrs))
+	for id := range f.attrs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		a := f.attrs[id]
+		dentries := names[id]
+		if len(dentries) == 0 {
+			if !f.orphans[id] {
+				f.report.Unreferenced = append(f.report.Unreferenced, id)
+			} else if a.Nlink != 0 {
+				f.report.add(FsckNlink, id, f.repair, "orphan nlink %d, expected 0", a.Nlink)
+				f.setNlink(id, 0)
+			}
+			continue
+		}
+		if f.orphans[id] {
+			f.report.add(FsckOrphan, id, f.repair, "orphan record of an inode with %d names", len(dentries))
+			if f.repair {
+				f.batch.Delete(orphanKey(id))
+			}
+		}
+		parentOK := false
+		for _, d := range dentries {
+			if d.parent == a.ParentID {
+				parentOK = true
+				break
+			}
+		}
+		if !parentOK {
+			sort.Slice(dentries, func(i, j int) bool { return dentries[i].parent < dentries[j].parent })
+			f.report.add(FsckParent, id, f.repair, "ParentID %d doesn't match any dentry, expected %d", a.ParentID, dentries[0].parent)
+			if f.repair {
+				a.ParentID = dentries[0].parent
+				f.dirty[id] = true
+			}
+		}
+		expected := uint32(len(dentries))
+		if a.Mode.IsDir() {
+			expected = 2 + subdirs[id]
+		}
+		if a.Nlink != expected {
+			f.report.add(FsckNlink, id, f.repair, "nlink %d, expected %d", a.Nlink, expected)
+			f.setNlink(id, expected)
+		}
+	}
+}
+
+func (f *fsck) setNlink(id uint64, nlink uint32) {
+	if !f.repair {
+		return
+	}
+	f.attrs[id].Nlink = nlink
+	f.dirty[id] = true
+}
+
+// put stages a new dentry
+func (f *fsck) put(d *fsckDentry) {
+	f.dentries[string(d.key())] = d
+	f.batch.Put(d.key(), utils.Uint64ToBytes(d.id))
+}
+
+// commit writes staged repairs, attributes first like Txn does
+func (f *fsck) commit() error {
+	ab := new(metastore.Batch)
+	for id := range f.dirty {
+		a, ok := f.attrs[id]
+		if !ok {
+			ab.Delete(utils.Uint64ToBytes(id))
+			continue
+		}
+		buf, err := a.Marshall()
+		if err != nil {
+			return err
+		}
+		ab.Put(utils.Uint64ToBytes(id), buf)
+	}
+	if ab.Len() > 0 {
+		if err := f.db.astore.Write(ab); err != nil {
+			return err
+		}
+	}
+	if f.batch.Len() > 0 {
+		err := f.db.istore.Write(f.batch)
+		f.db.dCache.Purge()
+		return err
+	}
+	return nil
+}
+
+func newDirAttrs(parent uint64) *InodeAttributes {
+	t := time.Now()
+	return &InodeAttributes{
+		ParentID: parent,
+		InodeAttributes: fuseops.InodeAttributes{
+			Size:   4096,
+			Nlink:  2,
+			Mode:   os.ModeDir | 0755,
+			Atime:  t,
+			Mtime:  t,
+			Ctime:  t,
+			Crtime: t,
+		},
+	}
+}
@@ -0,0 +1,198 @@
+package fsdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	"github.com/radek-ryckowski/monofs/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func putFsckInode(t *testing.T, db *Fsdb, id, parent uint64, name string, mode os.FileMode, nlink uint32) {
+	attrs := InodeAttributes{
+		ParentID:        parent,
+		InodeAttributes: fuseops.InodeAttributes{Nlink: nlink, Mode: mode},
+	}
+	buf, err := attrs.Marshall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.astore.Put(utils.Uint64ToBytes(id), buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.istore.Put(DbInodeKey(parent, name), utils.Uint64ToBytes(id)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func kinds(report *FsckReport) map[string]int {
+	k := map[string]int{}
+	for _, p := range report.Problems {
+		k[p.Kind]++
+	}
+	return k
+}
+
+func TestFsck(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	putFsckInode(t, db, 1, 0, "", os.ModeDir|0755, 2)
+	putFsckInode(t, db, 10, 1, "dir", os.ModeDir|0755, 2)
+	putFsckInode(t, db, 11, 99, "file", 0644, 3)
+	// the file lives in dir, its attributes point elsewhere
+	if err := db.istore.Delete(DbInodeKey(99, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.istore.Put(DbInodeKey(10, "file"), utils.Uint64ToBytes(11)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.istore.Put(DbInodeKey(10, "ghost"), utils.Uint64ToBytes(12)); err != nil {
+		t.Fatal(err)
+	}
+	putFsckInode(t, db, 13, 50, "lost", 0644, 1)
+	// attributes of an inode only in the WAL, followed by a torn entry
+	attrs := InodeAttributes{InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644}}
+	buf, _ := attrs.Marshall()
+	if err := db.Wal.AddEntry(&wal.Entry{Key: utils.Uint64ToBytes(14), Value: buf}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(db.Wal.WalFilename(), os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("AAAA#AA")
+	f.Close()
+	db.MarkAsFailed(os.ErrInvalid)
+
+	report, err := db.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, report.Clean())
+	assert.Equal(t, map[string]int{
+		FsckWAL:          1,
+		FsckDangling:     1,
+		FsckDisconnected: 1,
+		FsckParent:       1,
+		FsckNlink:        2,
+	}, kinds(report))
+	assert.True(t, db.CheckIfFailed())
+
+	report, err = db.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.Clean())
+	assert.False(t, db.CheckIfFailed())
+	assert.Equal(t, []uint64{14}, report.Unreferenced)
+
+	report, err = db.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(report.Problems), report.Problems)
+	inode, err := db.GetInode(LostFoundInodeID, "#13", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(LostFoundInodeID), inode.Attrs.ParentID)
+	if _, err := db.GetInode(fuseops.RootInodeID, LostFoundName, false); err != nil {
+		t.Fatal(err)
+	}
+	inode, err = db.GetInode(10, "file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(10), inode.Attrs.ParentID)
+	assert.Equal(t, uint32(1), inode.Attrs.Nlink)
+}
+
+func TestNewRefusesUnrepaired(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	cfg := &config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	}
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.istore.Put(DbInodeKey(fuseops.RootInodeID, "ghost"), utils.Uint64ToBytes(12)); err != nil {
+		t.Fatal(err)
+	}
+	db.MarkAsFailed(os.ErrInvalid)
+	db.Close()
+
+	_, err = New(cfg)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "monofs fsck --repair")
+	}
+	cfg.FsckRepair = true
+	db, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, db.CheckIfFailed())
+	db.Close()
+}
+
+func TestFsckRepairOutlastsReplay(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	cfg := &config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	}
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inode := range []*Inode{
+		NewInode(fuseops.RootInodeID, fuseops.RootInodeID-1, "", InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+		}),
+		NewInode(20, fuseops.RootInodeID, "file", InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 3, Mode: 0644},
+		}),
+	} {
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// the wrong count is only in the current WAL file
+	db, err = Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]int{FsckNlink: 1}, kinds(report))
+	db.Close()
+
+	db, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	inode, err := db.GetInode(fuseops.RootInodeID, "file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(1), inode.Attrs.Nlink)
+}
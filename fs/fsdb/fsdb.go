@@ -5,79 +5,146 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/metastore"
 	"github.com/radek-ryckowski/monofs/fs/monocache"
 	"github.com/radek-ryckowski/monofs/fs/wal"
 	monostat "github.com/radek-ryckowski/monofs/monoclient/stat"
 	msnapshot "github.com/radek-ryckowski/monofs/snapshot"
 	"github.com/radek-ryckowski/monofs/utils"
-	"github.com/syndtr/goleveldb/leveldb"
-	lfilter "github.com/syndtr/goleveldb/leveldb/filter"
-	lopt "github.com/syndtr/goleveldb/leveldb/opt"
-	lutil "github.com/syndtr/goleveldb/leveldb/util"
 
 	"github.com/ztrue/tracerr"
 )
 
-// TODO add caching layer for parent,names pairs with ttl whcih can speed up dir lookups
-
 var ErrNoSuchInode = errors.New("not such inode")
 
+// ErrReadOnly is returned by writes to a snapshot opened with OpenSnapshot
+var ErrReadOnly = errors.New("snapshot is read-only")
+
 type Fsdb struct {
-	istore     *leveldb.DB
-	astore     *leveldb.DB
+	istore     metastore.MetaStore
+	astore     metastore.MetaStore
 	Quit       chan bool
 	path       string
 	failedFile string
 	aCache     *monocache.CacheTable
+	dCache     *DentryCache
 	Wal        *wal.WAL
 	StatClient *monostat.Client
 	Snapshot   *msnapshot.Snapshot
+	// readOnly is set for snapshots and offline tools, neither has a WAL
+	// and snapshots have no snapshot db either
+	readOnly bool
+	// copyLock keeps copies of a snapshot from being deleted while they are served
+	copyLock *os.File
 }
 
-// New creates a new fsdb
+// New creates a new fsdb, checks it after a failure and replays the WAL
 func New(config *config.Config) (*Fsdb, error) {
+	fsdb, err := Open(config)
+	if err != nil {
+		return nil, err
+	}
+	if fsdb.CheckIfFailed() {
+		report, err := fsdb.Fsck(config.FsckRepair)
+		if err != nil {
+			fsdb.Close()
+			return nil, fmt.Errorf("fsck: %w", err)
+		}
+		if !report.Clean() {
+			fsdb.Close()
+			return nil, fmt.Errorf("fsck found %d problems, run monofs fsck --repair --inode_path %s before mounting", len(report.Problems), config.Path)
+		}
+	}
+	if err := fsdb.ReplayWAL(); err != nil {
+		fsdb.Close()
+		return nil, err
+	}
+	fsdb.aCache.SetAddCallback(func(key uint64, value []byte) error {
+		entry := &wal.Entry{
+			Key:        utils.Uint64ToBytes(key),
+			Value:      value,
+			Tombstoned: false,
+		}
+		return fsdb.Wal.AddEntry(entry)
+	})
+	fsdb.aCache.SetDelCallback(func(key uint64, value []byte) error {
+		entry := &wal.Entry{
+			Key:        utils.Uint64ToBytes(key),
+			Value:      value,
+			Tombstoned: true,
+		}
+		return fsdb.Wal.AddEntry(entry)
+	})
+	fsdb.aCache.SetCacheFullCallback(func(output chan string) error {
+		_, err := fsdb.Wal.Dump(output, nil)
+		return err
+	})
+	// a full or old WAL file is rotated through the cache, so items written
+	// by the dump are marked processed
+	fsdb.Wal.SetRotateCallback(fsdb.aCache.Flush)
+	// writers wait for dumps falling behind
+	fsdb.aCache.SetThrottleCallback(fsdb.Wal.Throttle)
+	return fsdb, nil
+}
+
+// Open opens fsdb stores without checking them or replaying the WAL, offline
+// tools use it directly
+func Open(config *config.Config) (*Fsdb, error) {
 	var err error
-	var istore *leveldb.DB
+	var istore metastore.MetaStore
 	ipath := fmt.Sprintf("%s/inodes", config.Path)
 	apath := fmt.Sprintf("%s/attrs", config.Path)
 	wpath := fmt.Sprintf("%s/wal", config.Path)
-	err = os.MkdirAll(ipath, 0755)
-	if err != nil {
-		return nil, err
+	if !config.InMemory {
+		for _, dir := range []string{ipath, apath, wpath} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+		}
 	}
-	err = os.MkdirAll(apath, 0755)
-	if err != nil {
-		return nil, err
+	opts := &metastore.Options{
+		Backend:         config.MetaBackend,
+		BloomFilterSize: config.BloomFilterSize,
+	}
+	walFS := wal.OS
+	if config.InMemory {
+		opts.Backend = metastore.Memory
+		walFS = wal.NewMemFS()
 	}
-	err = os.MkdirAll(wpath, 0755)
+	istore, err = metastore.Open(ipath, opts)
 	if err != nil {
 		return nil, err
 	}
-	io := &lopt.Options{
-		Filter: lfilter.NewBloomFilter(config.BloomFilterSize),
+	if err := migrateDentryKeys(istore); err != nil {
+		istore.Close()
+		return nil, fmt.Errorf("migrating dentry keys: %w", err)
 	}
-	istore, err = leveldb.OpenFile(ipath, io)
+	astore, err := metastore.Open(apath, opts)
 	if err != nil {
+		istore.Close()
 		return nil, err
 	}
-	ao := &lopt.Options{
-		Filter: lfilter.NewBloomFilter(config.BloomFilterSize),
-	}
-	astore, err := leveldb.OpenFile(apath, ao)
+	w, err := wal.NewWithFS(walFS, wpath, astore,
+		wal.WithSync(config.WALSync, config.WALSyncInterval),
+		wal.WithRotation(config.WALSegmentSize, config.WALSegmentAge),
+		wal.WithBackpressure(config.WALMaxPendingFiles),
+		wal.WithInodeStore(istore))
 	if err != nil {
 		istore.Close()
+		astore.Close()
 		return nil, err
 	}
-	w, err := wal.New(wpath, astore)
+	policy, err := monocache.PolicyByName(config.CachePolicy)
 	if err != nil {
 		istore.Close()
 		astore.Close()
+		w.Close()
 		return nil, err
 	}
 	s, err := msnapshot.New(config.Path, istore, astore, w)
@@ -87,56 +154,229 @@ func New(config *config.Config) (*Fsdb, error) {
 		w.Close()
 		return nil, err
 	}
+	s.FS = config.FilesystemName
 	fsdb := &Fsdb{
 		istore:     istore,
 		astore:     astore,
 		Quit:       make(chan bool),
 		path:       config.Path,
 		failedFile: fmt.Sprintf("%s/broken.marker", config.Path),
-		aCache:     monocache.NewCacheTable(config.CacheSize),
+		aCache:     monocache.NewCacheTable(config.CacheSize, monocache.WithPolicy(policy), monocache.WithMaxBytes(config.CacheBytes)),
+		dCache:     NewDentryCache(config.DentryCacheSize, config.DentryCacheTTL, config.NegativeDentryCacheTTL),
 		Wal:        w,
 		StatClient: config.StatClient,
 		Snapshot:   s,
 	}
-	if fsdb.CheckIfFailed() {
-		if err := fsdb.Fsck(); err != nil {
-			fsdb.Close()
-			return nil, err
+	return fsdb, nil
+}
+
+// OpenSnapshot opens copies of the stores taken for the snapshot named
+// config.Snapshot read-only. Neither the WAL nor the snapshot db of the head
+// are opened, so a snapshot can be served while the head is mounted.
+func OpenSnapshot(config *config.Config) (*Fsdb, error) {
+	dir := msnapshot.CopyPath(config.Path, config.Snapshot)
+	opts := &metastore.Options{
+		BloomFilterSize: config.BloomFilterSize,
+		ReadOnly:        true,
+		ErrorIfMissing:  true,
+	}
+	// copies are written when the next snapshot is created, the current one
+	// has none yet
+	noCopy := func(err error) error {
+		return fmt.Errorf("snapshot %q has no copy, it doesn't exist or is current: %w", config.Snapshot, err)
+	}
+	copyLock, err := msnapshot.LockCopy(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, noCopy(err)
+		}
+		return nil, fmt.Errorf("snapshot %q: %w", config.Snapshot, err)
+	}
+	ipath := filepath.Join(dir, "inode")
+	if err := migrateCopy(ipath, opts); err != nil {
+		copyLock.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, noCopy(err)
 		}
+		return nil, fmt.Errorf("migrating dentry keys of snapshot %q: %w", config.Snapshot, err)
+	}
+	istore, err := metastore.Open(ipath, opts)
+	if err != nil {
+		copyLock.Close()
+		return nil, fmt.Errorf("snapshot %q: %w", config.Snapshot, err)
+	}
+	astore, err := metastore.Open(filepath.Join(dir, "attrs"), opts)
+	if err != nil {
+		copyLock.Close()
+		istore.Close()
+		return nil, fmt.Errorf("snapshot %q: %w", config.Snapshot, err)
+	}
+	fsdb, err := newReadOnly(config, istore, astore)
+	if err != nil {
+		copyLock.Close()
+		istore.Close()
+		astore.Close()
+		return nil, err
+	}
+	fsdb.copyLock = copyLock
+	return fsdb, nil
+}
+
+// OpenReadOnly opens the stores of an unmounted filesystem read-only for
+// offline tools. Attributes logged in WAL files and not dumped yet are
+// overlaid in memory, names are read from the inode store as they are
+// written to it when logged. Nothing is written: the WAL is neither replayed
+// nor dumped and stores with legacy dentry keys are refused.
+func OpenReadOnly(config *config.Config) (*Fsdb, error) {
+	opts := &metastore.Options{
+		BloomFilterSize: config.BloomFilterSize,
+		ReadOnly:        true,
+		ErrorIfMissing:  true,
+	}
+	istore, err := metastore.Open(fmt.Sprintf("%s/inodes", config.Path), opts)
+	if err != nil {
+		return nil, err
+	}
+	migrated, err := migratedDentryKeys(istore)
+	if err == nil && !migrated {
+		err = errors.New("dentry keys are in the legacy format, mount the filesystem or run fsck once to migrate them")
+	}
+	if err != nil {
+		istore.Close()
+		return nil, err
+	}
+	astore, err := metastore.Open(fmt.Sprintf("%s/attrs", config.Path), opts)
+	if err != nil {
+		istore.Close()
+		return nil, err
+	}
+	fsdb, err := newReadOnly(config, istore, astore)
+	if err != nil {
+		istore.Close()
+		astore.Close()
+		return nil, err
+	}
+	err = wal.ScanPending(wal.OS, fmt.Sprintf("%s/wal", config.Path), astore, func(entry *wal.Entry) error {
+		if !entry.Dentry {
+			cacheItem := monocache.NewCacheItem(utils.BytesToUint64(entry.Key), entry.Value, fsdb.aCache.GetCacheGeneration(), 0)
+			cacheItem.SetTombstoned(entry.Tombstoned)
+			fsdb.aCache.Set(cacheItem)
+		}
+		return nil
+	})
+	if err == nil {
+		fsdb.Snapshot, err = msnapshot.OpenReadOnly(config.Path)
 	}
-	entries, err := fsdb.Wal.Reply()
 	if err != nil {
 		fsdb.Close()
-		return nil, tracerr.Errorf("replying WAL entries failed: %w", err)
+		return nil, err
+	}
+	return fsdb, nil
+}
+
+// newReadOnly returns a db of stores opened read-only
+func newReadOnly(config *config.Config, istore, astore metastore.MetaStore) (*Fsdb, error) {
+	policy, err := monocache.PolicyByName(config.CachePolicy)
+	if err != nil {
+		return nil, err
+	}
+	fsdb := &Fsdb{
+		istore:     istore,
+		astore:     astore,
+		Quit:       make(chan bool),
+		path:       config.Path,
+		aCache:     monocache.NewCacheTable(config.CacheSize, monocache.WithPolicy(policy), monocache.WithMaxBytes(config.CacheBytes)),
+		dCache:     NewDentryCache(config.DentryCacheSize, config.DentryCacheTTL, config.NegativeDentryCacheTTL),
+		StatClient: config.StatClient,
+		readOnly:   true,
+	}
+	// every write goes through the cache, it fails before anything is logged
+	fsdb.aCache.SetThrottleCallback(func() error {
+		return ErrReadOnly
+	})
+	return fsdb, nil
+}
+
+// WALCheckpoint returns the sequence number up to which WAL entries are
+// written to the stores, it needs no WAL so offline tools can read it
+func (db *Fsdb) WALCheckpoint() (uint64, error) {
+	return wal.ReadCheckpoint(db.astore)
+}
+
+// ReadOnly reports whether db is opened with OpenSnapshot or OpenReadOnly
+func (db *Fsdb) ReadOnly() bool {
+	return db.readOnly
+}
+
+// SetLogger sets where failures of background cache flushes and WAL dumps
+// are reported
+func (db *Fsdb) SetLogger(log wal.Logger) {
+	db.aCache.SetLogger(log)
+	if db.Wal != nil {
+		db.Wal.SetLogger(log)
+	}
+}
+
+// Sync makes metadata changes made so far durable when the WAL syncs every
+// entry, in the other modes syncing a file doesn't sync metadata
+func (db *Fsdb) Sync() error {
+	if db.readOnly || db.Wal.SyncMode() != wal.SyncAlways {
+		return nil
 	}
-	for _, entry := range entries {
-		cacheItem := &monocache.CacheItem{}
-		if err := cacheItem.Unmarshall(entry.Value); err != nil {
-			return nil, tracerr.Errorf("unmarshalling cache entry failed: %w", err)
+	return db.Wal.Sync()
+}
+
+// ReplayWAL loads changes logged in the current WAL file into the cache and
+// redoes logged dentry changes, they may not have reached the inode store
+// before a crash. Entries are streamed, dentry changes are written in batches
+// holding whole records.
+func (db *Fsdb) ReplayWAL() error {
+	batch := new(metastore.Batch)
+	written := false
+	lsn := uint64(0)
+	writeBatch := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		if err := db.istore.Write(batch); err != nil {
+			return db.MarkAsFailed(err)
 		}
-		fsdb.aCache.Set(cacheItem)
+		batch.Reset()
+		written = true
+		return nil
 	}
-	fsdb.aCache.SetAddCallback(func(key uint64, value []byte) error {
-		entry := &wal.Entry{
-			Key:        utils.Uint64ToBytes(key),
-			Value:      value,
-			Tombstoned: false,
+	err := db.Wal.Replay(func(entry *wal.Entry) error {
+		// entries of a record share their sequence number
+		if entry.LSN != lsn && batch.Len() >= wal.WALBatchMaxSize {
+			if err := writeBatch(); err != nil {
+				return err
+			}
 		}
-		return fsdb.Wal.AddEntry(entry)
-	})
-	fsdb.aCache.SetDelCallback(func(key uint64, value []byte) error {
-		entry := &wal.Entry{
-			Key:        utils.Uint64ToBytes(key),
-			Value:      value,
-			Tombstoned: true,
+		lsn = entry.LSN
+		if entry.Dentry {
+			if entry.Tombstoned {
+				batch.Delete(entry.Key)
+			} else {
+				batch.Put(entry.Key, entry.Value)
+			}
+			return nil
 		}
-		return fsdb.Wal.AddEntry(entry)
-	})
-	fsdb.aCache.SetCacheFullCallback(func(output chan string) error {
-		_, err := w.Dump(output, nil)
-		return err
+		// values are attribute records, deletions only need the key
+		cacheItem := monocache.NewCacheItem(utils.BytesToUint64(entry.Key), entry.Value, db.aCache.GetCacheGeneration(), 0)
+		cacheItem.SetTombstoned(entry.Tombstoned)
+		db.aCache.Set(cacheItem)
+		return nil
 	})
-	return fsdb, nil
+	if err == nil {
+		err = writeBatch()
+	}
+	if written {
+		db.dCache.Purge()
+	}
+	if err != nil {
+		return tracerr.Errorf("replying WAL entries failed: %w", err)
+	}
+	return nil
 }
 
 // StartSyncSnaphost returns and creates if nessesary current Snapshot name
@@ -157,56 +397,67 @@ func (db *Fsdb) StartSyncSnapshot() (string, error) {
 }
 
 // GetIStoreHandler returns a handler to the istore
-func (db *Fsdb) GetIStoreHandler() *leveldb.DB {
+func (db *Fsdb) GetIStoreHandler() metastore.MetaStore {
 	return db.istore
 }
 
 // Close closes the fsdb
 func (db *Fsdb) Close() error {
 	close(db.Quit)
-	ierr := db.istore.Close()
-	aerr := db.astore.Close()
-	if ierr != nil {
-		return ierr
+	// no flush starts a dump any more
+	db.aCache.Stop()
+	var err error
+	if !db.readOnly {
+		// dumps running in the background write to the stores
+		err = db.Wal.Close()
 	}
-	if err := db.Wal.Close(); err != nil {
-		return err
+	if db.Snapshot != nil {
+		if serr := db.Snapshot.Close(); err == nil {
+			err = serr
+		}
+	}
+	if ierr := db.istore.Close(); err == nil {
+		err = ierr
+	}
+	if aerr := db.astore.Close(); err == nil {
+		err = aerr
+	}
+	if db.copyLock != nil {
+		db.copyLock.Close()
 	}
-	return aerr
+	return err
 }
 
 // AddInode stores an inode
 func (db *Fsdb) AddInode(inode *Inode, attr bool) error {
-	inodeKey := DbInodeKey(inode.ParentID, inode.Name)
-
-	if err := db.istore.Put(inodeKey, inode.DbID(), nil); err != nil {
-		return db.MarkAsFailed(err)
-	}
+	txn := db.NewTxn()
+	txn.PutDentry(inode)
 	if attr {
-		buf, err := inode.Attrs.Marshall()
-		if err != nil {
-			return err
-		}
-		err = db.aCache.Add(inode.InodeID, buf, 0)
-		if err != nil {
-			return err
-		}
+		txn.PutAttrs(inode.InodeID, inode.Attrs)
 	}
-	return nil
+	return txn.Commit()
 }
 
 // GetInode gets an inode
 func (db *Fsdb) GetInode(parent uint64, name string, attr bool) (*Inode, error) {
 	var inode Inode
-	inodeKey := DbInodeKey(parent, name)
-	val, err := db.istore.Get(inodeKey, nil)
-	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
-			return nil, ErrNoSuchInode
+	id, cached, gen := db.dCache.Get(parent, name)
+	if !cached {
+		val, err := db.istore.Get(DbInodeKey(parent, name))
+		if err != nil {
+			if errors.Is(err, metastore.ErrNotFound) {
+				db.dCache.Add(parent, name, 0, gen)
+				return nil, ErrNoSuchInode
+			}
+			return nil, db.MarkAsFailed(err)
 		}
-		return nil, db.MarkAsFailed(err)
+		id = utils.BytesToUint64(val)
+		db.dCache.Add(parent, name, id, gen)
 	}
-	inode.InodeID = utils.BytesToUint64(val)
+	if id == 0 {
+		return nil, ErrNoSuchInode
+	}
+	inode.InodeID = id
 	inode.ParentID = parent
 	inode.Name = name
 	if attr {
@@ -220,9 +471,9 @@ func (db *Fsdb) GetInode(parent uint64, name string, attr bool) (*Inode, error)
 		if err != monocache.ErrKeyNotFound {
 			return nil, err
 		}
-		v, err := db.astore.Get(inode.DbID(), nil)
+		v, err := db.astore.Get(inode.DbID())
 		if err != nil {
-			if errors.Is(err, leveldb.ErrNotFound) {
+			if errors.Is(err, metastore.ErrNotFound) {
 				return nil, ErrNoSuchInode
 			}
 			return nil, db.MarkAsFailed(err)
@@ -231,31 +482,17 @@ func (db *Fsdb) GetInode(parent uint64, name string, attr bool) (*Inode, error)
 			return nil, err
 		}
 	}
-	return &inode, err
+	return &inode, nil
 }
 
 // DeleteInode deletes an inode
 func (db *Fsdb) DeleteInode(inode *Inode, attr bool) error {
-	inodeKey := DbInodeKey(inode.ParentID, inode.Name)
-	if err := db.istore.Delete(inodeKey, nil); err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
-			return ErrNoSuchInode
-		}
-		return err
-	}
+	txn := db.NewTxn()
+	txn.DeleteDentry(inode)
 	if attr {
-		err := db.aCache.Del(inode.InodeID)
-		if err == nil {
-			return nil
-		}
-		if err := db.astore.Delete(inode.DbID(), nil); err != nil {
-			if errors.Is(err, leveldb.ErrNotFound) {
-				return ErrNoSuchInode
-			}
-			return db.MarkAsFailed(err)
-		}
+		txn.DeleteAttrs(inode.InodeID)
 	}
-	return nil
+	return txn.Commit()
 }
 
 // CreateInodeAttrs stores an inode's attributes
@@ -283,9 +520,9 @@ func (db *Fsdb) GetFsdbInodeAttributes(ID uint64) (InodeAttributes, error) {
 	if err == monocache.ErrKeyDeleted {
 		return iattrs, ErrNoSuchInode
 	}
-	v, err := db.astore.Get(utils.Uint64ToBytes(ID), nil)
+	v, err := db.astore.Get(utils.Uint64ToBytes(ID))
 	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
+		if errors.Is(err, metastore.ErrNotFound) {
 			return iattrs, ErrNoSuchInode
 		}
 		return iattrs, db.MarkAsFailed(err)
@@ -296,27 +533,9 @@ func (db *Fsdb) GetFsdbInodeAttributes(ID uint64) (InodeAttributes, error) {
 // UpdateInodeAttrs sets an inode's attributes
 func (db *Fsdb) UpdateInodeAttrs(ID uint64, attr fuseops.InodeAttributes) error {
 	//TODO: this should be better optimised global change fuseops.InodeAttributes to InodeAttributes
-	var iattr InodeAttributes
-	val, err := db.aCache.Get(ID)
-	if err == nil {
-		if err := iattr.Unmarshall(val); err != nil {
-			return err
-		}
-	} else if err != monocache.ErrKeyNotFound {
+	iattr, err := db.GetFsdbInodeAttributes(ID)
+	if err != nil {
 		return err
-	} else if err == monocache.ErrKeyDeleted {
-		return ErrNoSuchInode
-	} else {
-		v, err := db.astore.Get(utils.Uint64ToBytes(ID), nil)
-		if err != nil {
-			if errors.Is(err, leveldb.ErrNotFound) {
-				return ErrNoSuchInode
-			}
-			return db.MarkAsFailed(err)
-		}
-		if err := iattr.Unmarshall(v); err != nil {
-			return db.MarkAsFailed(err)
-		}
 	}
 	//TODO update only the changed fields
 	iattr.Size = attr.Size
@@ -326,6 +545,28 @@ func (db *Fsdb) UpdateInodeAttrs(ID uint64, attr fuseops.InodeAttributes) error
 	iattr.Gid = attr.Gid
 	iattr.Atime = attr.Atime
 	iattr.Mtime = attr.Mtime
+	iattr.Ctime = attr.Ctime
+	// creation time is immutable, only fill it for records created without it
+	if iattr.Crtime.IsZero() {
+		iattr.Crtime = attr.Crtime
+	}
+	buf, err := iattr.Marshall()
+	if err != nil {
+		return err
+	}
+	return db.aCache.Add(ID, buf, 0)
+}
+
+// UpdateInodeAtime sets only an inode's access time, it does not change ctime
+func (db *Fsdb) UpdateInodeAtime(ID uint64, atime time.Time) error {
+	iattr, err := db.GetFsdbInodeAttributes(ID)
+	if err != nil {
+		return err
+	}
+	if !atime.After(iattr.Atime) {
+		return nil
+	}
+	iattr.Atime = atime
 	buf, err := iattr.Marshall()
 	if err != nil {
 		return err
@@ -338,7 +579,18 @@ func (db *Fsdb) DeleteInodeAttrs(inodeID uint64) error {
 	if err := db.aCache.Del(inodeID); err == nil {
 		return nil
 	}
-	return db.astore.Delete(utils.Uint64ToBytes(inodeID), nil)
+	return db.astore.Delete(utils.Uint64ToBytes(inodeID))
+}
+
+// InvalidateDentry drops the cached lookup of name in parent, it has to be
+// called when the inode store is changed bypassing Fsdb
+func (db *Fsdb) InvalidateDentry(parent uint64, name string) {
+	db.dCache.Invalidate(parent, name)
+}
+
+// DentryCacheStats returns counters of the dentry cache
+func (db *Fsdb) DentryCacheStats() DentryCacheStats {
+	return db.dCache.Stats()
 }
 
 // MarkAsFailed marks database as bad and force check
@@ -346,6 +598,10 @@ func (db *Fsdb) MarkAsFailed(err error) error {
 	if err == nil {
 		return nil
 	}
+	// copies of a snapshot aren't checked, the head is marked by its own errors
+	if db.readOnly {
+		return tracerr.Wrap(err)
+	}
 	// create failed file
 	f, oserr := os.Create(db.failedFile)
 	if oserr != nil {
@@ -362,22 +618,19 @@ func (db *Fsdb) CheckIfFailed() bool {
 	return err == nil
 }
 
-// GetChildren gets the children of an inode
-func (db *Fsdb) GetChildren(inodeID uint64, offset int, limit int, key []byte) ([]*Inode, int, error) {
+// GetChildren gets up to limit children of an inode which follow the name after in key order,
+// an empty after starts from the first child
+func (db *Fsdb) GetChildren(inodeID uint64, after string, limit int) ([]*Inode, error) {
 	values := []*Inode{}
 	tmpValues := []*Inode{}
-	prefix := []byte(fmt.Sprintf("%d:", inodeID))
-	iter := db.istore.NewIterator(lutil.BytesPrefix(prefix), nil)
-	if offset > 0 {
-		// convert key to db key
-		dbKey := []byte(fmt.Sprintf("%d:", inodeID))
-		dbKey = append(dbKey, key...)
-		iter.Seek(dbKey)
-	}
-	for iter.Next() {
-		kSlice := strings.Split(string(iter.Key()), ":")
-		name := kSlice[1]
-		if len(name) == 0 {
+	iter := db.istore.NewIterator(dentryPrefix(inodeID))
+	ok := iter.First()
+	if after != "" {
+		ok = iter.Seek(DbInodeKey(inodeID, after))
+	}
+	for ; ok; ok = iter.Next() {
+		name := string(iter.Key()[8:])
+		if len(name) == 0 || name == after {
 			continue
 		}
 		iid := utils.BytesToUint64(iter.Value())
@@ -394,27 +647,27 @@ func (db *Fsdb) GetChildren(inodeID uint64, offset int, limit int, key []byte) (
 	}
 	iter.Release()
 	if err := iter.Error(); err != nil {
-		return values, len(values), err
+		return values, err
 	}
 	for _, inode := range tmpValues {
 		val, err := db.aCache.Get(inode.InodeID)
 		if err == nil {
 			if err := inode.Attrs.Unmarshall(val); err != nil {
-				return values, len(values), err
+				return values, err
 			}
 			values = append(values, inode)
 			continue
 		}
 		if errors.Is(err, monocache.ErrKeyNotFound) {
-			v, err := db.astore.Get(inode.DbID(), nil)
+			v, err := db.astore.Get(inode.DbID())
 			if err != nil {
-				if errors.Is(err, leveldb.ErrNotFound) {
+				if errors.Is(err, metastore.ErrNotFound) {
 					continue
 				}
-				return values, len(values), err
+				return values, err
 			}
 			if err := inode.Attrs.Unmarshall(v); err != nil {
-				return values, len(values), err
+				return values, err
 			}
 			values = append(values, inode)
 		} else if errors.Is(err, monocache.ErrKeyDeleted) {
@@ -423,14 +676,13 @@ func (db *Fsdb) GetChildren(inodeID uint64, offset int, limit int, key []byte) (
 			break
 		}
 	}
-	return values, len(values), nil
+	return values, nil
 }
 
 // GetChildrenCount gets the number of children of an inode
 func (db *Fsdb) GetChildrenCount(inodeID uint64) (int, error) {
 	c := 0
-	prefix := []byte(fmt.Sprintf("%d:", inodeID))
-	iter := db.istore.NewIterator(lutil.BytesPrefix(prefix), nil)
+	iter := db.istore.NewIterator(dentryPrefix(inodeID))
 	for iter.Next() {
 		c++
 	}
@@ -438,9 +690,23 @@ func (db *Fsdb) GetChildrenCount(inodeID uint64) (int, error) {
 	return c, iter.Error()
 }
 
-// Fsck check databse for errors
-func (db *Fsdb) Fsck() error {
-	return fmt.Errorf("FSCK not implemented")
+// FindNames returns dentries pointing to an inode, it scans the whole inode
+// store and is meant for offline tools
+func (db *Fsdb) FindNames(inodeID uint64) ([]*Inode, error) {
+	names := []*Inode{}
+	iter := db.istore.NewIterator(nil)
+	for iter.Next() {
+		if utils.BytesToUint64(iter.Value()) != inodeID {
+			continue
+		}
+		parent, name, ok := ParseDbInodeKey(iter.Key())
+		if !ok {
+			continue
+		}
+		names = append(names, &Inode{InodeID: inodeID, ParentID: parent, Name: name})
+	}
+	iter.Release()
+	return names, iter.Error()
 }
 
 func InodeDirentType(mode os.FileMode) fuseutil.DirentType {
@@ -1,10 +1,18 @@
 package fsdb
 
 import (
+	"context"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jacobsa/fuse/fuseops"
 	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	msnapshot "github.com/radek-ryckowski/monofs/snapshot"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestNodeStore(t *testing.T) {
@@ -38,3 +46,120 @@ func TestNodeStore(t *testing.T) {
 		t.Fatalf("%v != %v", inode.Attrs.Mtime, TestInode.Attrs.Mtime)
 	}
 }
+
+func TestNodeStoreBolt(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+		MetaBackend:    metastore.Bolt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, name := range []string{"b", "a", "c:d"} {
+		inode := NewInode(uint64(10+i), 1, name, TestInode.Attrs)
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	children, err := db.GetChildren(1, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, c := range children {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "a,b,c:d" {
+		t.Fatalf("unexpected children %v", names)
+	}
+	if _, err := db.Snapshot.CreateSyncSnapshot("test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	cfg := &config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	}
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	add := func(id uint64, name string) {
+		t.Helper()
+		inode := NewInode(id, 1, name, InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+		})
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Snapshot.CreateSyncSnapshot("first"); err != nil {
+		t.Fatal(err)
+	}
+	add(20, "before")
+	// the copy of the first snapshot is taken now
+	if _, err := db.Snapshot.CreateSyncSnapshot("second"); err != nil {
+		t.Fatal(err)
+	}
+	add(21, "after")
+
+	open := func(name string) (*Fsdb, error) {
+		snapCfg := *cfg
+		snapCfg.Snapshot = name
+		return OpenSnapshot(&snapCfg)
+	}
+	_, err = open("second")
+	assert.Error(t, err)
+	_, err = open("missing")
+	assert.Error(t, err)
+
+	// the head stays mounted while its snapshot is served
+	snap, err := open("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, snap.ReadOnly())
+	inode, err := snap.GetInode(1, "before", true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(20), inode.InodeID)
+		assert.Equal(t, uint32(1), inode.Attrs.Nlink)
+	}
+	_, err = snap.GetInode(1, "after", true)
+	assert.ErrorIs(t, err, ErrNoSuchInode)
+	children, err := snap.GetChildren(1, "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, children, 1)
+
+	inode = NewInode(22, 1, "new", InodeAttributes{})
+	assert.ErrorIs(t, snap.AddInode(inode, true), ErrReadOnly)
+	assert.ErrorIs(t, snap.UpdateInodeAtime(20, time.Now()), ErrReadOnly)
+	assert.NoError(t, snap.Sync())
+	_, err = snap.GetInode(1, "new", false)
+	assert.ErrorIs(t, err, ErrNoSuchInode)
+	assert.False(t, snap.CheckIfFailed())
+
+	// the head is untouched
+	_, err = db.GetInode(1, "after", true)
+	assert.NoError(t, err)
+
+	// a served snapshot is kept until it is closed
+	gc := NewGC(db, t.TempDir(), 0, zap.NewNop().Sugar())
+	_, err = gc.DeleteSnapshot(context.Background(), "first")
+	assert.ErrorIs(t, err, msnapshot.ErrSnapshotMounted)
+	_, err = snap.GetInode(1, "before", true)
+	assert.NoError(t, err)
+	assert.NoError(t, snap.Close())
+	_, err = gc.DeleteSnapshot(context.Background(), "first")
+	assert.NoError(t, err)
+	_, err = open("first")
+	assert.Error(t, err)
+}
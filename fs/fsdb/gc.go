@@ -0,0 +1,379 @@
+package fsdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	msnapshot "github.com/radek-ryckowski/monofs/snapshot"
+	"github.com/radek-ryckowski/monofs/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultGCGracePeriod how long an item has to stay unreferenced before it is removed
+	DefaultGCGracePeriod = time.Hour
+	// DefaultGCInterval how often the background collector runs
+	DefaultGCInterval = time.Hour
+)
+
+// dataFileName matches names of per-file data stores, sha256 of the file
+// followed by the hash of the sync snapshot it was created under
+var dataFileName = regexp.MustCompile(`^[0-9a-f]{64}\.[0-9a-f]*$`)
+
+// GCReport describes a single collector run
+type GCReport struct {
+	// DryRun nothing was removed
+	DryRun bool
+	// Attrs attribute records without any dentry or orphan record
+	Attrs []uint64
+	// DataFiles data files not referenced by head or any snapshot
+	DataFiles []string
+	// Pending unreferenced items still within the grace period
+	Pending int
+	// DataSkipped data files were not checked because snapshot references couldn't be read
+	DataSkipped bool
+	// Started when the run started
+	Started time.Time
+}
+
+// GC removes attribute records and data files nothing refers to any more:
+// leftovers of failed creates, interrupted renames and crashes. An item is
+// removed only when it was found unreferenced by runs spanning the whole
+// grace period, so operations in flight are never raced.
+type GC struct {
+	db       *Fsdb
+	dataPath string
+	grace    time.Duration
+	log      *zap.SugaredLogger
+	mu       sync.Mutex
+	seen     map[string]time.Time
+	stop     chan bool
+	wg       sync.WaitGroup
+}
+
+// NewGC creates a garbage collector of db and data files in dataPath
+func NewGC(db *Fsdb, dataPath string, grace time.Duration, log *zap.SugaredLogger) *GC {
+	return &GC{
+		db:       db,
+		dataPath: dataPath,
+		grace:    grace,
+		log:      log,
+		seen:     make(map[string]time.Time),
+		stop:     make(chan bool),
+	}
+}
+
+// Start runs the collector every interval, a zero interval disables background runs
+func (gc *GC) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	gc.wg.Add(1)
+	go func() {
+		defer gc.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report, err := gc.Collect(false)
+				if err != nil {
+					gc.log.Errorf("GC: %v", err)
+					continue
+				}
+				if len(report.Attrs) > 0 || len(report.DataFiles) > 0 {
+					gc.log.Infof("GC removed %d attribute records and %d data files", len(report.Attrs), len(report.DataFiles))
+				}
+			case <-gc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background runs
+func (gc *GC) Stop() {
+	close(gc.stop)
+	gc.wg.Wait()
+}
+
+// Collect finds unreferenced items and removes those past the grace period,
+// in dry run mode it only reports them
+func (gc *GC) Collect(dryRun bool) (*GCReport, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	report := &GCReport{
+		DryRun:    dryRun,
+		Started:   time.Now(),
+		Attrs:     []uint64{},
+		DataFiles: []string{},
+	}
+	referenced, err := gc.referencedInodes()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := gc.headAttrs()
+	if err != nil {
+		return nil, err
+	}
+	candidates := map[string]bool{}
+	hashes := map[string]bool{}
+	for id, a := range attrs {
+		if referenced[id] {
+			if a.Hash != "" {
+				hashes[a.Hash] = true
+			}
+			continue
+		}
+		key := fmt.Sprintf("a:%d", id)
+		candidates[key] = true
+		if gc.expired(key, report.Started) {
+			report.Attrs = append(report.Attrs, id)
+		} else {
+			report.Pending++
+		}
+	}
+	files, err := gc.dataFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if err := gc.snapshotHashes(hashes); err != nil {
+			gc.log.Warnf("GC: skipping data files, snapshot references unavailable: %v", err)
+			report.DataSkipped = true
+			files = nil
+		}
+	}
+	for _, name := range files {
+		if hashes[name] {
+			continue
+		}
+		key := "d:" + name
+		candidates[key] = true
+		if gc.expired(key, report.Started) {
+			report.DataFiles = append(report.DataFiles, name)
+		} else {
+			report.Pending++
+		}
+	}
+	// forget items which got referenced again
+	for key := range gc.seen {
+		if !candidates[key] {
+			delete(gc.seen, key)
+		}
+	}
+	sort.Slice(report.Attrs, func(i, j int) bool { return report.Attrs[i] < report.Attrs[j] })
+	sort.Strings(report.DataFiles)
+	if dryRun {
+		return report, nil
+	}
+	for _, id := range report.Attrs {
+		if err := gc.db.DeleteInodeAttrs(id); err != nil {
+			return report, fmt.Errorf("deleting attributes of %d: %w", id, err)
+		}
+		delete(gc.seen, fmt.Sprintf("a:%d", id))
+	}
+	for _, name := range report.DataFiles {
+		if err := os.Remove(filepath.Join(gc.dataPath, name)); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		delete(gc.seen, "d:"+name)
+	}
+	return report, nil
+}
+
+// expired remembers when key was first found unreferenced and reports if it
+// stayed so for the whole grace period
+func (gc *GC) expired(key string, now time.Time) bool {
+	first, ok := gc.seen[key]
+	if !ok {
+		gc.seen[key] = now
+		first = now
+	}
+	return now.Sub(first) >= gc.grace
+}
+
+// referencedInodes returns inodes named by a dentry or kept by an orphan record
+func (gc *GC) referencedInodes() (map[uint64]bool, error) {
+	referenced := map[uint64]bool{}
+	iter := gc.db.istore.NewIterator(nil)
+	for iter.Next() {
+		if bytes.Equal(iter.Key(), formatKey) {
+			continue
+		}
+		referenced[utils.BytesToUint64(iter.Value())] = true
+	}
+	iter.Release()
+	return referenced, iter.Error()
+}
+
+// headAttrs returns all attribute records, cached changes not yet written to
+// astore included
+func (gc *GC) headAttrs() (map[uint64]InodeAttributes, error) {
+	attrs := map[uint64]InodeAttributes{}
+	iter := gc.db.astore.NewIterator(nil)
+	for iter.Next() {
+		if bytes.Equal(iter.Key(), wal.CheckpointKey) {
+			continue
+		}
+		var a InodeAttributes
+		if err := a.Unmarshall(iter.Value()); err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("attributes of %d: %w", utils.BytesToUint64(iter.Key()), err)
+		}
+		attrs[utils.BytesToUint64(iter.Key())] = a
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	var err error
+	gc.db.aCache.Range(func(key uint64, data []byte, deleted bool) {
+		if deleted {
+			delete(attrs, key)
+			return
+		}
+		var a InodeAttributes
+		if uerr := a.Unmarshall(data); uerr != nil {
+			err = fmt.Errorf("cached attributes of %d: %w", key, uerr)
+			return
+		}
+		attrs[key] = a
+	})
+	return attrs, err
+}
+
+// dataFiles lists data files in the data path
+func (gc *GC) dataFiles() ([]string, error) {
+	if gc.dataPath == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(gc.dataPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && dataFileName.MatchString(e.Name()) {
+			files = append(files, e.Name())
+		}
+	}
+	return files, nil
+}
+
+// snapshotHashes adds data hashes referenced by snapshot copies of attributes
+func (gc *GC) snapshotHashes(hashes map[string]bool) error {
+	base := filepath.Join(gc.db.Snapshot.SnapshotPath, msnapshot.SnapshostsDataPath)
+	paths, err := filepath.Glob(filepath.Join(base, "*", "attrs"))
+	if err != nil {
+		return err
+	}
+	// the first sync snapshot is stored without a hash directory
+	if _, err := os.Stat(filepath.Join(base, "attrs")); err == nil {
+		paths = append(paths, filepath.Join(base, "attrs"))
+	}
+	for _, p := range paths {
+		if err := copyHashes(p, hashes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyHashes adds data hashes referenced by the snapshot copy of attributes in p
+func copyHashes(p string, hashes map[string]bool) error {
+	sdb, err := metastore.Open(p, &metastore.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	defer sdb.Close()
+	iter := sdb.NewIterator(nil)
+	for iter.Next() {
+		// copies carry the WAL checkpoint they were dumped up to
+		if bytes.Equal(iter.Key(), wal.CheckpointKey) {
+			continue
+		}
+		var a InodeAttributes
+		if err = a.Unmarshall(iter.Value()); err != nil {
+			break
+		}
+		if a.Hash != "" {
+			hashes[a.Hash] = true
+		}
+	}
+	iter.Release()
+	if err == nil {
+		err = iter.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes snapshot name and removes data files referenced by
+// nothing else than its copy, it returns their names. When references of the
+// other snapshots can't be read the data files are left to the collector.
+func (gc *GC) DeleteSnapshot(ctx context.Context, name string) ([]string, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	hash, err := gc.db.Snapshot.Hash(name)
+	if err != nil {
+		return nil, err
+	}
+	released := map[string]bool{}
+	copyPath := filepath.Join(gc.db.Snapshot.DataPath(hash), "attrs")
+	if _, err := os.Stat(copyPath); err == nil {
+		if err := copyHashes(copyPath, released); err != nil {
+			return nil, err
+		}
+	}
+	if err := gc.db.Snapshot.DeleteSnapshot(ctx, name); err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	if gc.dataPath == "" || len(released) == 0 {
+		return removed, nil
+	}
+	attrs, err := gc.headAttrs()
+	if err != nil {
+		return removed, err
+	}
+	referenced := map[string]bool{}
+	for _, a := range attrs {
+		if a.Hash != "" {
+			referenced[a.Hash] = true
+		}
+	}
+	if err := gc.snapshotHashes(referenced); err != nil {
+		gc.log.Warnf("GC: keeping data of snapshot %q, snapshot references unavailable: %v", name, err)
+		return removed, nil
+	}
+	for file := range released {
+		if referenced[file] || !dataFileName.MatchString(file) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(gc.dataPath, file)); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		delete(gc.seen, "d:"+file)
+		removed = append(removed, file)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
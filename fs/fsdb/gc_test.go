@@ -0,0 +1,149 @@
+package fsdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	msnapshot "github.com/radek-ryckowski/monofs/snapshot"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestGCCollect(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dataPath := t.TempDir()
+	linkedHash := strings.Repeat("a", 64) + ".1"
+	leakedHash := strings.Repeat("b", 64) + ".1"
+	for _, name := range []string{linkedHash, leakedHash, "unrelated"} {
+		if err := os.WriteFile(filepath.Join(dataPath, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	linked := NewInode(30, 1, "linked", InodeAttributes{
+		Hash:            linkedHash,
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	if err := db.AddInode(linked, true); err != nil {
+		t.Fatal(err)
+	}
+	// attributes of a create interrupted before its dentry was written
+	leaked := NewInode(31, 1, "leaked", InodeAttributes{
+		Hash:            leakedHash,
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	if err := db.CreateInodeAttrs(leaked); err != nil {
+		t.Fatal(err)
+	}
+
+	gc := NewGC(db, dataPath, time.Hour, zap.NewNop().Sugar())
+	report, err := gc.Collect(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// within the grace period the attributes and their data file are only pending
+	assert.Equal(t, 0, len(report.Attrs))
+	assert.Equal(t, 2, report.Pending)
+
+	gc.grace = 0
+	report, err = gc.Collect(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []uint64{31}, report.Attrs)
+	// data of unreferenced attributes is unreferenced too
+	assert.Equal(t, []string{leakedHash}, report.DataFiles)
+	if _, err := db.GetFsdbInodeAttributes(31); err != nil {
+		t.Fatalf("dry run removed attributes: %v", err)
+	}
+
+	report, err = gc.Collect(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []uint64{31}, report.Attrs)
+	if _, err := db.GetFsdbInodeAttributes(31); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+	assert.Equal(t, []string{leakedHash}, report.DataFiles)
+	for name, exists := range map[string]bool{linkedHash: true, leakedHash: false, "unrelated": true} {
+		_, err := os.Stat(filepath.Join(dataPath, name))
+		assert.Equal(t, exists, err == nil, name)
+	}
+}
+
+func TestGCDeleteSnapshot(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dataPath := t.TempDir()
+	oldHash := strings.Repeat("a", 64) + ".1"
+	newHash := strings.Repeat("b", 64) + ".2"
+	sharedHash := strings.Repeat("c", 64) + ".1"
+	for _, name := range []string{oldHash, newHash, sharedHash} {
+		if err := os.WriteFile(filepath.Join(dataPath, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Snapshot.CreateSyncSnapshot("first"); err != nil {
+		t.Fatal(err)
+	}
+	changed := NewInode(30, 1, "changed", InodeAttributes{
+		Hash:            oldHash,
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	shared := NewInode(31, 1, "shared", InodeAttributes{
+		Hash:            sharedHash,
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	for _, inode := range []*Inode{changed, shared} {
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the copy of the first snapshot is taken now
+	if _, err := db.Snapshot.CreateSyncSnapshot("second"); err != nil {
+		t.Fatal(err)
+	}
+	changed.Attrs.Hash = newHash
+	if err := db.CreateInodeAttrs(changed); err != nil {
+		t.Fatal(err)
+	}
+
+	gc := NewGC(db, dataPath, time.Hour, zap.NewNop().Sugar())
+	_, err = gc.DeleteSnapshot(context.Background(), "second")
+	assert.ErrorIs(t, err, msnapshot.ErrCurrentSnapshot)
+	removed, err := gc.DeleteSnapshot(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the data the head doesn't refer to any more is released
+	assert.Equal(t, []string{oldHash}, removed)
+	for name, exists := range map[string]bool{oldHash: false, newHash: true, sharedHash: true} {
+		_, err := os.Stat(filepath.Join(dataPath, name))
+		assert.Equal(t, exists, err == nil, name)
+	}
+	_, err = db.Snapshot.Hash("first")
+	assert.ErrorIs(t, err, msnapshot.ErrSnapshotNotFound)
+}
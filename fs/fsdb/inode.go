@@ -1,8 +1,9 @@
 package fsdb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
-	"fmt"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/radek-ryckowski/monofs/utils"
@@ -14,11 +15,26 @@ type InodeAttributes struct {
 	fuseops.InodeAttributes
 }
 
+// DbInodeKey returns the istore key of a dentry, a big endian parent id
+// followed by the name bytes, so children of a directory are stored together
+// in name order
 func DbInodeKey(parent uint64, name string) []byte {
-	if len(name) == 0 {
-		return []byte(fmt.Sprintf("%d:", parent))
+	key := make([]byte, 8, 8+len(name))
+	binary.BigEndian.PutUint64(key, parent)
+	return append(key, name...)
+}
+
+// dentryPrefix returns the key prefix shared by all children of parent
+func dentryPrefix(parent uint64) []byte {
+	return DbInodeKey(parent, "")
+}
+
+// ParseDbInodeKey splits a dentry key into parent and name
+func ParseDbInodeKey(key []byte) (uint64, string, bool) {
+	if len(key) < 8 || bytes.HasPrefix(key, metaPrefix) {
+		return 0, "", false
 	}
-	return []byte(fmt.Sprintf("%d:%s", parent, name))
+	return binary.BigEndian.Uint64(key), string(key[8:]), true
 }
 
 type Inode struct {
@@ -81,12 +97,14 @@ func (i *Inode) Unmarshall(data []byte) error {
 	return json.Unmarshal(data, i)
 }
 
+// Marshall encodes attributes in the current binary format
 func (ia *InodeAttributes) Marshall() ([]byte, error) {
-	return json.Marshal(ia)
+	return encodeAttrs(ia), nil
 }
 
+// Unmarshall decodes attributes in the binary or the legacy JSON format
 func (ia *InodeAttributes) Unmarshall(data []byte) error {
-	return json.Unmarshal(data, ia)
+	return decodeAttrs(data, ia)
 }
 
 func (ia *InodeAttributes) GetHash() string {
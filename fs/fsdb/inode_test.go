@@ -2,12 +2,14 @@ package fsdb
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
 )
 
 const TestInodeHash = "e5ea704c794879536f4a325d35147d5fd4107ae1728c98f43e0ceeb5709f8f73"
@@ -39,3 +41,41 @@ func TestInodeAttributes(t *testing.T) {
 		t.Fatalf("Hash mismatch %x != %s", h, TestInodeHash)
 	}
 }
+
+func TestInodeAttributesFormats(t *testing.T) {
+	attrs := InodeAttributes{
+		Hash:            TestInodeHash,
+		ParentID:        1,
+		InodeAttributes: TestInode.Attrs.InodeAttributes,
+	}
+	attrs.Atime = time.Unix(1700000000, 123456789)
+	attrs.Rdev = 7
+	buf, err := attrs.Marshall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != attrsVersion {
+		t.Fatalf("version byte %d", buf[0])
+	}
+	legacy, err := json.Marshal(&attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{buf, legacy} {
+		var got InodeAttributes
+		if err := got.Unmarshall(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, attrs.Hash, got.Hash)
+		assert.Equal(t, attrs.ParentID, got.ParentID)
+		assert.Equal(t, attrs.Size, got.Size)
+		assert.Equal(t, attrs.Mode, got.Mode)
+		assert.Equal(t, attrs.Rdev, got.Rdev)
+		assert.True(t, attrs.Atime.Equal(got.Atime))
+		assert.True(t, attrs.Mtime.Equal(got.Mtime))
+		assert.True(t, got.Crtime.IsZero())
+	}
+	var got InodeAttributes
+	assert.Error(t, got.Unmarshall(buf[:len(buf)-1]))
+	assert.Error(t, got.Unmarshall([]byte{attrsVersion + 1}))
+}
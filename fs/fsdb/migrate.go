@@ -0,0 +1,126 @@
+package fsdb
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+// dentryKeysVersion is the istore key format written by DbInodeKey
+const dentryKeysVersion = 1
+
+// migrateBatchSize limits the number of keys rewritten in one batch
+const migrateBatchSize = 10000
+
+var (
+	// metaPrefix prefixes istore records which aren't dentries, allocated
+	// inode ids never reach it so it can't start a dentry key
+	metaPrefix = []byte{0xff}
+	// formatKey holds the istore key format version
+	formatKey = []byte{0xff, 'v'}
+)
+
+// parseLegacyDbInodeKey splits a "parent:name" key written before keys became
+// binary. Binary keys start with a zero byte, so they never parse.
+func parseLegacyDbInodeKey(key []byte) (uint64, string, bool) {
+	parent, name, ok := strings.Cut(string(key), ":")
+	if !ok {
+		return 0, "", false
+	}
+	id, err := strconv.ParseUint(parent, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return id, name, true
+}
+
+// migratedDentryKeys reports whether keys of store are in the current format
+func migratedDentryKeys(store metastore.MetaStore) (bool, error) {
+	v, err := store.Get(formatKey)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(v) == 8 && utils.BytesToUint64(v) >= dentryKeysVersion, nil
+}
+
+// migrateCopy migrates dentry keys of the inode store copy at path, copies
+// taken before keys became binary have legacy ones. Copies are served
+// read-only, one is opened for writing only while its keys are rewritten.
+func migrateCopy(path string, opts *metastore.Options) error {
+	store, err := metastore.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	migrated, err := migratedDentryKeys(store)
+	store.Close()
+	if err != nil || migrated {
+		return err
+	}
+	rw := *opts
+	rw.ReadOnly = false
+	store, err = metastore.Open(path, &rw)
+	if err != nil {
+		return err
+	}
+	if err := migrateDentryKeys(store); err != nil {
+		store.Close()
+		return err
+	}
+	return store.Close()
+}
+
+// migrateDentryKeys rewrites legacy dentry keys to the binary format. Every
+// batch deletes the old keys along with putting the new ones, so an
+// interrupted migration is continued on the next open.
+func migrateDentryKeys(store metastore.MetaStore) error {
+	migrated, err := migratedDentryKeys(store)
+	if err != nil || migrated {
+		return err
+	}
+	batch := new(metastore.Batch)
+	// the iterator is released before a batch is written, stores may keep
+	// writers waiting for open iterators
+	var from []byte
+	for {
+		iter := store.NewIterator(nil)
+		ok := iter.First()
+		if from != nil {
+			ok = iter.Seek(from)
+		}
+		for ; ok && batch.Len() < migrateBatchSize; ok = iter.Next() {
+			if bytes.HasPrefix(iter.Key(), metaPrefix) {
+				continue
+			}
+			parent, name, legacy := parseLegacyDbInodeKey(iter.Key())
+			if !legacy {
+				continue
+			}
+			batch.Delete(iter.Key())
+			batch.Put(DbInodeKey(parent, name), iter.Value())
+		}
+		if ok {
+			// the rewritten keys are gone, so the next pass resumes here
+			from = append([]byte{}, iter.Key()...)
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := store.Write(batch); err != nil {
+			return err
+		}
+		batch.Reset()
+	}
+	batch.Put(formatKey, utils.Uint64ToBytes(dentryKeysVersion))
+	return store.Write(batch)
+}
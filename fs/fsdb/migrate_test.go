@@ -0,0 +1,149 @@
+package fsdb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	msnapshot "github.com/radek-ryckowski/monofs/snapshot"
+	"github.com/radek-ryckowski/monofs/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateDentryKeys(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	dir := t.TempDir()
+	istore, err := metastore.Open(path.Join(dir, "inodes"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := map[string]uint64{
+		"0:":          1,
+		"1:a:b":       10,
+		"1:plain":     11,
+		"10:child":    12,
+		"2:no:colons": 13,
+	}
+	for key, id := range legacy {
+		if err := istore.Put([]byte(key), utils.Uint64ToBytes(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	istore.Close()
+
+	db, err := New(&config.Config{
+		Path:           dir,
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	attrs := InodeAttributes{InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644}}
+	for _, id := range []uint64{1, 10, 11, 12, 13} {
+		if err := db.CreateInodeAttrs(&Inode{InodeID: id, Attrs: attrs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, id := range legacy {
+		parent, name, _ := parseLegacyDbInodeKey([]byte(key))
+		inode, err := db.GetInode(parent, name, false)
+		if err != nil {
+			t.Fatal(fmt.Errorf("%s: %w", key, err))
+		}
+		assert.Equal(t, id, inode.InodeID)
+	}
+	children, err := db.GetChildren(1, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, c := range children {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{"a:b", "plain"}, names)
+	// nothing is left in the old format
+	iter := db.istore.NewIterator(nil)
+	for iter.Next() {
+		_, _, ok := parseLegacyDbInodeKey(iter.Key())
+		assert.False(t, ok, "%q", iter.Key())
+	}
+	iter.Release()
+	assert.NoError(t, migrateDentryKeys(db.istore))
+}
+
+func TestOpenSnapshotLegacyKeys(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	cfg := &config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	}
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inode := range []*Inode{
+		NewInode(fuseops.RootInodeID, fuseops.RootInodeID-1, "", InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+		}),
+		NewInode(20, fuseops.RootInodeID, "a:b", InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+		}),
+	} {
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Snapshot.CreateSyncSnapshot("first"); err != nil {
+		t.Fatal(err)
+	}
+	// the copy of the first snapshot is taken now
+	if _, err := db.Snapshot.CreateSyncSnapshot("second"); err != nil {
+		t.Fatal(err)
+	}
+	ipath := path.Join(msnapshot.CopyPath(cfg.Path, "first"), "inode")
+	db.Close()
+
+	// a copy taken by a version writing "parent:name" keys
+	copyDB, err := metastore.Open(ipath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(metastore.Batch)
+	iter := copyDB.NewIterator(nil)
+	for iter.Next() {
+		if parent, name, ok := ParseDbInodeKey(iter.Key()); ok {
+			batch.Delete(iter.Key())
+			batch.Put([]byte(fmt.Sprintf("%d:%s", parent, name)), iter.Value())
+		}
+	}
+	iter.Release()
+	batch.Delete(formatKey)
+	assert.NoError(t, copyDB.Write(batch))
+	copyDB.Close()
+
+	snapCfg := *cfg
+	snapCfg.Snapshot = "first"
+	snap, err := OpenSnapshot(&snapCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	root, err := snap.GetInode(fuseops.RootInodeID-1, "", false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(1), root.InodeID)
+	}
+	found, err := snap.GetInode(1, "a:b", true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(20), found.InodeID)
+	}
+	children, err := snap.GetChildren(1, "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, children, 1)
+}
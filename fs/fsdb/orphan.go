@@ -0,0 +1,35 @@
+package fsdb
+
+import (
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+// orphanPrefix prefixes istore keys of inodes which lost their last name while
+// still open
+var orphanPrefix = append(append([]byte{}, metaPrefix...), 'o')
+
+func orphanKey(ID uint64) []byte {
+	return append(append([]byte{}, orphanPrefix...), utils.Uint64ToBytes(ID)...)
+}
+
+// PutOrphan stages recording of an inode without names, so it is reclaimed
+// after a crash
+func (t *Txn) PutOrphan(ID uint64) {
+	t.put(orphanKey(ID), utils.Uint64ToBytes(ID))
+}
+
+// DeleteOrphan stages removal of an orphan record
+func (t *Txn) DeleteOrphan(ID uint64) {
+	t.delete(orphanKey(ID))
+}
+
+// GetOrphans returns inodes recorded as orphans
+func (db *Fsdb) GetOrphans() ([]uint64, error) {
+	orphans := []uint64{}
+	iter := db.istore.NewIterator(orphanPrefix)
+	for iter.Next() {
+		orphans = append(orphans, utils.BytesToUint64(iter.Value()))
+	}
+	iter.Release()
+	return orphans, iter.Error()
+}
@@ -0,0 +1,125 @@
+package fsdb
+
+import (
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/fs/monocache"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+// txnAttr is a single staged attribute change
+type txnAttr struct {
+	id      uint64
+	attrs   InodeAttributes
+	deleted bool
+}
+
+// Txn groups dentry and attribute changes of a single filesystem operation
+// (for example a new child together with its parent directory times), so
+// they are applied together by Commit
+type Txn struct {
+	db *Fsdb
+	// dentries inode store changes
+	dentries []wal.Entry
+	// names changed by dentries, dropped from the dentry cache on commit
+	names []dentryKey
+	attrs []txnAttr
+}
+
+// NewTxn creates an empty transaction
+func (db *Fsdb) NewTxn() *Txn {
+	return &Txn{
+		db: db,
+	}
+}
+
+// PutDentry stages creation of the inode's name in its parent
+func (t *Txn) PutDentry(inode *Inode) {
+	t.put(DbInodeKey(inode.ParentID, inode.Name), inode.DbID())
+	t.names = append(t.names, dentryKey{parent: inode.ParentID, name: inode.Name})
+}
+
+// DeleteDentry stages removal of the inode's name from its parent
+func (t *Txn) DeleteDentry(inode *Inode) {
+	t.delete(DbInodeKey(inode.ParentID, inode.Name))
+	t.names = append(t.names, dentryKey{parent: inode.ParentID, name: inode.Name})
+}
+
+// put stages setting an inode store key
+func (t *Txn) put(key, value []byte) {
+	t.dentries = append(t.dentries, wal.Entry{Key: key, Value: value, Dentry: true})
+}
+
+// delete stages removal of an inode store key
+func (t *Txn) delete(key []byte) {
+	t.dentries = append(t.dentries, wal.Entry{Key: key, Tombstoned: true, Dentry: true})
+}
+
+// PutAttrs stages an attribute record write, a later write of the same inode wins
+func (t *Txn) PutAttrs(ID uint64, attrs InodeAttributes) {
+	t.attrs = append(t.attrs, txnAttr{id: ID, attrs: attrs})
+}
+
+// DeleteAttrs stages removal of an attribute record
+func (t *Txn) DeleteAttrs(ID uint64) {
+	t.attrs = append(t.attrs, txnAttr{id: ID, deleted: true})
+}
+
+// Commit applies staged changes. They are logged in the WAL as a single
+// record before anything is applied, a crash either loses the whole operation
+// or the WAL replay completes it.
+func (t *Txn) Commit() error {
+	if len(t.attrs) == 0 && len(t.dentries) == 0 {
+		return nil
+	}
+	entries := make([]wal.Entry, 0, len(t.attrs)+len(t.dentries))
+	for _, a := range t.attrs {
+		entry := wal.Entry{Key: utils.Uint64ToBytes(a.id), Tombstoned: a.deleted}
+		if !a.deleted {
+			buf, err := a.attrs.Marshall()
+			if err != nil {
+				return err
+			}
+			entry.Value = buf
+		}
+		entries = append(entries, entry)
+	}
+	entries = append(entries, t.dentries...)
+	return t.db.aCache.WithGeneration(func(generation uint64) error {
+		if err := t.db.Wal.AddBatch(entries); err != nil {
+			return err
+		}
+		for _, entry := range entries[:len(t.attrs)] {
+			item := monocache.NewCacheItem(utils.BytesToUint64(entry.Key), entry.Value, generation, 0)
+			item.SetTombstoned(entry.Tombstoned)
+			t.db.aCache.Set(item)
+		}
+		if len(t.dentries) == 0 {
+			return nil
+		}
+		err := t.db.istore.Write(dentryBatch(t.dentries))
+		for _, k := range t.names {
+			t.db.dCache.Invalidate(k.parent, k.name)
+		}
+		if err != nil {
+			return t.db.MarkAsFailed(err)
+		}
+		return nil
+	})
+}
+
+// dentryBatch returns inode store changes of WAL entries as a batch
+func dentryBatch(entries []wal.Entry) *metastore.Batch {
+	batch := new(metastore.Batch)
+	for _, entry := range entries {
+		if !entry.Dentry {
+			continue
+		}
+		if entry.Tombstoned {
+			batch.Delete(entry.Key)
+		} else {
+			batch.Put(entry.Key, entry.Value)
+		}
+	}
+	return batch
+}
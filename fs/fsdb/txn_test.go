@@ -0,0 +1,160 @@
+package fsdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+)
+
+func TestTxnCommit(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	parent := NewInode(10, 1, "parent", InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+	})
+	child := NewInode(11, 10, "child", InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+	})
+	txn := db.NewTxn()
+	txn.PutAttrs(parent.InodeID, parent.Attrs)
+	txn.PutDentry(parent)
+	txn.PutAttrs(child.InodeID, child.Attrs)
+	txn.PutDentry(child)
+	parent.Attrs.Nlink++
+	txn.PutAttrs(parent.InodeID, parent.Attrs)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	inode, err := db.GetInode(1, "parent", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode.Attrs.Nlink != 3 {
+		t.Fatalf("parent nlink %d != 3", inode.Attrs.Nlink)
+	}
+	if _, err := db.GetInode(10, "child", true); err != nil {
+		t.Fatal(err)
+	}
+
+	txn = db.NewTxn()
+	txn.DeleteDentry(child)
+	txn.DeleteAttrs(child.InodeID)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetInode(10, "child", true); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+	if _, err := db.GetFsdbInodeAttributes(child.InodeID); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+}
+
+func TestTxnOrphans(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	db, err := New(&config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	file := NewInode(20, 1, "file", InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	if err := db.AddInode(file, true); err != nil {
+		t.Fatal(err)
+	}
+	txn := db.NewTxn()
+	txn.DeleteDentry(file)
+	txn.PutOrphan(file.InodeID)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := db.GetOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0] != file.InodeID {
+		t.Fatalf("unexpected orphans %v", orphans)
+	}
+	// orphan records are not children of any directory
+	children, err := db.GetChildren(1, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 0 {
+		t.Fatalf("unexpected children %v", children)
+	}
+	txn = db.NewTxn()
+	txn.DeleteOrphan(file.InodeID)
+	txn.DeleteAttrs(file.InodeID)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if orphans, _ := db.GetOrphans(); len(orphans) != 0 {
+		t.Fatalf("unexpected orphans %v", orphans)
+	}
+}
+
+func TestTxnReplay(t *testing.T) {
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	cfg := &config.Config{
+		Path:           t.TempDir(),
+		FilesystemName: "test",
+		CacheSize:      10000,
+	}
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := NewInode(10, 1, "old", InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644},
+	})
+	if err := db.AddInode(file, true); err != nil {
+		t.Fatal(err)
+	}
+	txn := db.NewTxn()
+	txn.DeleteDentry(file)
+	file.SetName("new")
+	file.Attrs.Nlink = 1
+	txn.PutDentry(file)
+	txn.PutAttrs(file.InodeID, file.Attrs)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// the inode store write of the rename is lost in a crash
+	if err := db.istore.Delete(DbInodeKey(1, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.istore.Put(DbInodeKey(1, "old"), file.DbID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetInode(1, "old", true); err != ErrNoSuchInode {
+		t.Fatalf("expected ErrNoSuchInode, got %v", err)
+	}
+	if _, err := db.GetInode(1, "new", true); err != nil {
+		t.Fatal(err)
+	}
+}
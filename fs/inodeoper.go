@@ -27,24 +27,34 @@ func (fs *Monofs) MkNode(
 	inode := fs.NewInode(op.Parent, op.Name, fsdb.InodeAttributes{
 		Hash: fmt.Sprintf("%x.%s", sha256.Sum(nil), fs.CurrentSnapshot),
 		InodeAttributes: fuseops.InodeAttributes{
-			Size:  4096,
-			Nlink: 1,
-			Mode:  op.Mode,
-			Rdev:  0,
-			Uid:   fs.uid,
-			Gid:   fs.gid,
-			Atime: t,
-			Mtime: t,
-			Ctime: t,
+			Size:   4096,
+			Nlink:  1,
+			Mode:   op.Mode,
+			Rdev:   0,
+			Uid:    fs.uid,
+			Gid:    fs.gid,
+			Atime:  t,
+			Mtime:  t,
+			Ctime:  t,
+			Crtime: t,
 		},
 	})
-	if err := fs.AddInode(inode, true); err != nil {
+	txn := fs.metadb.NewTxn()
+	txn.PutAttrs(inode.InodeID, inode.Attrs)
+	txn.PutDentry(inode)
+	if err := fs.stageParent(txn, op.Parent, t, 0); err != nil {
+		fs.log.Errorf("MkNode(stageParent)(%d:%s): %v", op.Parent, op.Name, err)
+		return fuse.EIO
+	}
+	if err := txn.Commit(); err != nil {
 		fs.log.Errorf("MkNode(%d:%s): %v", op.Parent, op.Name, err)
 		return fuse.EIO
 	}
 	// Report the inode's attributes.
 	op.Entry.Child = inode.ID()
 	op.Entry.Attributes = inode.Attrs.InodeAttributes
+	fs.setEntryExpiration(&op.Entry)
+	fs.refs.Lookup(op.Entry.Child)
 	return nil
 }
 
@@ -58,6 +68,9 @@ func (fs *Monofs) LookUpInode(
 	inode, err := fs.GetInode(op.Parent, op.Name, true)
 	if err != nil {
 		if errors.Is(err, fsdb.ErrNoSuchInode) {
+			if fs.negativeEntry(&op.Entry) {
+				return nil
+			}
 			return fuse.ENOENT
 		}
 		fs.log.Errorf("LookUpInode: %v", err)
@@ -66,6 +79,9 @@ func (fs *Monofs) LookUpInode(
 	// Report the inode's attributes.
 	op.Entry.Child = inode.ID()
 	op.Entry.Attributes = inode.Attrs.InodeAttributes
+	fs.atime.Apply(op.Entry.Child, &op.Entry.Attributes)
+	fs.setEntryExpiration(&op.Entry)
+	fs.refs.Lookup(op.Entry.Child)
 	return nil
 }
 
@@ -82,13 +98,16 @@ func (fs *Monofs) GetInodeAttributes(
 		fs.log.Errorf("GetInodeAttributes: %v", err)
 		return fuse.EIO
 	}
-	fs.patchTime(&attrs)
+	fs.atime.Apply(op.Inode, &attrs)
 	op.Attributes = attrs
+	op.AttributesExpiration = fs.attributesExpiration()
 	return nil
 }
 
 // SetInodeAttributes sets the attributes of an inode.
 func (fs *Monofs) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	fs.fsHashLock.Lock(op.Inode)
+	defer fs.fsHashLock.Unlock(op.Inode)
 	attrs, err := fs.GetInodeAttrs(op.Inode)
 	if err != nil {
 		if err == fsdb.ErrNoSuchInode {
@@ -98,7 +117,11 @@ func (fs *Monofs) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAt
 		fs.log.Errorf("SetInodeAttributes(%d): %v", op.Inode, err)
 		return fuse.EIO
 	}
+	t := fs.Clock.Now()
 	if op.Size != nil {
+		if attrs.Size != *op.Size {
+			attrs.Mtime = t
+		}
 		attrs.Size = *op.Size
 	}
 	if op.Mode != nil {
@@ -111,15 +134,22 @@ func (fs *Monofs) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAt
 		attrs.Gid = *op.Gid
 	}
 	if op.Atime != nil {
+		// explicitly set access time wins over a lazily tracked one
+		fs.atime.Forget(op.Inode)
 		attrs.Atime = *op.Atime
+	} else {
+		fs.atime.Apply(op.Inode, &attrs)
 	}
 	if op.Mtime != nil {
 		attrs.Mtime = *op.Mtime
 	}
+	attrs.Ctime = t
 	if err := fs.UpdateInodeAttrs(op.Inode, attrs); err != nil {
+		fs.log.Errorf("SetInodeAttributes(UpdateInodeAttrs)(%d): %v", op.Inode, err)
 		return fuse.EIO
 	}
 	op.Attributes = attrs
+	op.AttributesExpiration = fs.attributesExpiration()
 	return nil
 }
 
@@ -127,15 +157,16 @@ func (fs *Monofs) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAt
 func (fs *Monofs) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) error {
-	// TODO FIX THIS and check if op.N actually == inode access count
-	if op.N > 0 {
-		if err := fs.DeleteInodeAttrs(op.Inode); err != nil {
-			if err != fsdb.ErrNoSuchInode {
-				return fuse.ENOENT
-			}
-			fs.log.Errorf("ForgetInode(%d): %v", op.Inode, err)
-			return fuse.EIO
-		}
+	fs.released(op.Inode, fs.refs.Forget(op.Inode, op.N))
+	return nil
+}
+
+// BatchForget - Forget about several inodes.
+func (fs *Monofs) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, entry := range op.Entries {
+		fs.released(entry.Inode, fs.refs.Forget(entry.Inode, entry.N))
 	}
 	return nil
 }
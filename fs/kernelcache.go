@@ -0,0 +1,72 @@
+package monofs
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Invalidator asks the kernel to drop cached attributes and dentries
+type Invalidator interface {
+	// InvalidateInode drops cached attributes (and page cache) of inode
+	InvalidateInode(inode fuseops.InodeID) error
+	// InvalidateEntry drops cached lookup of name in parent, positive or negative
+	InvalidateEntry(parent fuseops.InodeID, name string) error
+}
+
+// noopInvalidator is used while the kernel connection can't send invalidation
+// notifications, the pinned fuse library has no FUSE_NOTIFY_INVAL_* support.
+// Kernel caches then expire after the configured TTLs.
+type noopInvalidator struct{}
+
+func (noopInvalidator) InvalidateInode(fuseops.InodeID) error         { return nil }
+func (noopInvalidator) InvalidateEntry(fuseops.InodeID, string) error { return nil }
+
+// SetInvalidator sets the kernel invalidation backend
+func (fs *Monofs) SetInvalidator(inv Invalidator) {
+	if inv == nil {
+		inv = noopInvalidator{}
+	}
+	fs.invalidator = inv
+}
+
+// setEntryExpiration sets cache expirations of an entry reported to the kernel.
+func (fs *Monofs) setEntryExpiration(entry *fuseops.ChildInodeEntry) {
+	now := fs.Clock.Now()
+	entry.AttributesExpiration = now.Add(fs.attrTTL)
+	entry.EntryExpiration = now.Add(fs.entryTTL)
+}
+
+// attributesExpiration returns expiration of attributes reported to the kernel.
+func (fs *Monofs) attributesExpiration() time.Time {
+	return fs.Clock.Now().Add(fs.attrTTL)
+}
+
+// negativeEntry fills a negative lookup result, returns false if negative entries are disabled.
+func (fs *Monofs) negativeEntry(entry *fuseops.ChildInodeEntry) bool {
+	if fs.negativeEntryTTL <= 0 {
+		return false
+	}
+	entry.Child = 0
+	entry.EntryExpiration = fs.Clock.Now().Add(fs.negativeEntryTTL)
+	return true
+}
+
+// ExternalChange has to be called whenever metadata changes without the kernel
+// knowing about it (e.g. applied from a remote source). It drops our own caches
+// and asks the kernel to drop its cached attributes and dentries.
+func (fs *Monofs) ExternalChange(parent fuseops.InodeID, name string, inode fuseops.InodeID) {
+	fs.metadb.InvalidateDentry(uint64(parent), name)
+	if inode != 0 {
+		if err := fs.invalidator.InvalidateInode(inode); err != nil {
+			fs.log.Errorf("InvalidateInode(%d): %v", inode, err)
+		}
+	}
+	if err := fs.invalidator.InvalidateEntry(parent, name); err != nil {
+		fs.log.Errorf("InvalidateEntry(%d:%s): %v", parent, name, err)
+	}
+	// parent mtime/ctime changed too
+	if err := fs.invalidator.InvalidateInode(parent); err != nil {
+		fs.log.Errorf("InvalidateInode(%d): %v", parent, err)
+	}
+}
@@ -0,0 +1,115 @@
+package monofs_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/monofstest"
+)
+
+func TestKernelCacheTTL(t *testing.T) {
+	h := monofstest.New(t, &monofstest.Options{Config: func(cfg *config.Config) {
+		cfg.AttrCacheTTL = time.Second
+		cfg.EntryCacheTTL = 2 * time.Second
+		cfg.NegativeEntryCacheTTL = 3 * time.Second
+	}})
+	clock := &timeutil.SimulatedClock{}
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.SetTime(now)
+	h.FS.Clock = clock
+	ctx := context.Background()
+
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: os.ModeDir | 0755}
+	assert.NoError(t, h.FS.MkDir(ctx, mkdir))
+	assert.Equal(t, now.Add(time.Second), mkdir.Entry.AttributesExpiration)
+	assert.Equal(t, now.Add(2*time.Second), mkdir.Entry.EntryExpiration)
+
+	create := &fuseops.CreateFileOp{Parent: mkdir.Entry.Child, Name: "file", Mode: 0644}
+	assert.NoError(t, h.FS.CreateFile(ctx, create))
+	assert.Equal(t, now.Add(time.Second), create.Entry.AttributesExpiration)
+	assert.Equal(t, now.Add(2*time.Second), create.Entry.EntryExpiration)
+	assert.NoError(t, h.FS.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle}))
+
+	entry, err := h.LookUp(mkdir.Entry.Child, "file")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Second), entry.AttributesExpiration)
+	assert.Equal(t, now.Add(2*time.Second), entry.EntryExpiration)
+	// a missing name is cached as a negative entry
+	entry, err = h.LookUp(mkdir.Entry.Child, "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, fuseops.InodeID(0), entry.Child)
+	assert.Equal(t, now.Add(3*time.Second), entry.EntryExpiration)
+
+	attrs := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	assert.NoError(t, h.FS.GetInodeAttributes(ctx, attrs))
+	assert.Equal(t, now.Add(time.Second), attrs.AttributesExpiration)
+
+	mode := os.FileMode(0600)
+	setattr := &fuseops.SetInodeAttributesOp{Inode: create.Entry.Child, Mode: &mode}
+	assert.NoError(t, h.FS.SetInodeAttributes(ctx, setattr))
+	assert.Equal(t, now.Add(time.Second), setattr.AttributesExpiration)
+}
+
+func TestKernelCacheNegativeEntryDisabled(t *testing.T) {
+	h := monofstest.New(t, nil)
+	_, err := h.LookUp(fuseops.RootInodeID, "missing")
+	assert.ErrorIs(t, err, fuse.ENOENT)
+}
+
+// recordingInvalidator records invalidations sent to the kernel
+type recordingInvalidator struct {
+	calls []string
+}
+
+func (r *recordingInvalidator) InvalidateInode(inode fuseops.InodeID) error {
+	r.calls = append(r.calls, fmt.Sprintf("inode %d", inode))
+	return nil
+}
+
+func (r *recordingInvalidator) InvalidateEntry(parent fuseops.InodeID, name string) error {
+	r.calls = append(r.calls, fmt.Sprintf("entry %d:%s", parent, name))
+	return nil
+}
+
+func TestExternalChange(t *testing.T) {
+	h := monofstest.New(t, nil)
+	inv := &recordingInvalidator{}
+	h.FS.SetInvalidator(inv)
+	dir := h.MkDir(fuseops.RootInodeID, "dir")
+	file := h.CreateFile(dir, "file", nil)
+	_, err := h.LookUp(dir, "file")
+	assert.NoError(t, err)
+	before := h.FS.DentryCacheStats()
+	_, err = h.LookUp(dir, "file")
+	assert.NoError(t, err)
+	assert.Equal(t, before.Hits+1, h.FS.DentryCacheStats().Hits)
+
+	h.FS.ExternalChange(dir, "file", file)
+	assert.Equal(t, []string{
+		fmt.Sprintf("inode %d", file),
+		fmt.Sprintf("entry %d:file", dir),
+		fmt.Sprintf("inode %d", dir),
+	}, inv.calls)
+	// the name is read from the inode store again
+	before = h.FS.DentryCacheStats()
+	_, err = h.LookUp(dir, "file")
+	assert.NoError(t, err)
+	assert.Equal(t, before.Misses+1, h.FS.DentryCacheStats().Misses)
+
+	// a new name has no inode to invalidate yet
+	inv.calls = nil
+	h.FS.ExternalChange(dir, "new", 0)
+	assert.Equal(t, []string{
+		fmt.Sprintf("entry %d:new", dir),
+		fmt.Sprintf("inode %d", dir),
+	}, inv.calls)
+}
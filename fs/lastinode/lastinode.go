@@ -8,8 +8,8 @@ import (
 	"syscall"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/metastore"
 	"github.com/radek-ryckowski/monofs/utils"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type LastInodeEngine struct {
@@ -21,10 +21,10 @@ type LastInodeEngine struct {
 	shutdown     chan bool
 	lastFile     *os.File
 	rlock        sync.RWMutex
-	db           *leveldb.DB
+	db           metastore.MetaStore
 }
 
-func New(path string, db *leveldb.DB) *LastInodeEngine {
+func New(path string, db metastore.MetaStore) *LastInodeEngine {
 	return &LastInodeEngine{
 		LastInode: fuseops.InodeID(utils.MaxUint40()),
 		Path:      path,
@@ -83,7 +83,7 @@ func (l *LastInodeEngine) addLastInode(inode fuseops.InodeID) error {
 
 func (l *LastInodeEngine) getInodeFromDb() error {
 	maxInode := uint64(utils.MaxUint40())
-	iter := l.db.NewIterator(nil, nil)
+	iter := l.db.NewIterator(nil)
 	for iter.Next() {
 		inode := utils.BytesToUint64(iter.Value())
 		if inode > maxInode {
@@ -0,0 +1,41 @@
+package monofs_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radek-ryckowski/monofs/fs/monofstest"
+)
+
+func TestLinkCountKeepsConcurrentChmod(t *testing.T) {
+	h := monofstest.New(t, nil)
+	ctx := context.Background()
+	file := h.CreateFile(fuseops.RootInodeID, "file", nil)
+	done := make(chan struct{})
+	mode := os.FileMode(0600)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			mode = os.FileMode(0600 + i%2*0040)
+			op := &fuseops.SetInodeAttributesOp{Inode: file, Mode: &mode}
+			assert.NoError(t, h.FS.SetInodeAttributes(ctx, op))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		link := &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "link", Target: file}
+		assert.NoError(t, h.FS.CreateLink(ctx, link))
+		rename := &fuseops.RenameOp{OldParent: fuseops.RootInodeID, OldName: "link", NewParent: fuseops.RootInodeID, NewName: "moved"}
+		assert.NoError(t, h.FS.Rename(ctx, rename))
+		assert.NoError(t, h.FS.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "moved"}))
+	}
+	<-done
+	// link count changes never write back a mode read before the chmod
+	attrs := &fuseops.GetInodeAttributesOp{Inode: file}
+	assert.NoError(t, h.FS.GetInodeAttributes(ctx, attrs))
+	assert.Equal(t, mode, attrs.Attributes.Mode&os.ModePerm)
+	assert.Equal(t, uint32(1), attrs.Attributes.Nlink)
+}
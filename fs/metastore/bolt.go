@@ -0,0 +1,250 @@
+package metastore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltFileName = "meta.bolt"
+	// boltSnapshotPattern names snapshot copies left next to the store by
+	// older versions
+	boltSnapshotPattern = "snapshot-*.bolt"
+	// boltMmapSize is mapped up front, writers wait for open read
+	// transactions only when the file outgrows the mapping
+	boltMmapSize = 1 << 30
+)
+
+var boltBucket = []byte("meta")
+
+// boltDB keeps all keys in a single bucket of a bbolt file
+type boltDB struct {
+	db *bolt.DB
+}
+
+func openBolt(path string, opts *Options) (*boltDB, error) {
+	if !opts.ReadOnly {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		// snapshot copies left by a crash of older versions
+		stale, _ := filepath.Glob(filepath.Join(path, boltSnapshotPattern))
+		for _, name := range stale {
+			os.Remove(name)
+		}
+	}
+	db, err := bolt.Open(filepath.Join(path, boltFileName), 0644, &bolt.Options{
+		Timeout:         time.Second,
+		ReadOnly:        opts.ReadOnly,
+		InitialMmapSize: boltMmapSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !opts.ReadOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &boltDB{db: db}, nil
+}
+
+func boltGet(tx *bolt.Tx, key []byte) ([]byte, error) {
+	b := tx.Bucket(boltBucket)
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (b *boltDB) Get(key []byte) ([]byte, error) {
+	var v []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = boltGet(tx, key)
+		return err
+	})
+	return v, err
+}
+
+// NewIterator reads entries in a read transaction held until Release. A
+// writer which has to grow the file waits for it, so the iterating goroutine
+// must not write to the store before releasing the iterator.
+func (b *boltDB) NewIterator(prefix []byte) Iterator {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return &boltIterator{err: err}
+	}
+	return newBoltIterator(tx, true, prefix)
+}
+
+func (b *boltDB) Put(key, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (b *boltDB) Delete(key []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+func (b *boltDB) Write(batch *Batch) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range batch.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot holds a read transaction until Release. Like an iterator it makes
+// writers growing the file wait, so it is meant to be released promptly.
+func (b *boltDB) Snapshot() (Snapshot, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshot{tx: tx}, nil
+}
+
+// Sync does nothing, every transaction is synced when it commits
+func (b *boltDB) Sync() error {
+	return nil
+}
+
+func (b *boltDB) Backend() string {
+	return Bolt
+}
+
+func (b *boltDB) Close() error {
+	return b.db.Close()
+}
+
+type boltSnapshot struct {
+	tx *bolt.Tx
+}
+
+func (s *boltSnapshot) Get(key []byte) ([]byte, error) {
+	if s.tx == nil {
+		return nil, ErrReleased
+	}
+	return boltGet(s.tx, key)
+}
+
+// NewIterator iterates in the transaction of the snapshot, iterators have to
+// be released before the snapshot
+func (s *boltSnapshot) NewIterator(prefix []byte) Iterator {
+	if s.tx == nil {
+		return &boltIterator{err: ErrReleased}
+	}
+	return newBoltIterator(s.tx, false, prefix)
+}
+
+func (s *boltSnapshot) Release() {
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+}
+
+type boltIterator struct {
+	tx *bolt.Tx
+	// owned transactions are rolled back on Release
+	owned  bool
+	cursor *bolt.Cursor
+	prefix []byte
+	key    []byte
+	value  []byte
+	// started is set once the iterator was positioned
+	started bool
+	err     error
+}
+
+func newBoltIterator(tx *bolt.Tx, owned bool, prefix []byte) *boltIterator {
+	it := &boltIterator{tx: tx, owned: owned, prefix: prefix}
+	if b := tx.Bucket(boltBucket); b != nil {
+		it.cursor = b.Cursor()
+	}
+	return it
+}
+
+// set positions the iterator at k unless it is past the prefix
+func (it *boltIterator) set(k, v []byte) bool {
+	it.started = true
+	if k == nil || !bytes.HasPrefix(k, it.prefix) {
+		it.key, it.value = nil, nil
+		return false
+	}
+	it.key, it.value = k, v
+	return true
+}
+
+func (it *boltIterator) First() bool {
+	return it.Seek(it.prefix)
+}
+
+func (it *boltIterator) Seek(key []byte) bool {
+	if it.cursor == nil {
+		return it.set(nil, nil)
+	}
+	if bytes.Compare(key, it.prefix) < 0 {
+		key = it.prefix
+	}
+	if len(key) == 0 {
+		return it.set(it.cursor.First())
+	}
+	return it.set(it.cursor.Seek(key))
+}
+
+func (it *boltIterator) Next() bool {
+	if !it.started {
+		return it.First()
+	}
+	if it.key == nil {
+		return false
+	}
+	return it.set(it.cursor.Next())
+}
+
+func (it *boltIterator) Key() []byte {
+	return it.key
+}
+
+func (it *boltIterator) Value() []byte {
+	return it.value
+}
+
+func (it *boltIterator) Release() {
+	if it.owned && it.tx != nil {
+		it.tx.Rollback()
+	}
+	it.tx, it.cursor, it.key, it.value = nil, nil, nil, nil
+}
+
+func (it *boltIterator) Error() error {
+	return it.err
+}
@@ -0,0 +1,122 @@
+package metastore
+
+import (
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lfilter "github.com/syndtr/goleveldb/leveldb/filter"
+	lopt "github.com/syndtr/goleveldb/leveldb/opt"
+	lutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelSyncKey is deleted by a synced write to flush the journal, it is never
+// stored
+var levelSyncKey = []byte("\xff\xffmetastore-sync")
+
+type levelDB struct {
+	db *leveldb.DB
+}
+
+func openLevelDB(path string, opts *Options) (*levelDB, error) {
+	o := &lopt.Options{
+		ReadOnly:       opts.ReadOnly,
+		ErrorIfMissing: opts.ErrorIfMissing,
+	}
+	if opts.BloomFilterSize > 0 {
+		o.Filter = lfilter.NewBloomFilter(opts.BloomFilterSize)
+	}
+	db, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDB{db: db}, nil
+}
+
+func levelErr(err error) error {
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return ErrNotFound
+	}
+	if errors.Is(err, leveldb.ErrSnapshotReleased) {
+		return ErrReleased
+	}
+	return err
+}
+
+func levelRange(prefix []byte) *lutil.Range {
+	if prefix == nil {
+		return nil
+	}
+	return lutil.BytesPrefix(prefix)
+}
+
+func levelBatch(b *Batch) *leveldb.Batch {
+	wb := new(leveldb.Batch)
+	for _, op := range b.ops {
+		if op.delete {
+			wb.Delete(op.key)
+		} else {
+			wb.Put(op.key, op.value)
+		}
+	}
+	return wb
+}
+
+func (l *levelDB) Get(key []byte) ([]byte, error) {
+	v, err := l.db.Get(key, nil)
+	return v, levelErr(err)
+}
+
+func (l *levelDB) NewIterator(prefix []byte) Iterator {
+	return l.db.NewIterator(levelRange(prefix), nil)
+}
+
+func (l *levelDB) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *levelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *levelDB) Write(b *Batch) error {
+	return l.db.Write(levelBatch(b), nil)
+}
+
+func (l *levelDB) Snapshot() (Snapshot, error) {
+	s, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, levelErr(err)
+	}
+	return &levelSnapshot{s: s}, nil
+}
+
+// Sync writes the journal to disk, empty batches are not written so a
+// deletion is
+func (l *levelDB) Sync() error {
+	return l.db.Delete(levelSyncKey, &lopt.WriteOptions{Sync: true})
+}
+
+func (l *levelDB) Backend() string {
+	return LevelDB
+}
+
+func (l *levelDB) Close() error {
+	return l.db.Close()
+}
+
+type levelSnapshot struct {
+	s *leveldb.Snapshot
+}
+
+func (s *levelSnapshot) Get(key []byte) ([]byte, error) {
+	v, err := s.s.Get(key, nil)
+	return v, levelErr(err)
+}
+
+func (s *levelSnapshot) NewIterator(prefix []byte) Iterator {
+	return s.s.NewIterator(levelRange(prefix), nil)
+}
+
+func (s *levelSnapshot) Release() {
+	s.s.Release()
+}
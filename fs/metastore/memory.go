@@ -0,0 +1,185 @@
+package metastore
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/tidwall/btree"
+)
+
+type memItem struct {
+	key, value []byte
+}
+
+func memLess(a, b memItem) bool {
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+// memDB keeps keys in a copy-on-write btree, nothing is written to disk
+type memDB struct {
+	mu   sync.RWMutex
+	tree *btree.BTreeG[memItem]
+}
+
+func openMemory() *memDB {
+	return &memDB{tree: btree.NewBTreeG(memLess)}
+}
+
+func memGet(tree *btree.BTreeG[memItem], key []byte) ([]byte, error) {
+	item, ok := tree.Get(memItem{key: key})
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, item.value...), nil
+}
+
+func (m *memDB) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return memGet(m.tree, key)
+}
+
+// NewIterator walks a copy of the tree, so writes made while iterating
+// neither block nor show up
+func (m *memDB) NewIterator(prefix []byte) Iterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return newMemIterator(m.tree.Copy(), prefix)
+}
+
+func (m *memDB) Put(key, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tree.Set(memItem{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+	return nil
+}
+
+func (m *memDB) Delete(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tree.Delete(memItem{key: key})
+	return nil
+}
+
+func (m *memDB) Write(b *Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range b.ops {
+		if op.delete {
+			m.tree.Delete(memItem{key: op.key})
+		} else {
+			m.tree.Set(memItem{key: op.key, value: op.value})
+		}
+	}
+	return nil
+}
+
+func (m *memDB) Snapshot() (Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &memSnapshot{tree: m.tree.Copy()}, nil
+}
+
+func (m *memDB) Sync() error {
+	return nil
+}
+
+func (m *memDB) Backend() string {
+	return Memory
+}
+
+func (m *memDB) Close() error {
+	return nil
+}
+
+type memSnapshot struct {
+	tree *btree.BTreeG[memItem]
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	if s.tree == nil {
+		return nil, ErrReleased
+	}
+	return memGet(s.tree, key)
+}
+
+func (s *memSnapshot) NewIterator(prefix []byte) Iterator {
+	if s.tree == nil {
+		return &memIterator{err: ErrReleased}
+	}
+	return newMemIterator(s.tree.Copy(), prefix)
+}
+
+func (s *memSnapshot) Release() {
+	s.tree = nil
+}
+
+type memIterator struct {
+	iter    btree.IterG[memItem]
+	prefix  []byte
+	valid   bool
+	started bool
+	err     error
+}
+
+func newMemIterator(tree *btree.BTreeG[memItem], prefix []byte) *memIterator {
+	return &memIterator{iter: tree.Iter(), prefix: prefix}
+}
+
+func (it *memIterator) check(ok bool) bool {
+	it.started = true
+	it.valid = ok && it.err == nil && bytes.HasPrefix(it.iter.Item().key, it.prefix)
+	return it.valid
+}
+
+func (it *memIterator) First() bool {
+	if it.err != nil {
+		return false
+	}
+	return it.check(it.iter.Seek(memItem{key: it.prefix}))
+}
+
+func (it *memIterator) Seek(key []byte) bool {
+	if it.err != nil {
+		return false
+	}
+	if bytes.Compare(key, it.prefix) < 0 {
+		key = it.prefix
+	}
+	return it.check(it.iter.Seek(memItem{key: key}))
+}
+
+func (it *memIterator) Next() bool {
+	if !it.started {
+		return it.First()
+	}
+	if !it.valid {
+		return false
+	}
+	return it.check(it.iter.Next())
+}
+
+func (it *memIterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.iter.Item().key
+}
+
+func (it *memIterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.iter.Item().value
+}
+
+func (it *memIterator) Release() {
+	if it.err == nil {
+		it.iter.Release()
+	}
+	it.valid = false
+}
+
+func (it *memIterator) Error() error {
+	return it.err
+}
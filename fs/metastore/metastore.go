@@ -0,0 +1,156 @@
+// Package metastore abstracts the ordered key-value stores holding filesystem
+// metadata, so the embedded database engine can be swapped
+package metastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// LevelDB goleveldb backend, the default
+	LevelDB = "leveldb"
+	// Bolt bbolt backend
+	Bolt = "bolt"
+	// Memory keeps everything in memory, the store is empty on every open
+	Memory = "memory"
+)
+
+var (
+	ErrNotFound = errors.New("metastore: not found")
+	ErrReleased = errors.New("metastore: snapshot released")
+)
+
+// Reader reads keys of a store or of a point-in-time snapshot
+type Reader interface {
+	// Get returns the value of key or ErrNotFound
+	Get(key []byte) ([]byte, error)
+	// NewIterator iterates keys starting with prefix in byte order, a nil
+	// prefix iterates all keys
+	NewIterator(prefix []byte) Iterator
+}
+
+// MetaStore is an ordered key-value store
+type MetaStore interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Write applies a batch atomically
+	Write(b *Batch) error
+	// Sync makes writes applied so far durable
+	Sync() error
+	// Snapshot returns a consistent read-only view of the current state,
+	// it has to be released
+	Snapshot() (Snapshot, error)
+	// Backend returns the name of the backend
+	Backend() string
+	Close() error
+}
+
+// Snapshot is a point-in-time view of a store
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// Iterator walks keys in byte order. Key and Value are valid until the next
+// call moving the iterator.
+type Iterator interface {
+	// First moves to the first key and reports whether it exists
+	First() bool
+	// Seek moves to the first key not smaller than key
+	Seek(key []byte) bool
+	// Next moves to the next key, an unpositioned iterator moves to the first one
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// Options of a store
+type Options struct {
+	// Backend to use, empty detects the backend of an existing store and
+	// falls back to LevelDB
+	Backend string
+	// BloomFilterSize bits per key of leveldb bloom filters
+	BloomFilterSize int
+	// ReadOnly opens the store read-only
+	ReadOnly bool
+	// ErrorIfMissing fails instead of creating a new store
+	ErrorIfMissing bool
+}
+
+// Open opens the store in directory path
+func Open(path string, opts *Options) (MetaStore, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Backend == Memory {
+		if opts.ErrorIfMissing {
+			return nil, fmt.Errorf("metastore %s: %w", path, os.ErrNotExist)
+		}
+		return openMemory(), nil
+	}
+	existing := detect(path)
+	if existing == "" && opts.ErrorIfMissing {
+		return nil, fmt.Errorf("metastore %s: %w", path, os.ErrNotExist)
+	}
+	backend := opts.Backend
+	if backend == "" {
+		backend = existing
+	}
+	if existing != "" && backend != existing {
+		return nil, fmt.Errorf("metastore %s holds a %s store, not %s", path, existing, backend)
+	}
+	switch backend {
+	case LevelDB, "":
+		return openLevelDB(path, opts)
+	case Bolt:
+		return openBolt(path, opts)
+	}
+	return nil, fmt.Errorf("unknown metastore backend %q", backend)
+}
+
+// detect returns the backend of the store in path or an empty string
+func detect(path string) string {
+	if _, err := os.Stat(filepath.Join(path, boltFileName)); err == nil {
+		return Bolt
+	}
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err == nil {
+		return LevelDB
+	}
+	return ""
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// Batch collects writes applied at once
+type Batch struct {
+	ops []batchOp
+}
+
+// Put stages setting key, key and value are copied
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+}
+
+// Delete stages removal of key
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte{}, key...), delete: true})
+}
+
+// Len returns the number of staged writes
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset drops staged writes
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
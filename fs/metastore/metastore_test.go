@@ -0,0 +1,139 @@
+package metastore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, backend string) {
+	dir := t.TempDir()
+	s, err := Open(dir, &Options{Backend: backend, BloomFilterSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, backend, s.Backend())
+
+	_, err = s.Get([]byte("missing"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, s.Put([]byte("a"), []byte("1")))
+	v, err := s.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+	assert.NoError(t, s.Delete([]byte("a")))
+	_, err = s.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	const chunk = 1024
+	n := chunk*2 + 10
+	b := new(Batch)
+	for i := 0; i < n; i++ {
+		b.Put([]byte(fmt.Sprintf("p/%05d", i)), []byte{byte(i)})
+	}
+	b.Put([]byte("q"), []byte("x"))
+	assert.Equal(t, n+1, b.Len())
+	assert.NoError(t, s.Write(b))
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	b.Delete([]byte("p/00000"))
+	b.Put([]byte("p/99999"), []byte("new"))
+	assert.NoError(t, s.Write(b))
+
+	count := func(r Reader) int {
+		c := 0
+		iter := r.NewIterator([]byte("p/"))
+		for iter.Next() {
+			c++
+		}
+		iter.Release()
+		assert.NoError(t, iter.Error())
+		return c
+	}
+	assert.Equal(t, n, count(snap))
+	assert.Equal(t, n, count(s))
+	_, err = snap.Get([]byte("p/00000"))
+	assert.NoError(t, err)
+	snap.Release()
+
+	iter := s.NewIterator([]byte("p/"))
+	assert.True(t, iter.Seek([]byte(fmt.Sprintf("p/%05d", chunk))))
+	assert.Equal(t, fmt.Sprintf("p/%05d", chunk), string(iter.Key()))
+	assert.True(t, iter.First())
+	assert.Equal(t, "p/00001", string(iter.Key()))
+	iter.Release()
+	iter = s.NewIterator(nil)
+	assert.True(t, iter.Seek([]byte("p/99999")))
+	assert.True(t, iter.Next())
+	assert.Equal(t, "q", string(iter.Key()))
+	assert.False(t, iter.Next())
+	iter.Release()
+	assert.NoError(t, s.Close())
+	if backend == Memory {
+		return
+	}
+
+	// an existing store keeps its backend
+	other := LevelDB
+	if backend == LevelDB {
+		other = Bolt
+	}
+	_, err = Open(dir, &Options{Backend: other})
+	assert.Error(t, err)
+	s, err = Open(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, backend, s.Backend())
+	v, err = s.Get([]byte("q"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), v)
+	assert.NoError(t, s.Close())
+}
+
+func TestLevelDB(t *testing.T) {
+	testStore(t, LevelDB)
+}
+
+func TestBolt(t *testing.T) {
+	testStore(t, Bolt)
+}
+
+func TestBoltIteratorView(t *testing.T) {
+	s, err := Open(t.TempDir(), &Options{Backend: Bolt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 3000; i++ {
+		assert.NoError(t, s.Put([]byte(fmt.Sprintf("k%05d", i)), []byte{1}))
+	}
+	// the whole iteration sees the store as it was when it started
+	iter := s.NewIterator(nil)
+	assert.True(t, iter.Next())
+	assert.NoError(t, s.Put([]byte("k99999"), []byte{1}))
+	assert.NoError(t, s.Delete([]byte("k02999")))
+	c := 1
+	last := ""
+	for iter.Next() {
+		c++
+		last = string(iter.Key())
+	}
+	iter.Release()
+	assert.NoError(t, iter.Error())
+	assert.Equal(t, 3000, c)
+	assert.Equal(t, "k02999", last)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, Memory)
+}
+
+func TestOpenMissing(t *testing.T) {
+	_, err := Open(t.TempDir(), &Options{ErrorIfMissing: true})
+	assert.Error(t, err)
+}
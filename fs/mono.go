@@ -7,15 +7,18 @@ import (
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/timeutil"
+	"github.com/radek-ryckowski/monofs/fs/atime"
 	"github.com/radek-ryckowski/monofs/fs/config"
 	monodir "github.com/radek-ryckowski/monofs/fs/dir"
 	monofile "github.com/radek-ryckowski/monofs/fs/file"
 	"github.com/radek-ryckowski/monofs/fs/fsdb"
 	"github.com/radek-ryckowski/monofs/fs/lastinode"
+	"github.com/radek-ryckowski/monofs/fs/refcount"
 	"github.com/radek-ryckowski/monofs/hash"
 	"github.com/radek-ryckowski/monofs/monoserver/manager"
 	pb "github.com/radek-ryckowski/monofs/proto"
@@ -45,11 +48,28 @@ type Monofs struct {
 	manager           *manager.Manager
 	grpcManager       *grpc.Server
 	localDataPath     string
+	blocks            monofile.Blocks
+	atime             *atime.Tracker
+	invalidator       Invalidator
+	attrTTL           time.Duration
+	entryTTL          time.Duration
+	negativeEntryTTL  time.Duration
+	refs              *refcount.Table
+	gc                *fsdb.GC
+	converter         *fsdb.AttrsConverter
+	// readOnly is set when a snapshot is served, nothing is written then
+	readOnly bool
 }
 
 func NewMonoFS(cfg *config.Config, log *zap.SugaredLogger) (*Monofs, error) {
 	var limit syscall.Rlimit
-	metadb, err := fsdb.New(cfg)
+	var metadb *fsdb.Fsdb
+	var err error
+	if cfg.Snapshot != "" {
+		metadb, err = fsdb.OpenSnapshot(cfg)
+	} else {
+		metadb, err = fsdb.New(cfg)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("metadb: %v", err)
 	}
@@ -68,12 +88,24 @@ func NewMonoFS(cfg *config.Config, log *zap.SugaredLogger) (*Monofs, error) {
 	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
 		return nil, err
 	}
+	if metadb.ReadOnly() {
+		return newSnapshotFS(cfg, metadb, uint32(uid), uint32(gid), limit.Cur, log), nil
+	}
 	lastInodeEngine := lastinode.New(cfg.Path, metadb.GetIStoreHandler())
 	s, err := metadb.StartSyncSnapshot()
 	if err != nil {
 		return nil, fmt.Errorf("StartSyncSnapshot: %v", err)
 	}
+	blocks := monofile.DiskBlocks
+	if cfg.InMemory {
+		blocks = monofile.NewMemBlocks()
+	}
+	gc := fsdb.NewGC(metadb, cfg.LocalDataPath, cfg.GCGracePeriod, log)
 	manager := manager.New(cfg.FilesystemName, metadb.Snapshot, cfg.ManagerPort)
+	manager.SetGC(gc)
+	manager.SetWAL(metadb.Wal)
+	manager.SetFsdb(metadb)
+	metadb.SetLogger(log)
 	manager.Start()
 
 	fs := &Monofs{
@@ -93,11 +125,59 @@ func NewMonoFS(cfg *config.Config, log *zap.SugaredLogger) (*Monofs, error) {
 		manager:           manager,
 		grpcManager:       grpc.NewServer(),
 		localDataPath:     cfg.LocalDataPath,
+		blocks:            blocks,
+		invalidator:       noopInvalidator{},
+		attrTTL:           cfg.AttrCacheTTL,
+		entryTTL:          cfg.EntryCacheTTL,
+		negativeEntryTTL:  cfg.NegativeEntryCacheTTL,
+		refs:              refcount.New(),
+		gc:                gc,
+		converter:         fsdb.NewAttrsConverter(metadb, fsdb.DefaultAttrsConvertBatch, log),
 	}
+	fs.atime = atime.New(cfg.AtimePolicy, cfg.AtimeFlushInterval, fs.flushAtime, log)
+	fs.atime.Start()
+	fs.gc.Start(cfg.GCInterval)
+	fs.converter.Start(fsdb.DefaultAttrsConvertInterval)
 	return fs, nil
 }
 
+// newSnapshotFS serves a snapshot opened read-only, files read the data their
+// attributes name in cfg.LocalDataPath. The head copies data shared with a
+// snapshot before it opens it for writing, see ownData. The manager, the
+// garbage collector and access times are disabled.
+func newSnapshotFS(cfg *config.Config, metadb *fsdb.Fsdb, uid, gid uint32, maxFiles uint64, log *zap.SugaredLogger) *Monofs {
+	fs := &Monofs{
+		Name:              cfg.FilesystemName,
+		metadb:            metadb,
+		log:               log,
+		Clock:             timeutil.RealClock(),
+		files:             make(map[fuseops.InodeID]*monofile.FsFile),
+		fileHandles:       make(map[fuseops.HandleID]*monofile.FsFile),
+		dirHandles:        make(map[fuseops.HandleID]*monodir.FsDir),
+		uid:               uid,
+		gid:               gid,
+		fsHashLock:        hash.New(maxFiles),
+		CurrentSnapshot:   cfg.Snapshot,
+		stopSnapshotCheck: make(chan bool),
+		localDataPath:     cfg.LocalDataPath,
+		blocks:            monofile.DiskBlocks,
+		invalidator:       noopInvalidator{},
+		attrTTL:           cfg.AttrCacheTTL,
+		entryTTL:          cfg.EntryCacheTTL,
+		negativeEntryTTL:  cfg.NegativeEntryCacheTTL,
+		refs:              refcount.New(),
+		gc:                fsdb.NewGC(metadb, cfg.LocalDataPath, cfg.GCGracePeriod, log),
+		converter:         fsdb.NewAttrsConverter(metadb, fsdb.DefaultAttrsConvertBatch, log),
+		readOnly:          true,
+	}
+	fs.atime = atime.New(atime.Noatime, cfg.AtimeFlushInterval, fs.flushAtime, log)
+	return fs
+}
+
 func (fs *Monofs) PostInitStart() error {
+	if fs.manager == nil {
+		return nil
+	}
 	lis, err := net.Listen("tcp", fs.manager.Port)
 	if err != nil {
 		return err
@@ -112,6 +192,9 @@ func (fs *Monofs) PostInitStart() error {
 }
 
 func (fs *Monofs) Stop() error {
+	if fs.manager == nil {
+		return nil
+	}
 	fs.grpcManager.Stop()
 	fs.manager.Stop()
 	return nil
@@ -2,7 +2,9 @@ package monocache
 
 import (
 	"errors"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/radek-ryckowski/monofs/utils"
@@ -13,112 +15,152 @@ var (
 	ErrKeyDeleted  = errors.New("key deleted")
 )
 
-type CacheTable struct {
-	// contains filtered or unexported fields
-	table map[interface{}]*CacheItem
+const (
+	// DefaultShards number of shards of a cache table
+	DefaultShards = 32
+	// accessBuffer how many reads a shard remembers until its policy is updated
+	accessBuffer = 64
+)
+
+// shard holds the items whose keys hash to it, each shard has its own lock
+// and policy
+type shard struct {
 	sync.RWMutex
-	threshold           int
-	addCallback         func(key uint64, data []byte) error
-	delCallback         func(key uint64, data []byte) error
-	cacheFullCallback   func(output chan string) error
-	ticker              *time.Ticker
-	stop                chan bool
-	cacheMutations      int
-	minSize             int
-	cacheGeneration     uint64
-	fullCallbackRunning bool
-	currentSize         int
-}
-
-// NewCacheTable creates new cache table
-func NewCacheTable(threshold int) *CacheTable {
+	table  map[uint64]*CacheItem
+	policy Policy
+	// accesses keys read under the read lock, they are applied to the policy
+	// once the write lock is taken. Reads made while it is full are not
+	// recorded, the policy sees a sample of reads of busy shards.
+	accesses chan uint64
+}
+
+// recordAccess remembers a read of key, it may be called with the read lock held
+func (s *shard) recordAccess(key uint64) {
+	select {
+	case s.accesses <- key:
+	default:
+	}
+}
+
+// applyAccesses passes recorded reads to the policy, must be called with lock held
+func (s *shard) applyAccesses() {
+	for {
+		select {
+		case key := <-s.accesses:
+			if _, ok := s.table[key]; ok {
+				s.policy.Access(key)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Logger receives failures of flushes running in the background
+type Logger interface {
+	Errorf(template string, args ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Errorf(template string, args ...interface{}) {
+	log.Printf(template, args...)
+}
+
+type CacheTable struct {
+	shards []*shard
+	// mask selects a shard from a key hash
+	mask uint64
+	// genLock is held for reading by writes from picking the generation of an
+	// item until its callback returns, and for writing while the generation
+	// changes and the cache full callback starts writing out the previous
+	// one, so a flush covers every item of its generation. It guards the
+	// settings and callbacks too.
+	genLock           sync.RWMutex
+	threshold         int
+	addCallback       func(key uint64, data []byte) error
+	delCallback       func(key uint64, data []byte) error
+	cacheFullCallback func(output chan string) error
+	ticker            *time.Ticker
+	stop              chan bool
+	minSize           int
+	cacheGeneration   atomic.Uint64
+	newPolicy         func() Policy
+	nShards           int
+	log               Logger
+	// maxBytes budget of item data, zero bounds the number of items instead
+	maxBytes int64
+	count    atomic.Int64
+	bytes    atomic.Int64
+	// throttleCallback is called by writes before they take any lock, it
+	// blocks them while flushed items can't be written out fast enough
+	throttleCallback func() error
+}
+
+// TableOption configures a cache table
+type TableOption func(*CacheTable)
+
+// WithPolicy sets the eviction policy, every shard gets its own from
+// newPolicy. LRU is used by default.
+func WithPolicy(newPolicy func() Policy) TableOption {
+	return func(t *CacheTable) {
+		t.newPolicy = newPolicy
+	}
+}
+
+// WithMaxBytes bounds the size of cached data, items are evicted once they
+// are flushed whenever the cache is over it
+func WithMaxBytes(maxBytes int64) TableOption {
+	return func(t *CacheTable) {
+		t.maxBytes = maxBytes
+	}
+}
+
+// WithShards sets the number of shards, it is rounded up to a power of two
+func WithShards(n int) TableOption {
+	return func(t *CacheTable) {
+		t.nShards = n
+	}
+}
+
+// NewCacheTable creates new cache table. Once it holds more than threshold
+// items, or more data than its byte budget, the cache full callback is asked
+// to flush them. Only flushed items are evicted: with a byte budget until the
+// cache fits in it, otherwise until half of threshold items are left.
+func NewCacheTable(threshold int, opts ...TableOption) *CacheTable {
 	ct := &CacheTable{
-		table:               make(map[interface{}]*CacheItem),
-		stop:                make(chan bool),
-		ticker:              time.NewTicker(1 * time.Second),
-		cacheMutations:      0,
-		minSize:             int(float64(threshold) * 0.5),
-		cacheGeneration:     0,
-		fullCallbackRunning: false,
-		threshold:           threshold,
+		stop:      make(chan bool),
+		ticker:    time.NewTicker(1 * time.Second),
+		minSize:   int(float64(threshold) * 0.5),
+		threshold: threshold,
+		newPolicy: func() Policy { return NewLRU() },
+		nShards:   DefaultShards,
+		log:       stdLogger{},
+	}
+	for _, opt := range opts {
+		opt(ct)
+	}
+	n := 1
+	for n < ct.nShards {
+		n <<= 1
+	}
+	ct.mask = uint64(n - 1)
+	ct.shards = make([]*shard, n)
+	for i := range ct.shards {
+		ct.shards[i] = &shard{
+			table:    make(map[uint64]*CacheItem),
+			policy:   ct.newPolicy(),
+			accesses: make(chan uint64, accessBuffer),
+		}
 	}
 	// add error handling in callbacks and log them
 	go func() {
 		for {
 			select {
 			case <-ct.ticker.C:
-				meanAccess := float64(0)
-				ct.Lock()
-				// if cache is larger than utilization size
-				if len(ct.table) > ct.threshold {
-					if ct.fullCallbackRunning {
-						ct.Unlock()
-						continue
-					}
-					// switch generation
-					ct.cacheGeneration++
-					// run fullCallback
-					ct.fullCallbackRunning = true
-					ct.Unlock()
-					if ct.cacheFullCallback != nil {
-						processedElements := make(chan string, len(ct.table))
-						oldCacheGeneration := ct.cacheGeneration - 1
-						err := ct.cacheFullCallback(processedElements)
-						ct.fullCallbackRunning = false
-						if err != nil {
-							//TODO LOG ERROR
-							continue
-						}
-						go func() {
-							for strKey := range processedElements {
-								ct.Lock()
-								key := utils.BytesToUint64([]byte(strKey))
-								if item, ok := ct.table[key]; ok {
-									if item.GetGeneration() == oldCacheGeneration {
-										ct.table[key].SetProcessed(true)
-									}
-								}
-								ct.Unlock()
-							}
-						}()
-					} else {
-						ct.fullCallbackRunning = false
-					}
-				} else {
-					ct.Unlock()
-				}
-				ct.Lock()
-				oldGenerationCount := 0
-				for key, item := range ct.table {
-					if item.GetTTL() > 0 && time.Since(item.GetLastAccess()) > item.GetTTL() {
-						ct.currentSize--
-						delete(ct.table, key)
-					} else {
-						if item.GetGeneration() != ct.cacheGeneration {
-							meanAccess += float64(item.GetAccessCount())
-							oldGenerationCount++
-						}
-					}
-				}
-				if oldGenerationCount == 0 {
-					ct.Unlock()
-					continue
-				}
-				meanAccess /= float64(oldGenerationCount)
-				if ct.cacheMutations > ct.threshold {
-					for key, item := range ct.table {
-						//this should only include keys which are already deployed in db
-						if item.IsProcessed() && item.GetAccessCount() <= uint64(meanAccess) && item.GetGeneration() != ct.cacheGeneration {
-							delete(ct.table, key)
-							ct.cacheMutations--
-							ct.currentSize--
-							if ct.cacheMutations <= ct.minSize {
-								break
-							}
-						}
-					}
-				}
-				ct.Unlock()
+				ct.flush(false)
+				ct.expire()
+				ct.evict()
 			case <-ct.stop:
 				return
 			}
@@ -127,39 +169,229 @@ func NewCacheTable(threshold int) *CacheTable {
 	return ct
 }
 
+// shard returns the shard of key, inode numbers are sequential so they are
+// mixed first
+func (ct *CacheTable) shard(key uint64) *shard {
+	return ct.shards[(key*0x9e3779b97f4a7c15>>32)&ct.mask]
+}
+
+// Flush starts a new generation and passes the previous one to the cache full
+// callback even if the cache isn't full
+func (ct *CacheTable) Flush() {
+	ct.flush(true)
+}
+
+// flush starts a new generation and passes the previous one to the cache full
+// callback when the cache is full or force is set, items it reports as
+// written are marked processed. Writers wait until the callback returns, so
+// none of them logs an item of the new generation to a file the callback
+// writes out as the previous one.
+func (ct *CacheTable) flush(force bool) {
+	ct.genLock.Lock()
+	if !force && !ct.full() {
+		ct.genLock.Unlock()
+		return
+	}
+	// switch generation
+	oldCacheGeneration := ct.cacheGeneration.Add(1) - 1
+	cb := ct.cacheFullCallback
+	if cb == nil {
+		ct.genLock.Unlock()
+		return
+	}
+	processedElements := make(chan string, ct.Len())
+	err := cb(processedElements)
+	log := ct.log
+	ct.genLock.Unlock()
+	if err != nil {
+		log.Errorf("flushing cache generation %d: %v", oldCacheGeneration, err)
+		return
+	}
+	go func() {
+		for strKey := range processedElements {
+			key := utils.BytesToUint64([]byte(strKey))
+			s := ct.shard(key)
+			s.Lock()
+			if item, ok := s.table[key]; ok {
+				if item.GetGeneration() == oldCacheGeneration {
+					item.SetProcessed(true)
+				}
+			}
+			s.Unlock()
+		}
+	}()
+}
+
+// full reports whether items have to be flushed, must be called with genLock held
+func (ct *CacheTable) full() bool {
+	if ct.maxBytes > 0 && ct.bytes.Load() > ct.maxBytes {
+		return true
+	}
+	return ct.count.Load() > int64(ct.threshold)
+}
+
+// expire drops items not accessed within their ttl
+func (ct *CacheTable) expire() {
+	for _, s := range ct.shards {
+		s.Lock()
+		for key, item := range s.table {
+			if item.GetTTL() > 0 && time.Since(item.GetLastAccess()) > item.GetTTL() {
+				s.policy.Remove(key)
+				ct.drop(s, key)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// evict drops processed items in the order chosen by the shard policies, one
+// item of every shard at a time
+func (ct *CacheTable) evict() {
+	ct.genLock.RLock()
+	threshold, minSize := int64(ct.threshold), int64(ct.minSize)
+	ct.genLock.RUnlock()
+	over := func() bool { return ct.maxBytes > 0 && ct.bytes.Load() > ct.maxBytes }
+	if ct.maxBytes <= 0 {
+		if ct.count.Load() <= threshold {
+			return
+		}
+		over = func() bool { return ct.count.Load() > minSize }
+	}
+	for progress := true; progress; {
+		progress = false
+		for _, s := range ct.shards {
+			if !over() {
+				return
+			}
+			s.Lock()
+			s.applyAccesses()
+			if key, ok := s.policy.Evict(s.evictable); ok {
+				ct.drop(s, key)
+				progress = true
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// evictable only items already written to the store can be evicted
+func (s *shard) evictable(key uint64) bool {
+	item, ok := s.table[key]
+	return ok && item.IsProcessed()
+}
+
+// put stores item, must be called with the shard lock held
+func (ct *CacheTable) put(s *shard, item *CacheItem) {
+	s.applyAccesses()
+	if old, ok := s.table[item.Key]; ok {
+		ct.bytes.Add(-old.size())
+		s.policy.Access(item.Key)
+	} else {
+		ct.count.Add(1)
+		s.policy.Add(item.Key)
+	}
+	s.table[item.Key] = item
+	ct.bytes.Add(item.size())
+}
+
+// drop removes key without telling the policy, must be called with the shard
+// lock held
+func (ct *CacheTable) drop(s *shard, key uint64) {
+	if item, ok := s.table[key]; ok {
+		ct.count.Add(-1)
+		ct.bytes.Add(-item.size())
+		delete(s.table, key)
+	}
+}
+
 // Add adds new item to cache
 func (t *CacheTable) Add(key uint64, data []byte, ttl time.Duration, opts ...Option) error {
-	t.Lock()
-	defer t.Unlock()
-	t.currentSize++
-	t.table[key] = NewCacheItem(key, data, t.cacheGeneration, ttl, opts...)
-	t.cacheMutations++
+	if err := t.throttle(); err != nil {
+		return err
+	}
+	t.genLock.RLock()
+	defer t.genLock.RUnlock()
+	s := t.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	t.put(s, NewCacheItem(key, data, t.cacheGeneration.Load(), ttl, opts...))
 	if t.addCallback != nil {
 		return t.addCallback(key, data)
 	}
 	return nil
 }
 
+// AddIfAbsent adds new item to cache unless the key is already cached, it
+// reports whether the item was added
+func (t *CacheTable) AddIfAbsent(key uint64, data []byte, ttl time.Duration, opts ...Option) (bool, error) {
+	return t.AddIfAbsentFunc(key, func() ([]byte, error) { return data, nil }, ttl, opts...)
+}
+
+// AddIfAbsentFunc adds the item returned by fn unless the key is already
+// cached, nothing is added when fn returns nil. fn runs while the key can't be
+// added or evicted, an uncached item was written to the store already.
+func (t *CacheTable) AddIfAbsentFunc(key uint64, fn func() ([]byte, error), ttl time.Duration, opts ...Option) (bool, error) {
+	if err := t.throttle(); err != nil {
+		return false, err
+	}
+	t.genLock.RLock()
+	defer t.genLock.RUnlock()
+	s := t.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.table[key]; ok {
+		return false, nil
+	}
+	data, err := fn()
+	if err != nil || data == nil {
+		return false, err
+	}
+	t.put(s, NewCacheItem(key, data, t.cacheGeneration.Load(), ttl, opts...))
+	if t.addCallback != nil {
+		return true, t.addCallback(key, data)
+	}
+	return true, nil
+}
+
 // Set sets item in cache
 func (t *CacheTable) Set(item *CacheItem) {
-	t.Lock()
-	defer t.Unlock()
-	t.currentSize++
-	t.table[item.Key] = item
-	t.cacheMutations++
+	s := t.shard(item.Key)
+	s.Lock()
+	defer s.Unlock()
+	t.put(s, item)
+}
+
+// WithGeneration runs fn while the cache generation can't change. Callers
+// logging changes themselves instead of through the add and delete callbacks
+// log them and Set their items from fn with the generation passed to it.
+func (t *CacheTable) WithGeneration(fn func(generation uint64) error) error {
+	if err := t.throttle(); err != nil {
+		return err
+	}
+	t.genLock.RLock()
+	defer t.genLock.RUnlock()
+	return fn(t.cacheGeneration.Load())
 }
 
 // Del deletes item from cache
 func (t *CacheTable) Del(key uint64) error {
-	t.Lock()
-	defer t.Unlock()
-	if _, ok := t.table[key]; !ok {
+	if err := t.throttle(); err != nil {
+		return err
+	}
+	t.genLock.RLock()
+	defer t.genLock.RUnlock()
+	s := t.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	item, ok := s.table[key]
+	if !ok {
 		return ErrKeyNotFound
 	}
-	t.table[key].SetTombstoned(true)
-	t.cacheMutations++
+	item.SetTombstoned(true)
+	s.applyAccesses()
+	s.policy.Access(key)
 	if t.delCallback != nil {
-		bData, err := t.table[key].Marshall()
+		bData, err := item.Marshall()
 		if err != nil {
 			return err
 		}
@@ -168,49 +400,101 @@ func (t *CacheTable) Del(key uint64) error {
 	return nil
 }
 
-// Get returns item from cache
+// Get returns item from cache, items past their ttl are reported as missing
+// and dropped by the next expiry run
 func (t *CacheTable) Get(key uint64) ([]byte, error) {
-	t.RLock()
-	defer t.RUnlock()
-	item, ok := t.table[key]
+	s := t.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	item, ok := s.table[key]
 	if !ok {
 		return nil, ErrKeyNotFound
 	}
 	if item.GetTTL() > 0 && time.Since(item.GetLastAccess()) > item.GetTTL() {
-		delete(t.table, key)
 		return nil, ErrKeyNotFound
 	}
+	s.recordAccess(key)
 	if item.IsTomstoned() {
 		return nil, ErrKeyDeleted
 	}
 	return item.GetData(), nil
 }
 
+// Range calls fn for every item in cache, deleted items are reported with
+// their tombstone. It doesn't count as an access and fn is called without the
+// cache lock held.
+func (t *CacheTable) Range(fn func(key uint64, data []byte, deleted bool)) {
+	items := make([]*CacheItem, 0, t.Len())
+	for _, s := range t.shards {
+		s.RLock()
+		for _, item := range s.table {
+			items = append(items, item)
+		}
+		s.RUnlock()
+	}
+	for _, item := range items {
+		item.RLock()
+		key, data, deleted := item.Key, item.Data, item.Tombstoned
+		item.RUnlock()
+		fn(key, data, deleted)
+	}
+}
+
 // Len returns number of items in cache
 func (t *CacheTable) Len() int {
-	t.RLock()
-	defer t.RUnlock()
-	return t.currentSize
+	return int(t.count.Load())
+}
+
+// Size returns the size of cached data in bytes
+func (t *CacheTable) Size() int64 {
+	return t.bytes.Load()
 }
 
 // SetAddCallback sets callback function which is called when item is added to cache
 func (t *CacheTable) SetAddCallback(cb func(key uint64, data []byte) error) {
-	t.Lock()
-	defer t.Unlock()
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
 	t.addCallback = cb
 }
 
 // SetDelCallback sets callback function which is called when item is deleted from cache
 func (t *CacheTable) SetDelCallback(cb func(key uint64, data []byte) error) {
-	t.Lock()
-	defer t.Unlock()
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
 	t.delCallback = cb
 }
 
-// SetCacheFullCallback sets callback function which is called when cache is full
+// SetThrottleCallback sets callback function which is called before every
+// write, writes fail with its error
+func (t *CacheTable) SetThrottleCallback(cb func() error) {
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
+	t.throttleCallback = cb
+}
+
+// throttle calls the throttle callback, it must be called without locks held
+func (t *CacheTable) throttle() error {
+	t.genLock.RLock()
+	cb := t.throttleCallback
+	t.genLock.RUnlock()
+	if cb == nil {
+		return nil
+	}
+	return cb()
+}
+
+// SetLogger sets where failed flushes are reported
+func (t *CacheTable) SetLogger(log Logger) {
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
+	t.log = log
+}
+
+// SetCacheFullCallback sets callback function which is called when cache is full,
+// it closes output once the keys written are sent, also when it fails
 func (t *CacheTable) SetCacheFullCallback(cb func(output chan string) error) {
-	t.Lock()
-	defer t.Unlock()
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
 	t.cacheFullCallback = cb
 }
 
@@ -222,19 +506,17 @@ func (t *CacheTable) Stop() {
 
 // SetCacheTreshold sets cache size
 func (t *CacheTable) SetCacheTreshold(size int) {
-	t.Lock()
-	defer t.Unlock()
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
 	t.threshold = size
 }
 
 func (t *CacheTable) GetCacheGeneration() uint64 {
-	t.RLock()
-	defer t.RUnlock()
-	return t.cacheGeneration
+	return t.cacheGeneration.Load()
 }
 
 func (t *CacheTable) SetMinSize(size int) {
-	t.Lock()
-	defer t.Unlock()
+	t.genLock.Lock()
+	defer t.genLock.Unlock()
 	t.minSize = size
 }
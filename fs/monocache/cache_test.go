@@ -1,9 +1,13 @@
 package monocache
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/radek-ryckowski/monofs/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -65,3 +69,169 @@ func TestAddGet(t *testing.T) {
 	}
 	cache.Stop()
 }
+
+func TestAddIfAbsent(t *testing.T) {
+	cache := NewCacheTable(1000)
+	added, err := cache.AddIfAbsent(uint64(1), []byte("data1"), 0)
+	assert.NoError(t, err)
+	assert.True(t, added)
+	added, err = cache.AddIfAbsent(uint64(1), []byte("data2"), 0)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	data, err := cache.Get(uint64(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data1"), data)
+
+	// fn decides under the shard lock, it isn't called for cached keys
+	added, err = cache.AddIfAbsentFunc(uint64(1), func() ([]byte, error) {
+		t.Error("fn called for a cached key")
+		return nil, nil
+	}, 0)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	added, err = cache.AddIfAbsentFunc(uint64(2), func() ([]byte, error) { return nil, nil }, 0)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	_, err = cache.Get(uint64(2))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	cache.Stop()
+}
+
+func TestCacheTableMaxBytes(t *testing.T) {
+	var flushed int32
+	cache := NewCacheTable(1000, WithMaxBytes(10), WithShards(1))
+	cache.SetCacheFullCallback(func(output chan string) error {
+		atomic.AddInt32(&flushed, 1)
+		close(output)
+		return nil
+	})
+	cache.Add(uint64(1), []byte("12345"), 0, WithProcessed(true))
+	cache.Add(uint64(2), []byte("12345"), 0)
+	cache.Add(uint64(3), []byte("12345"), 0, WithProcessed(true))
+	assert.Equal(t, int64(15), cache.Size())
+	cache.Get(uint64(1))
+	time.Sleep(1100 * time.Millisecond)
+	// 2 is not flushed yet and 1 was used after 3
+	assert.Equal(t, int32(1), atomic.LoadInt32(&flushed))
+	assert.Equal(t, int64(10), cache.Size())
+	_, err := cache.Get(uint64(3))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = cache.Get(uint64(2))
+	assert.NoError(t, err)
+	cache.Stop()
+}
+
+func TestCacheTableFlush(t *testing.T) {
+	cache := NewCacheTable(1000)
+	cache.SetCacheFullCallback(func(output chan string) error {
+		output <- string(utils.Uint64ToBytes(1))
+		close(output)
+		return nil
+	})
+	cache.Add(uint64(1), []byte("data1"), 0)
+	generation := cache.GetCacheGeneration()
+	cache.Flush()
+	assert.Equal(t, generation+1, cache.GetCacheGeneration())
+	assert.Eventually(t, func() bool {
+		s := cache.shard(1)
+		s.Lock()
+		defer s.Unlock()
+		return s.table[1].IsProcessed()
+	}, time.Second, 5*time.Millisecond)
+	cache.Stop()
+}
+
+func TestCacheTableFlushExcludesWriters(t *testing.T) {
+	cache := NewCacheTable(1000)
+	defer cache.Stop()
+	started, release := make(chan struct{}), make(chan struct{})
+	cache.SetCacheFullCallback(func(output chan string) error {
+		close(started)
+		<-release
+		close(output)
+		return nil
+	})
+	go cache.Flush()
+	<-started
+	added := make(chan struct{})
+	go func() {
+		cache.Add(uint64(1), []byte("data1"), 0)
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("write went through while the flush was rotating")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-added
+	s := cache.shard(1)
+	s.Lock()
+	defer s.Unlock()
+	assert.Equal(t, cache.GetCacheGeneration(), s.table[1].GetGeneration())
+}
+
+func TestCacheTableConcurrent(t *testing.T) {
+	cache := NewCacheTable(1 << 20)
+	var mu sync.Mutex
+	logged := map[uint64][]byte{}
+	cache.SetAddCallback(func(key uint64, data []byte) error {
+		mu.Lock()
+		logged[key] = data
+		mu.Unlock()
+		return nil
+	})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := uint64(i % 50)
+				cache.Add(key, []byte(fmt.Sprintf("%d-%d", w, i)), 0)
+				cache.Get(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+	// the callback of the write left in the cache ran last
+	for key := uint64(0); key < 50; key++ {
+		data, err := cache.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, logged[key], data)
+	}
+	assert.Equal(t, 50, cache.Len())
+	cache.Stop()
+}
+
+// BenchmarkCacheTableParallel reads and writes from as many goroutines as
+// FUSE serves requests with, a single shard shows the cost of one lock
+func BenchmarkCacheTableParallel(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		for _, parallelism := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("shards=%d/goroutines=%dxCPU", shards, parallelism), func(b *testing.B) {
+				cache := NewCacheTable(1<<30, WithShards(shards))
+				defer cache.Stop()
+				const keys = 1 << 16
+				data := []byte("attributes")
+				for key := uint64(0); key < keys; key++ {
+					cache.Add(key, data, 0)
+				}
+				var seed atomic.Uint64
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					key := seed.Add(7919)
+					for i := 0; pb.Next(); i++ {
+						key = (key*6364136223846793005 + 1442695040888963407) % keys
+						if i%10 == 0 {
+							cache.Add(key, data, 0)
+						} else {
+							cache.Get(key)
+						}
+					}
+				})
+			})
+		}
+	}
+}
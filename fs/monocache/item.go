@@ -3,6 +3,7 @@ package monocache
 import (
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,12 +15,13 @@ type CacheItem struct {
 	Data []byte `json:"data"`
 	// ttl is time to live for item in cache
 	Ttl time.Duration `json:"ttl"`
-	// lastAccess is time when item was last accessed
-	LastAccess time.Time `json:"lastAccess"`
+	// lastAccess is time when item was last accessed in unix nanoseconds,
+	// reads update it under the read lock so it is atomic
+	lastAccess atomic.Int64
 	// lastUpdate is time when item was last updated
 	LastUpdate time.Time `json:"lastUpdate"`
 	// accessCount is number of times item was accessed
-	AccessCount uint64 `json:"accessCount"`
+	accessCount atomic.Uint64
 	// generation is a generation of item
 	Generation uint64 `json:"generation"`
 	// tombstoned is a flag that indicates that item was deleted
@@ -39,16 +41,15 @@ func WithProcessed(processed bool) Option {
 // NewCacheItem creates new cache item
 func NewCacheItem(key uint64, data []byte, generation uint64, ttl time.Duration, opts ...Option) *CacheItem {
 	ci := &CacheItem{
-		Key:         key,
-		Data:        data,
-		Ttl:         ttl,
-		LastAccess:  time.Now(),
-		LastUpdate:  time.Now(),
-		AccessCount: 0,
-		Generation:  generation,
-		Tombstoned:  false,
-		Processed:   false,
+		Key:        key,
+		Data:       data,
+		Ttl:        ttl,
+		LastUpdate: time.Now(),
+		Generation: generation,
+		Tombstoned: false,
+		Processed:  false,
 	}
+	ci.lastAccess.Store(time.Now().UnixNano())
 	for _, opt := range opts {
 		opt(ci)
 	}
@@ -57,22 +58,33 @@ func NewCacheItem(key uint64, data []byte, generation uint64, ttl time.Duration,
 
 // key is used to identify item in cache
 func (item *CacheItem) GetKey() uint64 {
+	item.touch()
 	item.RLock()
-	item.LastAccess = time.Now()
-	item.AccessCount++
 	defer item.RUnlock()
 	return item.Key
 }
 
+// touch records an access
+func (item *CacheItem) touch() {
+	item.lastAccess.Store(time.Now().UnixNano())
+	item.accessCount.Add(1)
+}
+
 // GetData returns data stored in cache
 func (item *CacheItem) GetData() []byte {
+	item.touch()
 	item.RLock()
-	item.LastAccess = time.Now()
-	item.AccessCount++
 	defer item.RUnlock()
 	return item.Data
 }
 
+// size returns the size of item data counted against the cache budget
+func (item *CacheItem) size() int64 {
+	item.RLock()
+	defer item.RUnlock()
+	return int64(len(item.Data))
+}
+
 // GetTTL returns time to live for item in cache
 func (item *CacheItem) GetTTL() time.Duration {
 	item.RLock()
@@ -82,9 +94,7 @@ func (item *CacheItem) GetTTL() time.Duration {
 
 // GetLastAccess returns time when item was last accessed
 func (item *CacheItem) GetLastAccess() time.Time {
-	item.RLock()
-	defer item.RUnlock()
-	return item.LastAccess
+	return time.Unix(0, item.lastAccess.Load())
 }
 
 // GetLastUpdate returns time when item was last updated
@@ -96,9 +106,7 @@ func (item *CacheItem) GetLastUpdate() time.Time {
 
 // GetAccessCount returns number of times item was accessed
 func (item *CacheItem) GetAccessCount() uint64 {
-	item.RLock()
-	defer item.RUnlock()
-	return item.AccessCount
+	return item.accessCount.Load()
 }
 
 // SetData sets data for item in cache
@@ -0,0 +1,306 @@
+package monocache
+
+import (
+	"container/list"
+	"fmt"
+)
+
+const (
+	// PolicyLRU evicts the least recently used item
+	PolicyLRU = "lru"
+	// PolicyARC adaptive replacement cache, balances recently and frequently
+	// used items using the history of evicted keys
+	PolicyARC = "arc"
+	// Policy2Q keeps items seen once in a FIFO, only items accessed again are
+	// promoted to an LRU, scans don't flush frequently used items
+	Policy2Q = "2q"
+)
+
+// Policy orders cached keys for eviction. The cache calls it with its lock
+// held, implementations don't need to be safe for concurrent use.
+type Policy interface {
+	// Add is called when a key not cached yet is inserted
+	Add(key uint64)
+	// Access is called when a cached key is read or replaced
+	Access(key uint64)
+	// Remove is called when a key leaves the cache other than by Evict
+	Remove(key uint64)
+	// Evict picks the next key to evict among keys for which evictable
+	// returns true and forgets it, ok is false if there is none
+	Evict(evictable func(key uint64) bool) (key uint64, ok bool)
+	// Len returns the number of tracked cached keys
+	Len() int
+}
+
+// PolicyByName returns the constructor of a policy, an empty name returns LRU
+func PolicyByName(name string) (func() Policy, error) {
+	switch name {
+	case PolicyLRU, "":
+		return func() Policy { return NewLRU() }, nil
+	case PolicyARC:
+		return func() Policy { return NewARC() }, nil
+	case Policy2Q:
+		return func() Policy { return New2Q() }, nil
+	}
+	return nil, fmt.Errorf("unknown cache policy %q", name)
+}
+
+// NewPolicy returns a new policy by name, an empty name returns LRU
+func NewPolicy(name string) (Policy, error) {
+	newPolicy, err := PolicyByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return newPolicy(), nil
+}
+
+// keyList is a list of keys with constant time lookup, the front is the most
+// recently inserted key
+type keyList struct {
+	l     *list.List
+	elems map[uint64]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{l: list.New(), elems: make(map[uint64]*list.Element)}
+}
+
+func (k *keyList) pushFront(key uint64) {
+	if elem, ok := k.elems[key]; ok {
+		k.l.MoveToFront(elem)
+		return
+	}
+	k.elems[key] = k.l.PushFront(key)
+}
+
+func (k *keyList) moveToFront(key uint64) {
+	if elem, ok := k.elems[key]; ok {
+		k.l.MoveToFront(elem)
+	}
+}
+
+func (k *keyList) remove(key uint64) bool {
+	elem, ok := k.elems[key]
+	if !ok {
+		return false
+	}
+	k.l.Remove(elem)
+	delete(k.elems, key)
+	return true
+}
+
+// removeBack drops the oldest key and returns it
+func (k *keyList) removeBack() (uint64, bool) {
+	elem := k.l.Back()
+	if elem == nil {
+		return 0, false
+	}
+	key := elem.Value.(uint64)
+	k.l.Remove(elem)
+	delete(k.elems, key)
+	return key, true
+}
+
+// evict drops the oldest key for which evictable returns true
+func (k *keyList) evict(evictable func(key uint64) bool) (uint64, bool) {
+	for elem := k.l.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(uint64)
+		if evictable(key) {
+			k.l.Remove(elem)
+			delete(k.elems, key)
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+// trim drops oldest keys until at most n are left
+func (k *keyList) trim(n int) {
+	for k.l.Len() > n {
+		k.removeBack()
+	}
+}
+
+func (k *keyList) len() int {
+	return k.l.Len()
+}
+
+// LRU evicts the least recently used key
+type LRU struct {
+	keys *keyList
+}
+
+// NewLRU creates new LRU policy
+func NewLRU() *LRU {
+	return &LRU{keys: newKeyList()}
+}
+
+func (p *LRU) Add(key uint64) {
+	p.keys.pushFront(key)
+}
+
+func (p *LRU) Access(key uint64) {
+	p.keys.moveToFront(key)
+}
+
+func (p *LRU) Remove(key uint64) {
+	p.keys.remove(key)
+}
+
+func (p *LRU) Evict(evictable func(key uint64) bool) (uint64, bool) {
+	return p.keys.evict(evictable)
+}
+
+func (p *LRU) Len() int {
+	return p.keys.len()
+}
+
+// ARC adaptive replacement cache. T1 holds keys seen once and T2 keys seen
+// more than once, B1 and B2 remember keys recently evicted from them. A hit
+// in B1 or B2 moves the target size of T1 towards the list which would have
+// kept the key. The cache size is not fixed, so the number of cached keys
+// bounds the history.
+type ARC struct {
+	t1, t2, b1, b2 *keyList
+	// p target size of t1
+	p int
+}
+
+// NewARC creates new ARC policy
+func NewARC() *ARC {
+	return &ARC{t1: newKeyList(), t2: newKeyList(), b1: newKeyList(), b2: newKeyList()}
+}
+
+func (p *ARC) Add(key uint64) {
+	c := p.Len() + 1
+	switch {
+	case p.b1.remove(key):
+		p.p = minInt(p.p+maxInt(p.b2.len()/maxInt(p.b1.len(), 1), 1), c)
+		p.t2.pushFront(key)
+	case p.b2.remove(key):
+		p.p = maxInt(p.p-maxInt(p.b1.len()/maxInt(p.b2.len(), 1), 1), 0)
+		p.t2.pushFront(key)
+	default:
+		p.t1.pushFront(key)
+	}
+	p.trimHistory()
+}
+
+func (p *ARC) Access(key uint64) {
+	if p.t1.remove(key) {
+		p.t2.pushFront(key)
+		return
+	}
+	p.t2.moveToFront(key)
+}
+
+func (p *ARC) Remove(key uint64) {
+	if !p.t1.remove(key) {
+		p.t2.remove(key)
+	}
+}
+
+func (p *ARC) Evict(evictable func(key uint64) bool) (uint64, bool) {
+	first, second, firstGhost, secondGhost := p.t1, p.t2, p.b1, p.b2
+	if p.t1.len() == 0 || p.t1.len() <= p.p {
+		first, second, firstGhost, secondGhost = p.t2, p.t1, p.b2, p.b1
+	}
+	if key, ok := first.evict(evictable); ok {
+		firstGhost.pushFront(key)
+		p.trimHistory()
+		return key, true
+	}
+	if key, ok := second.evict(evictable); ok {
+		secondGhost.pushFront(key)
+		p.trimHistory()
+		return key, true
+	}
+	return 0, false
+}
+
+func (p *ARC) Len() int {
+	return p.t1.len() + p.t2.len()
+}
+
+// trimHistory keeps each history list within the number of cached keys
+func (p *ARC) trimHistory() {
+	c := maxInt(p.Len(), 1)
+	p.b1.trim(c)
+	p.b2.trim(c)
+	if p.p > c {
+		p.p = c
+	}
+}
+
+// TwoQ the 2Q policy. New keys enter a FIFO (A1in), keys evicted from it are
+// remembered (A1out) and only keys added again while remembered enter the LRU
+// (Am). Accesses of keys in the FIFO don't change their position.
+type TwoQ struct {
+	in, out, main *keyList
+}
+
+// twoQInShare the part of cached keys the FIFO may hold before it is
+// preferred for eviction, twoQOutShare the part remembered after eviction
+const (
+	twoQInShare  = 0.25
+	twoQOutShare = 0.5
+)
+
+// New2Q creates new 2Q policy
+func New2Q() *TwoQ {
+	return &TwoQ{in: newKeyList(), out: newKeyList(), main: newKeyList()}
+}
+
+func (p *TwoQ) Add(key uint64) {
+	if p.out.remove(key) {
+		p.main.pushFront(key)
+		return
+	}
+	p.in.pushFront(key)
+}
+
+func (p *TwoQ) Access(key uint64) {
+	p.main.moveToFront(key)
+}
+
+func (p *TwoQ) Remove(key uint64) {
+	if !p.in.remove(key) {
+		p.main.remove(key)
+	}
+}
+
+func (p *TwoQ) Evict(evictable func(key uint64) bool) (uint64, bool) {
+	if float64(p.in.len()) > twoQInShare*float64(p.Len()) || p.main.len() == 0 {
+		if key, ok := p.in.evict(evictable); ok {
+			p.out.pushFront(key)
+			p.out.trim(maxInt(int(twoQOutShare*float64(p.Len())), 1))
+			return key, true
+		}
+	}
+	if key, ok := p.main.evict(evictable); ok {
+		return key, true
+	}
+	if key, ok := p.in.evict(evictable); ok {
+		p.out.pushFront(key)
+		return key, true
+	}
+	return 0, false
+}
+
+func (p *TwoQ) Len() int {
+	return p.in.len() + p.main.len()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package monocache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func all(uint64) bool { return true }
+
+func evictAll(p Policy) []uint64 {
+	keys := []uint64{}
+	for {
+		key, ok := p.Evict(all)
+		if !ok {
+			return keys
+		}
+		keys = append(keys, key)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	p := NewLRU()
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key)
+	}
+	p.Access(1)
+	p.Remove(3)
+	assert.Equal(t, 3, p.Len())
+	assert.Equal(t, []uint64{2, 4, 1}, evictAll(p))
+}
+
+func TestPolicySkipsUnevictable(t *testing.T) {
+	for _, name := range []string{PolicyLRU, PolicyARC, Policy2Q} {
+		p, err := NewPolicy(name)
+		assert.NoError(t, err)
+		p.Add(1)
+		p.Add(2)
+		key, ok := p.Evict(func(key uint64) bool { return key != 1 })
+		assert.True(t, ok, name)
+		assert.Equal(t, uint64(2), key, name)
+		_, ok = p.Evict(func(key uint64) bool { return key != 1 })
+		assert.False(t, ok, name)
+		assert.Equal(t, 1, p.Len(), name)
+	}
+	_, err := NewPolicy("mru")
+	assert.Error(t, err)
+}
+
+func TestARC(t *testing.T) {
+	p := NewARC()
+	// 1 and 2 are used twice, 3..6 once
+	for key := uint64(1); key <= 6; key++ {
+		p.Add(key)
+	}
+	p.Access(1)
+	p.Access(2)
+	// keys seen once go first
+	key, _ := p.Evict(all)
+	assert.Equal(t, uint64(3), key)
+	// adding an evicted key again makes it frequent and grows the recent
+	// list target
+	p.Add(3)
+	assert.Equal(t, 1, p.p)
+	assert.True(t, p.t2.elems[3] != nil)
+	// once the recent list is down to its target frequent keys go
+	assert.Equal(t, []uint64{4, 5, 1, 2, 3, 6}, evictAll(p))
+}
+
+func Test2Q(t *testing.T) {
+	p := New2Q()
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key)
+	}
+	// accesses don't promote keys out of the FIFO
+	p.Access(1)
+	key, _ := p.Evict(all)
+	assert.Equal(t, uint64(1), key)
+	// a remembered key goes to the LRU and survives a scan
+	p.Add(1)
+	for key := uint64(10); key < 20; key++ {
+		p.Add(key)
+	}
+	evicted := []uint64{}
+	for i := 0; i < 13; i++ {
+		key, _ := p.Evict(all)
+		evicted = append(evicted, key)
+	}
+	assert.NotContains(t, evicted, uint64(1))
+	assert.Equal(t, 1, p.Len())
+}
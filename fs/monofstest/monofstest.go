@@ -0,0 +1,252 @@
+// Package monofstest builds a Monofs keeping all of its state in memory and
+// wired to fake stat and proxy servers, for hermetic tests of filesystem
+// behaviour
+package monofstest
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	monofs "github.com/radek-ryckowski/monofs/fs"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	monostat "github.com/radek-ryckowski/monofs/monoclient/stat"
+	pb "github.com/radek-ryckowski/monofs/proto"
+)
+
+// DefaultBlocks blocks reported by a new FakeStatServer
+const DefaultBlocks = 1024 * 1024
+
+// FakeStatServer answers Stat with configurable block counts
+type FakeStatServer struct {
+	pb.UnimplementedMonofsStatServer
+	mu              sync.Mutex
+	blocks          uint64
+	blocksFree      uint64
+	blocksAvailable uint64
+}
+
+// NewFakeStatServer returns a server reporting blocks, all of them free
+func NewFakeStatServer(blocks uint64) *FakeStatServer {
+	return &FakeStatServer{blocks: blocks, blocksFree: blocks, blocksAvailable: blocks}
+}
+
+// SetBlocks changes the block counts reported from now on
+func (f *FakeStatServer) SetBlocks(blocks, free, available uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocks, f.blocksFree, f.blocksAvailable = blocks, free, available
+}
+
+func (f *FakeStatServer) Stat(ctx context.Context, in *pb.StatRequest) (*pb.StatResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.StatResponse{
+		Id:              in.Fs,
+		BlockSize:       4096,
+		Blocks:          f.blocks,
+		BlocksFree:      f.blocksFree,
+		BlocksAvailable: f.blocksAvailable,
+	}, nil
+}
+
+// FakeProxyServer lists files added to its buckets
+type FakeProxyServer struct {
+	pb.UnimplementedMonofsProxyServer
+	mu      sync.Mutex
+	buckets map[string][]*pb.File
+}
+
+// NewFakeProxyServer returns a proxy with no buckets
+func NewFakeProxyServer() *FakeProxyServer {
+	return &FakeProxyServer{buckets: make(map[string][]*pb.File)}
+}
+
+// AddFile adds file to its bucket
+func (f *FakeProxyServer) AddFile(file *pb.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buckets[file.Bucket] = append(f.buckets[file.Bucket], file)
+}
+
+func (f *FakeProxyServer) List(in *pb.ListRequest, stream pb.MonofsProxy_ListServer) error {
+	f.mu.Lock()
+	files := append([]*pb.File{}, f.buckets[in.Bucket]...)
+	f.mu.Unlock()
+	return stream.Send(&pb.ListResponse{Files: files})
+}
+
+// Options of a harness
+type Options struct {
+	// Name of the filesystem, "test" when empty
+	Name string
+	// Config is called on the configuration before the filesystem is built
+	Config func(cfg *config.Config)
+}
+
+// Harness is an in-memory Monofs with its fake servers
+type Harness struct {
+	FS     *monofs.Monofs
+	Server fuse.Server
+	Stat   *FakeStatServer
+	Proxy  *FakeProxyServer
+	// ProxyClient is connected to Proxy
+	ProxyClient pb.MonofsProxyClient
+	// Dir is the mountpoint after Mount
+	Dir string
+
+	t    *testing.T
+	grpc *grpc.Server
+	conn *grpc.ClientConn
+	mfs  *fuse.MountedFileSystem
+}
+
+// New builds a harness torn down when the test ends
+func New(t *testing.T, opts *Options) *Harness {
+	t.Helper()
+	if opts == nil {
+		opts = &Options{}
+	}
+	name := opts.Name
+	if name == "" {
+		name = "test"
+	}
+	h := &Harness{
+		Stat:  NewFakeStatServer(DefaultBlocks),
+		Proxy: NewFakeProxyServer(),
+		t:     t,
+		grpc:  grpc.NewServer(),
+	}
+	lis := bufconn.Listen(1024 * 1024)
+	pb.RegisterMonofsStatServer(h.grpc, h.Stat)
+	pb.RegisterMonofsProxyServer(h.grpc, h.Proxy)
+	go h.grpc.Serve(lis)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		h.grpc.Stop()
+		t.Fatalf("dial fake servers: %v", err)
+	}
+	h.conn = conn
+	h.ProxyClient = pb.NewMonofsProxyClient(conn)
+	t.Cleanup(h.close)
+
+	// the path only holds the last inode lock and snapshot copies
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Path:           dir,
+		LocalDataPath:  dir,
+		FilesystemName: name,
+		StatClient:     monostat.New(conn),
+		InMemory:       true,
+
+		DentryCacheSize:        fsdb.DefaultDentryCacheSize,
+		DentryCacheTTL:         fsdb.DefaultDentryCacheTTL,
+		NegativeDentryCacheTTL: fsdb.DefaultNegativeDentryCacheTTL,
+	}
+	if opts.Config != nil {
+		opts.Config(cfg)
+	}
+	h.FS, err = monofs.NewMonoFS(cfg, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewMonoFS: %v", err)
+	}
+	h.Server, err = monofs.NewMonoFuseFS(h.FS)
+	if err != nil {
+		h.FS.Destroy()
+		h.FS = nil
+		t.Fatalf("NewMonoFuseFS: %v", err)
+	}
+	return h
+}
+
+// MountEnv has to be set for Mount to mount, some sandboxes have /dev/fuse
+// but hang on mount
+const MountEnv = "MONOFS_TEST_MOUNT"
+
+// Mount mounts the filesystem in a temporary directory, the test is skipped
+// when FUSE is not available or MountEnv is not set
+func (h *Harness) Mount() string {
+	h.t.Helper()
+	if os.Getenv(MountEnv) == "" {
+		h.t.Skipf("%s not set", MountEnv)
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		h.t.Skipf("FUSE not available: %v", err)
+	}
+	dir := h.t.TempDir()
+	mfs, err := fuse.Mount(dir, h.Server, &fuse.MountConfig{FSName: h.FS.Name})
+	if err != nil {
+		h.t.Skipf("mount: %v", err)
+	}
+	h.mfs, h.Dir = mfs, dir
+	return dir
+}
+
+// MkDir creates directory name in parent and returns its inode
+func (h *Harness) MkDir(parent fuseops.InodeID, name string) fuseops.InodeID {
+	h.t.Helper()
+	op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: os.ModeDir | 0755}
+	if err := h.FS.MkDir(context.Background(), op); err != nil {
+		h.t.Fatalf("MkDir %s: %v", name, err)
+	}
+	return op.Entry.Child
+}
+
+// CreateFile creates file name in parent with data and returns its inode
+func (h *Harness) CreateFile(parent fuseops.InodeID, name string, data []byte) fuseops.InodeID {
+	h.t.Helper()
+	ctx := context.Background()
+	op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: 0644}
+	if err := h.FS.CreateFile(ctx, op); err != nil {
+		h.t.Fatalf("CreateFile %s: %v", name, err)
+	}
+	if len(data) > 0 {
+		err := h.FS.WriteFile(ctx, &fuseops.WriteFileOp{Inode: op.Entry.Child, Handle: op.Handle, Data: data})
+		if err != nil {
+			h.t.Fatalf("WriteFile %s: %v", name, err)
+		}
+	}
+	if err := h.FS.FlushFile(ctx, &fuseops.FlushFileOp{Inode: op.Entry.Child, Handle: op.Handle}); err != nil {
+		h.t.Fatalf("FlushFile %s: %v", name, err)
+	}
+	if err := h.FS.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: op.Handle}); err != nil {
+		h.t.Fatalf("ReleaseFileHandle %s: %v", name, err)
+	}
+	return op.Entry.Child
+}
+
+// LookUp returns the entry of name in parent
+func (h *Harness) LookUp(parent fuseops.InodeID, name string) (fuseops.ChildInodeEntry, error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err := h.FS.LookUpInode(context.Background(), op)
+	return op.Entry, err
+}
+
+func (h *Harness) close() {
+	if h.mfs != nil {
+		if err := fuse.Unmount(h.Dir); err != nil {
+			h.t.Errorf("unmount: %v", err)
+		}
+		h.mfs.Join(context.Background())
+	}
+	if h.FS != nil && h.mfs == nil {
+		// a mounted filesystem is destroyed by the server on unmount
+		h.FS.Destroy()
+	}
+	h.conn.Close()
+	h.grpc.Stop()
+}
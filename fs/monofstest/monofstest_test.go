@@ -0,0 +1,71 @@
+package monofstest
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+
+	pb "github.com/radek-ryckowski/monofs/proto"
+)
+
+func TestHarnessOps(t *testing.T) {
+	h := New(t, nil)
+	ctx := context.Background()
+
+	dir := h.MkDir(fuseops.RootInodeID, "dir")
+	file := h.CreateFile(dir, "file", []byte("hello"))
+	entry, err := h.LookUp(dir, "file")
+	assert.NoError(t, err)
+	assert.Equal(t, file, entry.Child)
+	_, err = h.LookUp(fuseops.RootInodeID, "missing")
+	assert.Error(t, err)
+
+	open := &fuseops.OpenFileOp{Inode: file}
+	assert.NoError(t, h.FS.OpenFile(ctx, open))
+	assert.NoError(t, h.FS.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}))
+
+	h.Stat.SetBlocks(100, 50, 40)
+	statfs := &fuseops.StatFSOp{}
+	assert.NoError(t, h.FS.StatFS(ctx, statfs))
+	assert.Equal(t, uint64(100), statfs.Blocks)
+	assert.Equal(t, uint64(40), statfs.BlocksAvailable)
+}
+
+func TestHarnessIsolated(t *testing.T) {
+	a := New(t, nil)
+	b := New(t, nil)
+	a.MkDir(fuseops.RootInodeID, "only_a")
+	_, err := b.LookUp(fuseops.RootInodeID, "only_a")
+	assert.Error(t, err)
+}
+
+func TestFakeProxy(t *testing.T) {
+	h := New(t, nil)
+	h.Proxy.AddFile(&pb.File{Bucket: "b", Name: "x", Size: 3})
+	stream, err := h.ProxyClient.List(context.Background(), &pb.ListRequest{Fs: "test", Bucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Len(t, resp.Files, 1)
+	assert.Equal(t, "x", resp.Files[0].Name)
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHarnessMount(t *testing.T) {
+	h := New(t, nil)
+	dir := h.Mount()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "d"), 0755))
+	fi, err := os.Stat(filepath.Join(dir, "d"))
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	_, err = h.LookUp(fuseops.RootInodeID, "d")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,101 @@
+package monofs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+)
+
+// orphaned Record that inode lost its last name, it is reclaimed right away
+// unless the kernel still holds lookups or open handles of it.
+func (fs *Monofs) orphaned(inode fuseops.InodeID) {
+	if !fs.refs.Unlinked(inode) {
+		return
+	}
+	if err := fs.reclaimInode(inode); err != nil {
+		fs.log.Errorf("reclaimInode(%d): %v", inode, err)
+	}
+}
+
+// released Reclaim inode if the kernel dropped the last reference of an orphan.
+func (fs *Monofs) released(inode fuseops.InodeID, reclaim bool) {
+	if !reclaim {
+		return
+	}
+	if err := fs.reclaimInode(inode); err != nil {
+		fs.log.Errorf("reclaimInode(%d): %v", inode, err)
+	}
+}
+
+// reclaimInode Remove attributes, data and orphan record of an inode which
+// has no names and no kernel references left.
+func (fs *Monofs) reclaimInode(inode fuseops.InodeID) error {
+	// data of a snapshot belongs to the head
+	if fs.readOnly {
+		return nil
+	}
+	fs.fsHashLock.Lock(inode)
+	defer fs.fsHashLock.Unlock(inode)
+	fs.atime.Forget(inode)
+	attrs, err := fs.metadb.GetFsdbInodeAttributes(uint64(inode))
+	if err != nil && !errors.Is(err, fsdb.ErrNoSuchInode) {
+		return err
+	}
+	found := err == nil
+	txn := fs.metadb.NewTxn()
+	txn.DeleteOrphan(uint64(inode))
+	if found && attrs.Nlink == 0 {
+		txn.DeleteAttrs(uint64(inode))
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	if found && attrs.Nlink == 0 && fsdb.InodeDirentType(attrs.Mode) == fuseutil.DT_File {
+		return fs.removeData(attrs.Hash)
+	}
+	return nil
+}
+
+// removeData Delete the data file of a reclaimed inode. Files created before
+// the current sync snapshot can be referenced by snapshot copies, those are
+// left for the garbage collector.
+func (fs *Monofs) removeData(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	current, err := fs.metadb.Snapshot.CurrentHash()
+	if err != nil {
+		return err
+	}
+	if current == "" || !strings.HasSuffix(hash, "."+current) {
+		return nil
+	}
+	err = os.Remove(filepath.Join(fs.localDataPath, hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// reclaimOrphans Reclaim inodes left open-but-unlinked by a previous run,
+// no kernel reference survives a restart.
+func (fs *Monofs) reclaimOrphans() error {
+	orphans, err := fs.metadb.GetOrphans()
+	if err != nil {
+		return err
+	}
+	for _, id := range orphans {
+		if err := fs.reclaimInode(fuseops.InodeID(id)); err != nil {
+			return err
+		}
+	}
+	if len(orphans) > 0 {
+		fs.log.Infof("Reclaimed %d orphaned inodes", len(orphans))
+	}
+	return nil
+}
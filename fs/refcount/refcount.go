@@ -0,0 +1,113 @@
+package refcount
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type counts struct {
+	lookups uint64
+	opens   uint64
+	// orphan is set once the inode lost its last name
+	orphan bool
+}
+
+// Table keeps kernel lookup counts and open handle counts of inodes. An
+// unlinked inode can't be reclaimed while the kernel still references it,
+// Table tells the caller the moment the last reference is gone. Inodes
+// without any reference have no entry.
+type Table struct {
+	mu     sync.Mutex
+	inodes map[fuseops.InodeID]*counts
+}
+
+// New creates an empty table
+func New() *Table {
+	return &Table{
+		inodes: make(map[fuseops.InodeID]*counts),
+	}
+}
+
+func (t *Table) get(inode fuseops.InodeID) *counts {
+	c, ok := t.inodes[inode]
+	if !ok {
+		c = &counts{}
+		t.inodes[inode] = c
+	}
+	return c
+}
+
+// release drops the entry once it has no references, returns true if the
+// inode is an orphan which has to be reclaimed. Must be called with lock held
+func (t *Table) release(inode fuseops.InodeID, c *counts) bool {
+	if c.lookups > 0 || c.opens > 0 {
+		return false
+	}
+	delete(t.inodes, inode)
+	return c.orphan
+}
+
+// Lookup records an entry returned to the kernel
+func (t *Table) Lookup(inode fuseops.InodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(inode).lookups++
+}
+
+// Forget drops n lookups, returns true if the inode has to be reclaimed now
+func (t *Table) Forget(inode fuseops.InodeID, n uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.inodes[inode]
+	if !ok {
+		return false
+	}
+	if n > c.lookups {
+		n = c.lookups
+	}
+	c.lookups -= n
+	return t.release(inode, c)
+}
+
+// Open records a new file handle
+func (t *Table) Open(inode fuseops.InodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(inode).opens++
+}
+
+// Release drops a file handle, returns true if the inode has to be reclaimed now
+func (t *Table) Release(inode fuseops.InodeID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.inodes[inode]
+	if !ok {
+		return false
+	}
+	if c.opens > 0 {
+		c.opens--
+	}
+	return t.release(inode, c)
+}
+
+// Unlinked marks inode as orphan after its last name was removed, returns
+// true if nothing references it and it has to be reclaimed now
+func (t *Table) Unlinked(inode fuseops.InodeID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.inodes[inode]
+	if !ok {
+		return true
+	}
+	c.orphan = true
+	return false
+}
+
+// Busy returns true if the kernel references inode
+func (t *Table) Busy(inode fuseops.InodeID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.inodes[inode]
+	return ok
+}
@@ -0,0 +1,32 @@
+package refcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnlinkedWhileOpen(t *testing.T) {
+	tbl := New()
+	tbl.Lookup(10)
+	tbl.Open(10)
+	assert.False(t, tbl.Unlinked(10))
+	// kernel drops the dentry, the handle is still open
+	assert.False(t, tbl.Forget(10, 1))
+	assert.True(t, tbl.Busy(10))
+	assert.True(t, tbl.Release(10))
+	assert.False(t, tbl.Busy(10))
+}
+
+func TestUnlinkedWithoutReferences(t *testing.T) {
+	tbl := New()
+	assert.True(t, tbl.Unlinked(10))
+	// linked inodes are never reclaimed
+	tbl.Lookup(11)
+	tbl.Lookup(11)
+	assert.False(t, tbl.Forget(11, 1))
+	assert.False(t, tbl.Forget(11, 1))
+	assert.False(t, tbl.Busy(11))
+	// forgets of unknown inodes are ignored
+	assert.False(t, tbl.Forget(12, 5))
+}
@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+// CheckpointKey holds the sequence number of the last entry written to the
+// WAL database, it is written in the same batch as the entries. Iterations of
+// the database have to skip it.
+var CheckpointKey = []byte("wal/checkpoint")
+
+// ReadCheckpoint returns the checkpoint stored in db, zero if there is none.
+// Snapshots of the WAL database carry the checkpoint they were dumped up to.
+func ReadCheckpoint(db metastore.Reader) (uint64, error) {
+	v, err := db.Get(CheckpointKey)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("malformed WAL checkpoint %x", v)
+	}
+	return utils.BytesToUint64(v), nil
+}
+
+// Checkpoint returns the sequence number up to which entries are written to
+// the WAL database
+func (w *WAL) Checkpoint() (uint64, error) {
+	return ReadCheckpoint(w.db)
+}
+
+// applied reports whether entry is already written to the stores, entries of
+// files without sequence numbers never are
+func applied(entry *Entry, checkpoint uint64) bool {
+	return entry.LSN != 0 && entry.LSN <= checkpoint
+}
+
+// dump is a WAL file being written to the database. Dumps run in the order of
+// files, so the checkpoint only moves forward.
+type dump struct {
+	// prev is the dump of the file rotated before
+	prev *dump
+	done chan struct{}
+	err  error
+}
+
+// finish records the result of the dump, a dump only fails once the WAL is
+// closed as the checkpoint would skip the entries left behind
+func (d *dump) finish(err error) {
+	d.err = err
+	d.prev = nil
+	close(d.done)
+}
+
+// result waits for the dump and returns its error
+func (d *dump) result() error {
+	if d == nil {
+		return nil
+	}
+	<-d.done
+	if d.err != nil {
+		return fmt.Errorf("previous WAL dump failed: %w", d.err)
+	}
+	return nil
+}
+
+// ScanPending calls fn for entries of WAL files in dir of fsys not written to
+// db yet. Nothing is changed, files are scanned up to their first damaged
+// entry.
+func ScanPending(fsys FS, dir string, db metastore.Reader, fn func(entry *Entry) error) error {
+	checkpoint, err := ReadCheckpoint(db)
+	if err != nil {
+		return err
+	}
+	files, err := ListFiles(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		_, err := scanEntries(fsys, name, func(entry *Entry) error {
+			if applied(entry, checkpoint) {
+				return nil
+			}
+			return fn(entry)
+		})
+		if err != nil && !errors.Is(err, ErrTorn) && !errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -2,44 +2,290 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"strings"
 )
 
-// Decoder is a decoder for WAL retrieves data from WAL and convert them to Entry
+var (
+	// ErrTorn is returned for an incomplete last record, left by a write
+	// interrupted by a crash. Records before it are intact.
+	ErrTorn = errors.New("torn WAL record")
+	// ErrCorrupt is returned for a damaged record followed by more data
+	ErrCorrupt = errors.New("corrupt WAL record")
+)
+
+// Decoder is a decoder for WAL retrieves data from WAL and convert them to Entry.
+// It reads binary WAL files as well as the legacy text format.
 type Decoder struct {
-	reader   *bufio.Reader
+	reader *bufio.Reader
+	// position number of the last decoded record
 	position int64
+	// offset size of the file up to the end of the last decoded record
+	offset int64
+	// format is detected on the first Decode
+	detected bool
+	legacy   bool
+	version  byte
+	// pending entries of a batch record not returned yet
+	pending []Entry
 }
 
 // NewDecoder creates new decoder for WAL
-func NewDecoder(file *os.File) *Decoder {
+func NewDecoder(file io.Reader) *Decoder {
 	return &Decoder{
 		reader:   bufio.NewReader(file),
 		position: 0,
 	}
 }
 
-// Decode decodes entry from WAL
+// Decode decodes entry from WAL. It returns io.EOF at the end of the file,
+// ErrTorn when the file ends within a record and ErrCorrupt when a damaged
+// record is followed by more data. Entries of a batch record are returned one
+// by one, only once the whole record was read.
 func (d *Decoder) Decode(e *Entry) error {
-	// reads line from file
+	if len(d.pending) > 0 {
+		*e = d.pending[0]
+		d.pending = d.pending[1:]
+		return nil
+	}
+	if !d.detected {
+		if err := d.detect(); err != nil {
+			return err
+		}
+	}
+	if d.legacy {
+		return d.decodeLine(e)
+	}
+	return d.decodeRecord(e)
+}
+
+// Offset returns the size of the decoded part of the file, a torn tail has to
+// be truncated to it before appending
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// detect reads the file header, files starting with anything else than the
+// magic are in the legacy text format
+func (d *Decoder) detect() error {
+	first, err := d.reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	if first[0] != walMagic[0] {
+		d.detected, d.legacy = true, true
+		return nil
+	}
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(d.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: incomplete file header", ErrTorn)
+		}
+		return err
+	}
+	if string(header[:len(walMagic)]) != walMagic {
+		return fmt.Errorf("%w: bad file header", ErrCorrupt)
+	}
+	d.version = header[len(walMagic)]
+	if d.version == 0 || d.version > walVersion {
+		return fmt.Errorf("unsupported WAL version %d", d.version)
+	}
+	d.detected = true
+	d.offset = int64(walHeaderSize)
+	return nil
+}
+
+// decodeRecord decodes a single framed record
+func (d *Decoder) decodeRecord(e *Entry) error {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(d.reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return d.torn("incomplete record header")
+		}
+		return err
+	}
+	length := binary.LittleEndian.Uint32(header[:4])
+	sum := binary.LittleEndian.Uint32(header[4:])
+	if length > maxRecordSize {
+		return d.damaged(fmt.Sprintf("record length %d", length))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return d.torn("incomplete record")
+		}
+		return err
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return d.damaged("checksum mismatch")
+	}
+	lsn := uint64(0)
+	if d.version >= 2 {
+		var n int
+		if lsn, n = binary.Uvarint(payload); n <= 0 {
+			return d.damaged("bad sequence number")
+		}
+		payload = payload[n:]
+	}
+	if len(payload) > 0 && payload[0]&flagBatch != 0 {
+		entries, err := decodeBatch(payload)
+		if err != nil {
+			return d.damaged(err.Error())
+		}
+		if len(entries) == 0 {
+			return d.damaged("empty batch")
+		}
+		for i := range entries {
+			entries[i].LSN = lsn
+		}
+		*e, d.pending = entries[0], entries[1:]
+	} else if err := decodePayload(payload, e); err != nil {
+		return d.damaged(err.Error())
+	} else {
+		e.LSN = lsn
+	}
+	d.position++
+	d.offset += int64(recordHeaderSize) + int64(length)
+	return nil
+}
+
+// decodePayload decodes the payload of a record, key and value share its memory
+func decodePayload(payload []byte, e *Entry) error {
+	if len(payload) < 2 {
+		return fmt.Errorf("payload too short")
+	}
+	flags := payload[0]
+	keyLen, n := binary.Uvarint(payload[1:])
+	if n <= 0 || keyLen > uint64(len(payload)-1-n) {
+		return fmt.Errorf("bad key length")
+	}
+	key := payload[1+n:]
+	e.Key = key[:keyLen:keyLen]
+	e.Value = key[keyLen:]
+	e.Tombstoned = flags&flagTombstone != 0
+	e.Dentry = flags&flagDentry != 0
+	return nil
+}
+
+// decodeBatch decodes the payload of a batch record
+func decodeBatch(payload []byte) ([]Entry, error) {
+	count, n := binary.Uvarint(payload[1:])
+	// every entry takes at least three bytes
+	if n <= 0 || count > uint64(len(payload))/3 {
+		return nil, fmt.Errorf("bad batch size")
+	}
+	buf := payload[1+n:]
+	entries := make([]Entry, count)
+	for i := range entries {
+		if len(buf) == 0 {
+			return nil, fmt.Errorf("batch entry %d missing", i)
+		}
+		flags := buf[0]
+		key, rest, err := decodeBytes(buf[1:])
+		if err != nil {
+			return nil, fmt.Errorf("batch entry %d key: %v", i, err)
+		}
+		value, rest, err := decodeBytes(rest)
+		if err != nil {
+			return nil, fmt.Errorf("batch entry %d value: %v", i, err)
+		}
+		entries[i] = Entry{
+			Key:        key,
+			Value:      value,
+			Tombstoned: flags&flagTombstone != 0,
+			Dentry:     flags&flagDentry != 0,
+		}
+		buf = rest
+	}
+	if len(buf) != 0 {
+		return nil, fmt.Errorf("%d bytes after batch entries", len(buf))
+	}
+	return entries, nil
+}
+
+// decodeBytes decodes a length prefixed byte slice and returns the rest of buf
+func decodeBytes(buf []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || l > uint64(len(buf)-n) {
+		return nil, nil, fmt.Errorf("bad length")
+	}
+	end := n + int(l)
+	return buf[n:end:end], buf[end:], nil
+}
+
+// torn reports an incomplete last record
+func (d *Decoder) torn(reason string) error {
+	return fmt.Errorf("%w %d at byte %d: %s", ErrTorn, d.position+1, d.offset, reason)
+}
+
+// damaged reports a record which can't be decoded. It is a torn tail if
+// nothing but zeros follows it, file systems may extend a file before its
+// data reaches the disk.
+func (d *Decoder) damaged(reason string) error {
+	zeros, err := onlyZeros(d.reader)
+	if err != nil {
+		return err
+	}
+	if zeros {
+		return d.torn(reason)
+	}
+	return fmt.Errorf("%w %d at byte %d: %s", ErrCorrupt, d.position+1, d.offset, reason)
+}
+
+func onlyZeros(r io.Reader) (bool, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// decodeLine decodes a single line of the legacy text format
+func (d *Decoder) decodeLine(e *Entry) error {
 	l, err := d.reader.ReadString('\n')
+	if err == io.EOF && len(l) > 0 {
+		return d.torn("incomplete line")
+	}
 	if err != nil {
 		return err
 	}
-	d.position += 1
+	if err := decodeLine(l, d.position+1, e); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	d.position++
+	d.offset += int64(len(l))
+	return nil
+}
+
+// decodeLine decodes a single WAL line
+func decodeLine(l string, position int64, e *Entry) error {
 	rline := strings.Split(strings.TrimRight(l, "\n"), "#")
 	if len(rline) == 3 {
 		// decodes line to entry
 		decKey, err := base64.StdEncoding.DecodeString(rline[0])
 		if err != nil {
-			return fmt.Errorf("unable decode Entry key in line %d: %w", d.position, err)
+			return fmt.Errorf("unable decode Entry key in line %d: %w", position, err)
 		}
 		decValue, err := base64.StdEncoding.DecodeString(rline[1])
 		if err != nil {
-			return fmt.Errorf("unable decode Entry value in line %d: %w", d.position, err)
+			return fmt.Errorf("unable decode Entry value in line %d: %w", position, err)
 		}
 		decTombstone := false
 		if rline[2] == "1" {
@@ -50,5 +296,62 @@ func (d *Decoder) Decode(e *Entry) error {
 		e.Tombstoned = decTombstone
 		return nil
 	}
-	return fmt.Errorf("error while decoding WAL file entry %d", d.position)
+	return fmt.Errorf("error while decoding WAL file entry %d", position)
+}
+
+// isLegacy reports whether a WAL file is in the legacy text format, empty
+// files are not
+func isLegacy(fsys FS, fileName string) (bool, error) {
+	f, err := fsys.OpenFile(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(f, first); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return !bytes.Equal(first, []byte(walMagic[:1])), nil
+}
+
+// ScanFile decodes entries of a WAL file on disk up to the first damaged one.
+// It returns the entries, size of the undamaged part of the file and the
+// decoding error, an incomplete last record counts as damaged.
+func ScanFile(fileName string) ([]Entry, int64, error) {
+	return scanFile(OS, fileName)
+}
+
+func scanFile(fsys FS, fileName string) ([]Entry, int64, error) {
+	entries := []Entry{}
+	offset, err := scanEntries(fsys, fileName, func(entry *Entry) error {
+		entries = append(entries, *entry)
+		return nil
+	})
+	return entries, offset, err
+}
+
+// scanEntries calls fn for entries of a WAL file up to the first damaged one
+// without keeping them, it returns like ScanFile
+func scanEntries(fsys FS, fileName string, fn func(entry *Entry) error) (int64, error) {
+	f, err := fsys.OpenFile(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	decoder := NewDecoder(f)
+	for {
+		var entry Entry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return decoder.Offset(), err
+		}
+		if err := fn(&entry); err != nil {
+			return decoder.Offset(), err
+		}
+	}
 }
@@ -2,33 +2,163 @@ package wal
 
 import (
 	"encoding/base64"
-	"os"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 )
 
-// Encoder is a encoder for WAL stores data in WAL
+const (
+	// walMagic starts every binary WAL file, its first byte can't start a
+	// line of the legacy text format
+	walMagic = "\x89MWL"
+	// walVersion is the version of the binary format following the magic,
+	// records of version 1 have no sequence numbers
+	walVersion = 2
+	// walHeaderSize is the size of the file header
+	walHeaderSize = len(walMagic) + 1
+	// recordHeaderSize is the size of payload length and checksum preceding
+	// every record
+	recordHeaderSize = 8
+	// maxRecordSize larger records are never written, a larger length means
+	// the record header is damaged
+	maxRecordSize = 64 << 20
+	// flagTombstone marks a deleted key in the record flags
+	flagTombstone = 1
+	// flagBatch marks a record holding several entries applied together
+	flagBatch = 2
+	// flagDentry marks an entry of the inode store
+	flagDentry = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
+// Encoder is a encoder for WAL stores data in WAL. Records are framed with
+// their payload length and CRC32C checksum:
+//
+//	file:    magic version record...
+//	record:  length(uint32 LE) crc(uint32 LE) payload
+//	payload: lsn(uvarint) flags(byte) keylen(uvarint) key value
+//	batch:   lsn(uvarint) flags(byte) count(uvarint) entry...
+//	entry:   flags(byte) keylen(uvarint) key valuelen(uvarint) value
 type Encoder struct {
-	file *os.File
+	file io.Writer
+	// header is true when the file header has to be written before the next record
+	header bool
+	// legacy appends text lines to a WAL file written by an older version
+	legacy bool
+	buf    []byte
+	// start offset of the record header in buf
+	start int
+	// size of the file written so far
+	size int64
 }
 
-// NewEncoder creates new encoder for WAL
-func NewEncoder(file *os.File) *Encoder {
+// NewEncoder creates new encoder for WAL writing an empty file
+func NewEncoder(file io.Writer) *Encoder {
 	return &Encoder{
-		file: file,
+		file:   file,
+		header: true,
 	}
 }
 
-// Encode encodes entry to WAL
+// newAppendEncoder creates an encoder appending to a WAL file of size bytes
+// which already has a header, legacy keeps the text format of older files
+func newAppendEncoder(file io.Writer, size int64, legacy bool) *Encoder {
+	return &Encoder{
+		file:   file,
+		legacy: legacy,
+		size:   size,
+	}
+}
+
+// Encode encodes entry to WAL, the record is written with a single write
 func (e *Encoder) Encode(entry *Entry) error {
-	// converts entry to byte array
-	// writes byte array to file
-	// returns error if any
+	if e.legacy {
+		return e.encodeLine(entry)
+	}
+	e.startRecord(entry.LSN)
+	e.buf = append(e.buf, entryFlags(entry))
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(entry.Key)))
+	e.buf = append(e.buf, entry.Key...)
+	e.buf = append(e.buf, entry.Value...)
+	return e.writeRecord()
+}
+
+// EncodeBatch encodes entries as a single record, a reader gets either all
+// of them or none. They share the sequence number of the first one.
+func (e *Encoder) EncodeBatch(entries []Entry) error {
+	if e.legacy {
+		return fmt.Errorf("batch records can't be appended to a legacy WAL file")
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("empty WAL batch")
+	}
+	e.startRecord(entries[0].LSN)
+	e.buf = append(e.buf, flagBatch)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(entries)))
+	for i := range entries {
+		e.buf = append(e.buf, entryFlags(&entries[i]))
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(entries[i].Key)))
+		e.buf = append(e.buf, entries[i].Key...)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(entries[i].Value)))
+		e.buf = append(e.buf, entries[i].Value...)
+	}
+	return e.writeRecord()
+}
+
+func entryFlags(entry *Entry) byte {
+	flags := byte(0)
+	if entry.Tombstoned {
+		flags |= flagTombstone
+	}
+	if entry.Dentry {
+		flags |= flagDentry
+	}
+	return flags
+}
+
+// startRecord resets the buffer to the header of a new record with sequence
+// number lsn, the rest of the payload is appended to it
+func (e *Encoder) startRecord(lsn uint64) {
+	e.buf = e.buf[:0]
+	if e.header {
+		e.buf = append(e.buf, walMagic...)
+		e.buf = append(e.buf, walVersion)
+	}
+	e.start = len(e.buf)
+	e.buf = append(e.buf, make([]byte, recordHeaderSize)...)
+	e.buf = binary.AppendUvarint(e.buf, lsn)
+}
+
+// writeRecord fills in the record header and writes the buffer
+func (e *Encoder) writeRecord() error {
+	payload := e.buf[e.start+recordHeaderSize:]
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("WAL record of %d bytes exceeds %d bytes", len(payload), maxRecordSize)
+	}
+	binary.LittleEndian.PutUint32(e.buf[e.start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(e.buf[e.start+4:], crc32.Checksum(payload, crcTable))
+	if _, err := e.file.Write(e.buf); err != nil {
+		return err
+	}
+	e.header = false
+	e.size += int64(len(e.buf))
+	return nil
+}
+
+// encodeLine writes entry in the legacy text format
+func (e *Encoder) encodeLine(entry *Entry) error {
+	if entry.Dentry {
+		return fmt.Errorf("inode store entries can't be appended to a legacy WAL file")
+	}
 	encKey := base64.StdEncoding.EncodeToString(entry.Key)
 	encValue := base64.StdEncoding.EncodeToString(entry.Value)
 	encTombstone := "0"
 	if entry.Tombstoned {
 		encTombstone = "1"
 	}
-	_, err := e.file.WriteString(encKey + "#" + encValue + "#" + encTombstone + "\n")
+	n, err := io.WriteString(e.file, encKey+"#"+encValue+"#"+encTombstone+"\n")
+	e.size += int64(n)
 	return err
 }
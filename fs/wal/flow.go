@@ -0,0 +1,199 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxPendingFiles rotated files waiting to be written to the WAL
+	// database before writers are throttled
+	DefaultMaxPendingFiles = 4
+	// degradeAfter failed attempts to dump a file after which the WAL is degraded
+	degradeAfter = 3
+	// retryBackoff first delay before a failed dump is retried, it doubles up
+	// to maxRetryBackoff
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// ErrDegraded is returned to writers throttled while dumps of WAL files fail
+var ErrDegraded = errors.New("WAL degraded")
+
+// Logger receives dump failures and changes of the WAL health
+type Logger interface {
+	Errorf(template string, args ...interface{})
+	Infof(template string, args ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Errorf(template string, args ...interface{}) {
+	log.Printf(template, args...)
+}
+
+func (stdLogger) Infof(template string, args ...interface{}) {
+	log.Printf(template, args...)
+}
+
+// Status is the state of WAL dumps
+type Status struct {
+	// PendingFiles rotated files not written to the WAL database yet
+	PendingFiles int
+	// Failures failed attempts to dump the oldest pending file in a row
+	Failures int
+	// Degraded is set once Failures reached the limit, Err is the last failure
+	Degraded bool
+	Err      error
+}
+
+// flowControl counts rotated files waiting for their dump and throttles
+// writers when there are too many of them
+type flowControl struct {
+	sync.Mutex
+	cond     *sync.Cond
+	pending  int
+	failures int
+	err      error
+	closed   bool
+	// stop interrupts retries once closed
+	stop chan struct{}
+}
+
+// WithBackpressure sets how many rotated files may wait to be written to the
+// WAL database before writers are throttled, zero is DefaultMaxPendingFiles
+// and a negative value never throttles
+func WithBackpressure(maxPending int) Option {
+	return func(w *WAL) error {
+		if maxPending == 0 {
+			maxPending = DefaultMaxPendingFiles
+		}
+		w.maxPending = maxPending
+		return nil
+	}
+}
+
+// SetLogger sets where dump failures are reported
+func (w *WAL) SetLogger(log Logger) {
+	w.Lock()
+	defer w.Unlock()
+	w.log = log
+}
+
+// Status returns the state of WAL dumps
+func (w *WAL) Status() Status {
+	f := &w.flow
+	f.Lock()
+	defer f.Unlock()
+	return Status{
+		PendingFiles: f.pending,
+		Failures:     f.failures,
+		Degraded:     f.failures >= degradeAfter,
+		Err:          f.err,
+	}
+}
+
+// Throttle blocks while more rotated files than allowed wait to be written to
+// the WAL database. Writers call it before they add entries, it fails instead
+// of blocking once the WAL is degraded.
+func (w *WAL) Throttle() error {
+	if w.maxPending <= 0 {
+		return nil
+	}
+	f := &w.flow
+	f.Lock()
+	defer f.Unlock()
+	for f.pending > w.maxPending && !f.closed {
+		if f.failures >= degradeAfter {
+			return fmt.Errorf("%w: %d files waiting: %v", ErrDegraded, f.pending, f.err)
+		}
+		f.cond.Wait()
+	}
+	return nil
+}
+
+// rotated counts a file waiting for its dump
+func (w *WAL) rotated() {
+	f := &w.flow
+	f.Lock()
+	f.pending++
+	f.Unlock()
+}
+
+// dumped records the end of a dump, writers waiting for it are woken up
+func (w *WAL) dumped() {
+	f := &w.flow
+	f.Lock()
+	f.pending--
+	f.cond.Broadcast()
+	f.Unlock()
+}
+
+// retry runs a dump until it succeeds or the WAL is closed. Failures are
+// logged, once they persist the WAL is degraded until a dump succeeds.
+func (w *WAL) retry(fileName string, fn func() error) error {
+	backoff := retryBackoff
+	for {
+		err := fn()
+		w.RLock()
+		log := w.log
+		w.RUnlock()
+		f := &w.flow
+		f.Lock()
+		if err == nil {
+			if f.failures >= degradeAfter {
+				log.Infof("WAL dumps recovered after %d failures", f.failures)
+			}
+			f.failures, f.err = 0, nil
+			f.cond.Broadcast()
+			f.Unlock()
+			return nil
+		}
+		f.failures++
+		f.err = err
+		closed := f.closed
+		if f.failures == degradeAfter {
+			log.Errorf("WAL degraded, dumping %s failed %d times: %v", fileName, f.failures, err)
+		} else {
+			log.Errorf("dumping WAL file %s: %v", fileName, err)
+		}
+		// writers waiting for the dump fail now
+		f.cond.Broadcast()
+		stop := f.stop
+		f.Unlock()
+		if closed {
+			return err
+		}
+		select {
+		case <-stop:
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// openFlow lets dumps be retried again after the WAL was reopened
+func (w *WAL) openFlow() {
+	f := &w.flow
+	f.Lock()
+	f.closed = false
+	f.stop = make(chan struct{})
+	f.Unlock()
+}
+
+// closeFlow stops retries and wakes up throttled writers
+func (w *WAL) closeFlow() {
+	f := &w.flow
+	f.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.stop)
+	}
+	f.cond.Broadcast()
+	f.Unlock()
+}
@@ -0,0 +1,118 @@
+package wal
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyStore fails writes while failing is set and blocks them until gate
+// is closed
+type faultyStore struct {
+	metastore.MetaStore
+	failing atomic.Bool
+	gate    chan struct{}
+}
+
+func (s *faultyStore) Write(b *metastore.Batch) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	if s.failing.Load() {
+		return errors.New("write failed")
+	}
+	return s.MetaStore.Write(b)
+}
+
+func addAndDump(t *testing.T, wal *WAL, key string) {
+	t.Helper()
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte(key), Value: []byte("value")}))
+	_, err := wal.Dump(nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestWALThrottle(t *testing.T) {
+	db := &faultyStore{MetaStore: memStore(t), gate: make(chan struct{})}
+	wal, err := NewWithFS(NewMemFS(), "/wal", db, WithBackpressure(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	addAndDump(t, wal, "a")
+	assert.NoError(t, wal.Throttle())
+	addAndDump(t, wal, "b")
+	assert.Equal(t, 2, wal.Status().PendingFiles)
+
+	throttled := make(chan error)
+	go func() {
+		throttled <- wal.Throttle()
+	}()
+	select {
+	case <-throttled:
+		t.Fatal("writer not throttled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(db.gate)
+	select {
+	case err := <-throttled:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("writer not released")
+	}
+	assert.NoError(t, wal.Wait())
+	assert.Equal(t, 0, wal.Status().PendingFiles)
+}
+
+func TestWALDegraded(t *testing.T) {
+	db := &faultyStore{MetaStore: memStore(t)}
+	db.failing.Store(true)
+	wal, err := NewWithFS(NewMemFS(), "/wal", db, WithBackpressure(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	addAndDump(t, wal, "a")
+	addAndDump(t, wal, "b")
+	waitFor(t, func() bool { return wal.Status().Degraded })
+	status := wal.Status()
+	assert.Equal(t, 2, status.PendingFiles)
+	assert.Error(t, status.Err)
+	// degraded writers fail instead of waiting
+	assert.ErrorIs(t, wal.Throttle(), ErrDegraded)
+
+	// dumps are retried until they succeed
+	db.failing.Store(false)
+	waitFor(t, func() bool { return wal.Status().PendingFiles == 0 })
+	status = wal.Status()
+	assert.False(t, status.Degraded)
+	assert.NoError(t, status.Err)
+	assert.NoError(t, wal.Throttle())
+	value, err := db.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestWALCloseWaitsForDumps(t *testing.T) {
+	db := &faultyStore{MetaStore: memStore(t), gate: make(chan struct{})}
+	wal, err := NewWithFS(NewMemFS(), "/wal", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addAndDump(t, wal, "key")
+	closed := make(chan error)
+	go func() { closed <- wal.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("WAL closed while a dump was writing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(db.gate)
+	assert.NoError(t, <-closed)
+	value, err := db.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
@@ -0,0 +1,218 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// File is an open WAL file
+type File interface {
+	io.Reader
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// FS stores WAL files
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldName, newName string) error
+	Truncate(name string, size int64) error
+	Glob(pattern string) ([]string, error)
+	Size(name string) (int64, error)
+}
+
+type osFS struct{}
+
+// OS keeps WAL files on disk
+var OS FS = osFS{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFS) Size(name string) (int64, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+type memData struct {
+	sync.Mutex
+	buf []byte
+}
+
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+// NewMemFS returns an FS keeping WAL files in memory
+func NewMemFS() FS {
+	return &memFS{files: make(map[string]*memData)}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	data, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		data = &memData{}
+		m.files[name] = data
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if flag&os.O_TRUNC != 0 {
+		data.Lock()
+		data.buf = nil
+		data.Unlock()
+	}
+	return &memFile{data: data, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	data, ok := m.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldName)
+	m.files[newName] = data
+	return nil
+}
+
+func (m *memFS) Truncate(name string, size int64) error {
+	m.mu.Lock()
+	data, ok := m.files[filepath.Clean(name)]
+	m.mu.Unlock()
+	if !ok {
+		return &os.PathError{Op: "truncate", Path: name, Err: os.ErrNotExist}
+	}
+	data.Lock()
+	defer data.Unlock()
+	if int64(len(data.buf)) > size {
+		data.buf = data.buf[:size]
+	} else {
+		data.buf = append(data.buf, make([]byte, size-int64(len(data.buf)))...)
+	}
+	return nil
+}
+
+func (m *memFS) Glob(pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for name := range m.files {
+		ok, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memFS) Size(name string) (int64, error) {
+	m.mu.Lock()
+	data, ok := m.files[filepath.Clean(name)]
+	m.mu.Unlock()
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	data.Lock()
+	defer data.Unlock()
+	return int64(len(data.buf)), nil
+}
+
+// memFile shares one offset between reads and writes like an os.File
+type memFile struct {
+	data   *memData
+	off    int
+	append bool
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.data.Lock()
+	defer f.data.Unlock()
+	if f.off >= len(f.data.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.buf[f.off:])
+	f.off += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.data.Lock()
+	defer f.data.Unlock()
+	if f.append {
+		f.off = len(f.data.buf)
+	}
+	if end := f.off + len(p); end > len(f.data.buf) {
+		f.data.buf = append(f.data.buf, make([]byte, end-len(f.data.buf))...)
+	}
+	n := copy(f.data.buf[f.off:], p)
+	f.off += n
+	return n, nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
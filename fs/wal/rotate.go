@@ -0,0 +1,112 @@
+package wal
+
+import (
+	"time"
+)
+
+const (
+	// DefaultSegmentSize size of a WAL file after which a new one is started
+	DefaultSegmentSize = 64 << 20
+	// DefaultSegmentAge age of a WAL file after which a new one is started
+	DefaultSegmentAge = 10 * time.Minute
+)
+
+// WithRotation sets when a new WAL file is started regardless of the cache,
+// once the current one holds maxSize bytes or its first entry is maxAge old.
+// Zero is DefaultSegmentSize or DefaultSegmentAge, a negative value disables
+// the limit.
+func WithRotation(maxSize int64, maxAge time.Duration) Option {
+	return func(w *WAL) error {
+		if maxSize == 0 {
+			maxSize = DefaultSegmentSize
+		}
+		if maxAge == 0 {
+			maxAge = DefaultSegmentAge
+		}
+		w.maxSize, w.maxAge = maxSize, maxAge
+		return nil
+	}
+}
+
+// SetRotateCallback sets the function called to start a new WAL file when the
+// current one is too large or too old. It has to call Dump, the cache does
+// it when it switches generation so flushed items are marked processed.
+// Without a callback the WAL calls Dump itself.
+func (w *WAL) SetRotateCallback(fn func()) {
+	w.Lock()
+	defer w.Unlock()
+	w.rotateCallback = fn
+}
+
+// recordAdded notes the first entry of a file and asks for a rotation once the
+// file is full, must be called with lock held
+func (w *WAL) recordAdded() {
+	if w.fileStart.IsZero() {
+		w.fileStart = time.Now()
+	}
+	if w.maxSize > 0 && w.encoder.size >= w.maxSize {
+		select {
+		case w.rotateRequest <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expired reports whether the current file holds entries older than maxAge
+func (w *WAL) expired() bool {
+	w.RLock()
+	defer w.RUnlock()
+	return !w.fileStart.IsZero() && time.Since(w.fileStart) >= w.maxAge
+}
+
+// rotate starts a new WAL file, the previous one is dumped in the background
+func (w *WAL) rotate() {
+	w.RLock()
+	fn := w.rotateCallback
+	w.RUnlock()
+	if fn != nil {
+		fn()
+		return
+	}
+	// a failed rotation is retried on the next request
+	w.Dump(nil, nil)
+}
+
+// startRotateLoop starts rotations by size and age, must be called with lock
+// held
+func (w *WAL) startRotateLoop() {
+	if w.stopRotate != nil || (w.maxSize <= 0 && w.maxAge <= 0) {
+		return
+	}
+	stop := make(chan struct{})
+	w.stopRotate = stop
+	go func() {
+		var tick <-chan time.Time
+		if w.maxAge > 0 {
+			ticker := time.NewTicker(w.maxAge/4 + 1)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-w.rotateRequest:
+				w.rotate()
+			case <-tick:
+				if w.expired() {
+					w.rotate()
+				}
+			}
+		}
+	}()
+}
+
+// stopRotateLoop stops rotations by size and age, must be called with lock
+// held
+func (w *WAL) stopRotateLoop() {
+	if w.stopRotate != nil {
+		close(w.stopRotate)
+		w.stopRotate = nil
+	}
+}
@@ -0,0 +1,145 @@
+package wal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitFor polls cond until it holds or a second passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWALRotateBySize(t *testing.T) {
+	db := memStore(t)
+	wal, err := NewWithFS(NewMemFS(), "/wal", db, WithRotation(100, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{byte(i)}, Value: []byte("value")}))
+	}
+	// closed files are written to the database in the background
+	waitFor(t, func() bool {
+		checkpoint, _ := wal.Checkpoint()
+		files, _ := wal.Files()
+		return checkpoint > 0 && len(files) == 1
+	})
+	wal.RLock()
+	counter := wal.fileCounter
+	wal.RUnlock()
+	assert.Greater(t, counter, 0)
+	value, err := db.Get([]byte{0})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestWALRotateByAge(t *testing.T) {
+	db := memStore(t)
+	wal, err := NewWithFS(NewMemFS(), "/wal", db, WithRotation(-1, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	rotated := make(chan struct{}, 1)
+	wal.SetRotateCallback(func() {
+		if _, err := wal.Dump(nil, nil); err == nil {
+			rotated <- struct{}{}
+		}
+	})
+	// an empty file is never rotated
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, rotated, 0)
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte("key"), Value: []byte("value")}))
+	select {
+	case <-rotated:
+	case <-time.After(time.Second):
+		t.Fatal("WAL file not rotated")
+	}
+	assert.NoError(t, wal.Wait())
+	value, err := db.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestWALReplayClosedFiles(t *testing.T) {
+	fsys := NewMemFS()
+	db := memStore(t)
+	wal, err := NewWithFS(fsys, "/wal", db, WithRotation(-1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte("old"), Value: []byte("value")}))
+	// a crash right after the rotation, before the dump of the closed file
+	wal.Lock()
+	assert.NoError(t, wal.CreateNewWALFile())
+	wal.Unlock()
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte("new"), Value: []byte("value")}))
+
+	var replayed []string
+	assert.NoError(t, wal.Close())
+	assert.NoError(t, wal.OpenLastWALFile())
+	assert.NoError(t, wal.Replay(func(entry *Entry) error {
+		replayed = append(replayed, string(entry.Key))
+		return nil
+	}))
+	assert.Equal(t, []string{"new"}, replayed)
+	value, err := db.Get([]byte("old"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	files, err := wal.Files()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{wal.WalFilename()}, files)
+}
+
+func TestWALReplayClosedFilesDentries(t *testing.T) {
+	fsys := NewMemFS()
+	db, idb := memStore(t), memStore(t)
+	wal, err := NewWithFS(fsys, "/wal", db, WithRotation(-1, -1), WithInodeStore(idb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, idb.Put([]byte("gone"), []byte("1")))
+	// the inode store missed both changes before a crash
+	assert.NoError(t, wal.AddBatch([]Entry{
+		{Key: []byte("attrs"), Value: []byte("value")},
+		{Key: []byte("name"), Value: []byte("2"), Dentry: true},
+		{Key: []byte("gone"), Tombstoned: true, Dentry: true},
+	}))
+	wal.Lock()
+	assert.NoError(t, wal.CreateNewWALFile())
+	wal.Unlock()
+	assert.NoError(t, wal.Close())
+
+	assert.NoError(t, wal.OpenLastWALFile())
+	assert.NoError(t, wal.Replay(func(entry *Entry) error { return nil }))
+	value, err := idb.Get([]byte("name"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+	_, err = idb.Get([]byte("gone"))
+	assert.ErrorIs(t, err, metastore.ErrNotFound)
+	// the WAL database doesn't get dentries
+	_, err = db.Get([]byte("name"))
+	assert.ErrorIs(t, err, metastore.ErrNotFound)
+
+	// a file rotated while running was written to the inode store when logged,
+	// its dump leaves later changes of the same names alone
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte("name"), Value: []byte("3"), Dentry: true}))
+	assert.NoError(t, idb.Delete([]byte("name")))
+	_, err = wal.Dump(nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Wait())
+	_, err = idb.Get([]byte("name"))
+	assert.ErrorIs(t, err, metastore.ErrNotFound)
+}
@@ -0,0 +1,155 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// SyncNone never syncs WAL files, entries survive a crash of the process
+	// but not of the machine
+	SyncNone = "none"
+	// SyncInterval syncs WAL files periodically, a power loss drops at most
+	// the entries added within the interval
+	SyncInterval = "interval"
+	// SyncAlways syncs every entry before it is acknowledged, concurrent
+	// entries share one sync
+	SyncAlways = "always"
+	// DefaultSyncInterval how often WAL files are synced in interval mode
+	DefaultSyncInterval = time.Second
+)
+
+// Option configures a WAL
+type Option func(*WAL) error
+
+// WithSync sets when WAL files are synced, mode is one of SyncNone,
+// SyncInterval or SyncAlways, an empty mode is SyncInterval. interval is only
+// used in interval mode, zero is DefaultSyncInterval.
+func WithSync(mode string, interval time.Duration) Option {
+	return func(w *WAL) error {
+		switch mode {
+		case "":
+			mode = SyncInterval
+		case SyncNone, SyncInterval, SyncAlways:
+		default:
+			return fmt.Errorf("unknown WAL sync mode %q", mode)
+		}
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		w.syncMode, w.syncInterval = mode, interval
+		return nil
+	}
+}
+
+// groupCommit lets concurrent writers share a sync, the first writer waiting
+// syncs everything written so far and the others wait for it
+type groupCommit struct {
+	sync.Mutex
+	cond *sync.Cond
+	// synced number of entries known to be durable
+	synced uint64
+	// syncing is true while a writer syncs
+	syncing bool
+}
+
+// waitSynced waits until the first seq entries are durable
+func (w *WAL) waitSynced(seq uint64) error {
+	g := &w.group
+	g.Lock()
+	defer g.Unlock()
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.Unlock()
+		target, err := w.syncCurrent()
+		g.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			// the file may have been synced and closed by a rotation meanwhile
+			if g.synced >= seq {
+				return nil
+			}
+			return fmt.Errorf("syncing WAL: %w", err)
+		}
+		if target > g.synced {
+			g.synced = target
+		}
+	}
+	return nil
+}
+
+// syncCurrent syncs the current file and returns the number of entries it made durable
+func (w *WAL) syncCurrent() (uint64, error) {
+	w.RLock()
+	f, written := w.file, w.written
+	w.RUnlock()
+	return written, f.Sync()
+}
+
+// syncBeforeClose syncs the current file before it is closed, must be called
+// with lock held
+func (w *WAL) syncBeforeClose() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	g := &w.group
+	g.Lock()
+	if w.written > g.synced {
+		g.synced = w.written
+	}
+	g.Unlock()
+	return nil
+}
+
+// Sync makes all entries added so far durable, it is a no-op in SyncNone mode
+func (w *WAL) Sync() error {
+	if w.syncMode == SyncNone {
+		return nil
+	}
+	w.RLock()
+	written := w.written
+	w.RUnlock()
+	return w.waitSynced(written)
+}
+
+// SyncMode returns when WAL files are synced
+func (w *WAL) SyncMode() string {
+	return w.syncMode
+}
+
+// startSyncLoop starts periodic syncs in interval mode, must be called with
+// lock held
+func (w *WAL) startSyncLoop() {
+	if w.syncMode != SyncInterval || w.stopSync != nil {
+		return
+	}
+	stop := make(chan struct{})
+	w.stopSync = stop
+	go func() {
+		ticker := time.NewTicker(w.syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a failed sync is retried on the next tick, Sync reports it
+				w.Sync()
+			}
+		}
+	}()
+}
+
+// stopSyncLoop stops periodic syncs, must be called with lock held
+func (w *WAL) stopSyncLoop() {
+	if w.stopSync != nil {
+		close(w.stopSync)
+		w.stopSync = nil
+	}
+}
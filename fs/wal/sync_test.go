@@ -0,0 +1,128 @@
+package wal
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncCountingFS counts syncs of files, each sync takes delay
+type syncCountingFS struct {
+	FS
+	delay time.Duration
+	syncs atomic.Int64
+}
+
+type syncCountingFile struct {
+	File
+	fs *syncCountingFS
+}
+
+func (s *syncCountingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := s.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{File: f, fs: s}, nil
+}
+
+func (f *syncCountingFile) Sync() error {
+	time.Sleep(f.fs.delay)
+	f.fs.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func TestWALSyncModes(t *testing.T) {
+	entry := &Entry{Key: []byte("key"), Value: []byte("value")}
+
+	fsys := &syncCountingFS{FS: NewMemFS()}
+	wal, err := NewWithFS(fsys, "/wal", memStore(t), WithSync(SyncNone, 0))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.AddEntry(entry))
+	assert.NoError(t, wal.Sync())
+	assert.Equal(t, int64(0), fsys.syncs.Load())
+
+	fsys = &syncCountingFS{FS: NewMemFS()}
+	wal, err = NewWithFS(fsys, "/wal", memStore(t), WithSync(SyncAlways, 0))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.AddEntry(entry))
+	assert.Equal(t, int64(1), fsys.syncs.Load())
+	// nothing new to sync
+	assert.NoError(t, wal.Sync())
+	assert.Equal(t, int64(1), fsys.syncs.Load())
+
+	fsys = &syncCountingFS{FS: NewMemFS()}
+	wal, err = NewWithFS(fsys, "/wal", memStore(t), WithSync(SyncInterval, 10*time.Millisecond))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.AddEntry(entry))
+	assert.Eventually(t, func() bool { return fsys.syncs.Load() > 0 }, time.Second, 5*time.Millisecond)
+	assert.NoError(t, wal.Close())
+
+	_, err = NewWithFS(NewMemFS(), "/wal", memStore(t), WithSync("sometimes", 0))
+	assert.Error(t, err)
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	fsys := &syncCountingFS{FS: NewMemFS(), delay: 10 * time.Millisecond}
+	wal, err := NewWithFS(fsys, "/wal", memStore(t), WithSync(SyncAlways, 0))
+	assert.NoError(t, err)
+	writers := 16
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{byte(i)}, Value: []byte("value")}))
+		}(i)
+	}
+	wg.Wait()
+	// writers arriving during a sync share the next one
+	assert.Less(t, fsys.syncs.Load(), int64(writers))
+	assert.Equal(t, uint64(writers), wal.group.synced)
+
+	// rotation keeps entries of the previous file durable
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte("key"), Value: []byte("value")}))
+	syncs := fsys.syncs.Load()
+	assert.NoError(t, wal.CreateNewWALFile())
+	assert.Equal(t, syncs, fsys.syncs.Load()-1)
+	assert.NoError(t, wal.Sync())
+	assert.Equal(t, syncs, fsys.syncs.Load()-1)
+}
+
+// syncCheckingStore records whether a WAL file was still there when the store
+// was synced
+type syncCheckingStore struct {
+	metastore.MetaStore
+	fsys FS
+	file string
+	kept atomic.Bool
+}
+
+func (s *syncCheckingStore) Sync() error {
+	if _, err := s.fsys.Size(s.file); err == nil {
+		s.kept.Store(true)
+	}
+	return s.MetaStore.Sync()
+}
+
+func TestWALDumpSyncsStores(t *testing.T) {
+	fsys := NewMemFS()
+	db := &syncCheckingStore{MetaStore: memStore(t), fsys: fsys}
+	wal, err := NewWithFS(fsys, "/wal", db)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte("key"), Value: []byte("value")}))
+	db.file = wal.WalFilename()
+	_, err = wal.Dump(nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Wait())
+	// the store was synced before the dumped file was removed
+	assert.True(t, db.kept.Load())
+	_, err = fsys.Size(db.file)
+	assert.Error(t, err)
+	assert.Equal(t, SyncInterval, wal.SyncMode())
+}
@@ -1,14 +1,19 @@
 package wal
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/utils"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -21,74 +26,186 @@ type Entry struct {
 	Key        []byte
 	Value      []byte
 	Tombstoned bool
+	// Dentry entries change the inode store, it is written when they are
+	// logged and again by dumps, which may follow a crash. Other entries
+	// change the WAL database.
+	Dentry bool
+	// LSN sequence number assigned when the entry is added, entries of a
+	// batch share it. It is zero for entries of legacy files.
+	LSN uint64
 }
 
-//TODO convert to base64
-
 type WAL struct {
 	// path is path to WAL directory
 	path string
+	// fsys stores WAL files
+	fsys FS
 	// file is current WAL file
-	file *os.File
+	file File
 	// fileCounter	 is counter of WAL files
 	fileCounter int
 	// db is database for WAL
-	db *leveldb.DB
+	db metastore.MetaStore
+	// inodeDB receives dentry entries when files are dumped, they are skipped
+	// without it
+	inodeDB metastore.MetaStore
 	sync.RWMutex
 	// encoder is encoder for WAL
 	encoder *Encoder
 	//errs is channel for errors
 	g *errgroup.Group
+	// syncMode when files are synced, syncInterval how often in interval mode
+	syncMode     string
+	syncInterval time.Duration
+	// written number of records added
+	written uint64
+	// lsn sequence number of the last added record
+	lsn uint64
+	// lastDump is the dump of the newest rotated file, pendingDumps dumps
+	// run by callers of DBDump by file name
+	lastDump     *dump
+	pendingDumps map[string]*dump
+	group        groupCommit
+	// stopSync stops periodic syncs
+	stopSync chan struct{}
+	// maxSize and maxAge of a file before a new one is started, fileStart is
+	// when the first entry of the current file was added
+	maxSize   int64
+	maxAge    time.Duration
+	fileStart time.Time
+	// rotateRequest asks for a rotation of a full file, rotateCallback rotates it
+	rotateRequest  chan struct{}
+	rotateCallback func()
+	// stopRotate stops rotations by size and age
+	stopRotate chan struct{}
+	// maxPending rotated files waiting for their dump before writers are
+	// throttled, flow counts them
+	maxPending int
+	flow       flowControl
+	log        Logger
 }
 
 // New creates or opens new WAL object
-func New(path string, db *leveldb.DB) (*WAL, error) {
+func New(path string, db metastore.MetaStore, opts ...Option) (*WAL, error) {
+	return NewWithFS(OS, path, db, opts...)
+}
+
+// NewWithFS creates or opens new WAL object keeping its files in fsys
+func NewWithFS(fsys FS, path string, db metastore.MetaStore, opts ...Option) (*WAL, error) {
 	w := &WAL{
-		path:        path,
-		fileCounter: 0,
-		db:          db,
-		file:        nil,
-		g:           &errgroup.Group{},
+		fsys:          fsys,
+		path:          path,
+		fileCounter:   0,
+		db:            db,
+		file:          nil,
+		g:             &errgroup.Group{},
+		syncMode:      SyncInterval,
+		syncInterval:  DefaultSyncInterval,
+		maxSize:       DefaultSegmentSize,
+		maxAge:        DefaultSegmentAge,
+		rotateRequest: make(chan struct{}, 1),
+		maxPending:    DefaultMaxPendingFiles,
+		log:           stdLogger{},
+		pendingDumps:  map[string]*dump{},
+	}
+	w.group.cond = sync.NewCond(&w.group)
+	w.flow.cond = sync.NewCond(&w.flow)
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, err
+		}
 	}
 	w.Lock()
 	defer w.Unlock()
 	return w, w.OpenLastWALFile()
 }
 
+// WithInodeStore sets the store dentry entries are written to when files are
+// dumped, a crash may have kept them from it when they were logged
+func WithInodeStore(db metastore.MetaStore) Option {
+	return func(w *WAL) error {
+		w.inodeDB = db
+		return nil
+	}
+}
+
 // OpenLastWALFile opens last WAL file
 func (w *WAL) OpenLastWALFile() error {
-	err := filepath.Walk(w.path, func(path string, info os.FileInfo, err error) error {
+	names, err := w.fsys.Glob(filepath.Join(w.path, "*.wal"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		size, err := w.fsys.Size(name)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && info.Size() > 0 {
-			if strings.HasSuffix(path, ".wal") {
-				fileName := path
-				parts := strings.Split(path, "/")
-				if len(parts) > 0 {
-					fileName = parts[len(parts)-1]
-				}
-				fc, err := strconv.Atoi(strings.TrimSuffix(fileName, ".wal"))
-				if err != nil {
-					return err
-				}
-				if fc > w.fileCounter {
-					w.fileCounter = fc
-				}
-			}
+		if size == 0 {
+			continue
+		}
+		fc, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".wal"))
+		if err != nil {
+			return err
+		}
+		if fc > w.fileCounter {
+			w.fileCounter = fc
+		}
+	}
+	fileName := fmt.Sprintf("%s/%d.wal", w.path, w.fileCounter)
+	// records are always appended, also after a torn tail was truncated
+	f, err := w.fsys.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("OpenLastWALFile: %v", err)
+	}
+	w.file = f
+	w.openFlow()
+	w.startSyncLoop()
+	if err := w.resetEncoder(); err != nil {
+		return err
+	}
+	if err := w.recoverLSN(); err != nil {
+		return err
+	}
+	w.startRotateLoop()
+	return nil
+}
+
+// recoverLSN continues sequence numbers after the checkpoint and the entries
+// of the current file, must be called with lock held
+func (w *WAL) recoverLSN() error {
+	checkpoint, err := w.Checkpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint > w.lsn {
+		w.lsn = checkpoint
+	}
+	// a damaged tail is dealt with by Replay
+	scanEntries(w.fsys, w.WalFilename(), func(entry *Entry) error {
+		if entry.LSN > w.lsn {
+			w.lsn = entry.LSN
 		}
 		return nil
 	})
+	return nil
+}
+
+// resetEncoder creates the encoder for the current WAL file, records are
+// appended in the format of the data already in it
+func (w *WAL) resetEncoder() error {
+	size, err := w.fsys.Size(w.WalFilename())
 	if err != nil {
 		return err
 	}
-	fileName := fmt.Sprintf("%s/%d.wal", w.path, w.fileCounter)
-	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0640)
+	if size == 0 {
+		w.encoder = NewEncoder(w.file)
+		return nil
+	}
+	legacy, err := isLegacy(w.fsys, w.WalFilename())
 	if err != nil {
-		return fmt.Errorf("OpenLastWALFile: %v", err)
+		return err
 	}
-	w.file = f
-	w.encoder = NewEncoder(f)
+	w.encoder = newAppendEncoder(w.file, size, legacy)
 	return nil
 }
 
@@ -96,16 +213,23 @@ func (w *WAL) OpenLastWALFile() error {
 func (w *WAL) CreateNewWALFile() error {
 	cnt := w.fileCounter
 	if w.file != nil {
+		// entries of the previous file must not lose their durability
+		if w.syncMode != SyncNone {
+			if err := w.syncBeforeClose(); err != nil {
+				return err
+			}
+		}
 		w.file.Close()
 		w.file = nil
 		cnt++
 	}
-	f, err := os.Create(fmt.Sprintf("%s/%d.wal", w.path, cnt))
+	f, err := w.fsys.OpenFile(fmt.Sprintf("%s/%d.wal", w.path, cnt), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 	w.file = f
 	w.encoder = NewEncoder(f)
+	w.fileStart = time.Time{}
 	w.fileCounter++
 	return nil
 }
@@ -113,37 +237,85 @@ func (w *WAL) CreateNewWALFile() error {
 // CheckFileSize return size of current WAL file
 func (w *WAL) CheckFileSize() (int64, error) {
 	if w.file != nil {
-		fileInfo, err := w.file.Stat()
-		if err != nil {
-			return 0, err
-		}
-		return fileInfo.Size(), nil
+		return w.fsys.Size(w.WalFilename())
 	}
 	return 0, fmt.Errorf("WAL file is not opened")
 }
 
-// AddEntry adds entry to WAL
+// AddEntry adds entry to WAL and sets its sequence number, in SyncAlways
+// mode it returns once the entry is durable
 func (w *WAL) AddEntry(entry *Entry) error {
 	w.Lock()
-	defer w.Unlock()
+	w.lsn++
+	entry.LSN = w.lsn
 	if err := w.encoder.Encode(entry); err != nil {
+		w.Unlock()
 		return err
 	}
+	w.written++
+	written := w.written
+	w.recordAdded()
+	w.Unlock()
+	if w.syncMode == SyncAlways {
+		return w.waitSynced(written)
+	}
+	return nil
+}
+
+// AddBatch adds entries as a single record and sets their sequence number,
+// after a crash either all of them are replayed or none. In SyncAlways mode it
+// returns once they are durable.
+func (w *WAL) AddBatch(entries []Entry) error {
+	w.Lock()
+	w.lsn++
+	for i := range entries {
+		entries[i].LSN = w.lsn
+	}
+	if err := w.encoder.EncodeBatch(entries); err != nil {
+		w.Unlock()
+		return err
+	}
+	w.written++
+	written := w.written
+	w.recordAdded()
+	w.Unlock()
+	if w.syncMode == SyncAlways {
+		return w.waitSynced(written)
+	}
 	return nil
 }
 
-// Close closes WAL
+// Close closes WAL and waits for dumps running in the background, so the
+// WAL database can be closed next. Failed dumps are not retried any more,
+// their files are dumped when the WAL is opened again.
 func (w *WAL) Close() error {
 	w.Lock()
-	defer w.Unlock()
-	w.file.Sync()
-	return w.file.Close()
+	w.stopSyncLoop()
+	w.stopRotateLoop()
+	w.closeFlow()
+	w.syncBeforeClose()
+	err := w.file.Close()
+	w.Unlock()
+	// failures were logged by the dumps
+	w.g.Wait()
+	return err
 }
 
-// Dump  dumps WAL to database and creates new WAL file
-func (w *WAL) Dump(output chan string, snapshotDB *leveldb.DB) (string, error) {
+// Dump  dumps WAL to database and creates new WAL file. Keys written are sent
+// to output unless it is nil. Without snapshotDB the file is dumped in the
+// background and output is closed once it is, or on return when no file is
+// rotated. For a snapshot the caller keeps output for DBDump and closes it.
+func (w *WAL) Dump(output chan string, snapshotDB metastore.MetaStore) (_ string, err error) {
 	w.Lock()
 	defer w.Unlock()
+	background := false
+	if snapshotDB == nil && output != nil {
+		defer func() {
+			if !background {
+				close(output)
+			}
+		}()
+	}
 	size, err := w.CheckFileSize()
 	if err != nil {
 		return "", err
@@ -155,113 +327,440 @@ func (w *WAL) Dump(output chan string, snapshotDB *leveldb.DB) (string, error) {
 	if err := w.CreateNewWALFile(); err != nil {
 		return "", err
 	}
-	if snapshotDB == nil {
+	d := &dump{prev: w.lastDump, done: make(chan struct{})}
+	w.lastDump = d
+	w.rotated()
+	if snapshotDB != nil {
+		// the caller runs DBDump for the file
+		w.pendingDumps[previousFileName] = d
+	} else {
+		background = true
 		w.g.Go(func() error {
-			if err := w.DBDump(previousFileName, output, nil); err != nil {
-				return err
+			if output != nil {
+				defer close(output)
 			}
-			return os.Remove(previousFileName)
-		})
-		go func() {
-			if err := w.g.Wait(); err != nil {
-				fmt.Println(err) // TODO CHANGE ME
+			err := d.prev.result()
+			if err == nil {
+				err = w.retry(previousFileName, func() error { return w.dbDump(previousFileName, output, nil, false) })
 			}
-		}()
+			return w.finishDump(d, previousFileName, err)
+		})
 	}
 	return previousFileName, nil
 }
 
+// finishDump ends the dump of a rotated file and removes the file once it is
+// written to the WAL database, failed dumps are logged by retry
+func (w *WAL) finishDump(d *dump, fileName string, err error) error {
+	d.finish(err)
+	w.dumped()
+	if err != nil {
+		return err
+	}
+	if err := w.fsys.Remove(fileName); err != nil {
+		w.RLock()
+		log := w.log
+		w.RUnlock()
+		log.Errorf("removing dumped WAL file %s: %v", fileName, err)
+		return err
+	}
+	return nil
+}
+
+// WaitPrevious waits until files rotated before fileName are written to the
+// WAL database, all files rotated so far when fileName is empty. fileName has
+// to be rotated by Dump for a snapshot and not passed to DBDump yet, until it
+// is no later file is written either.
+func (w *WAL) WaitPrevious(fileName string) error {
+	w.RLock()
+	if fileName == "" {
+		d := w.lastDump
+		w.RUnlock()
+		return d.result()
+	}
+	d, ok := w.pendingDumps[fileName]
+	w.RUnlock()
+	if !ok {
+		return fmt.Errorf("WAL file %s is not waiting for its dump", fileName)
+	}
+	return d.prev.result()
+}
+
 // Wait waits for all WAL dumps to finish
 func (w *WAL) Wait() error {
 	return w.g.Wait()
 }
 
-// BDump dumps WAL to database
-func (w *WAL) DBDump(fileName string, output chan string, db *leveldb.DB) error {
-	f, err := os.Open(fileName)
+// DBDump dumps WAL to database, and to db when it isn't nil. A file rotated
+// by Dump for a snapshot is dumped after the files rotated before it, if that
+// fails it is still written to the WAL database in the background.
+func (w *WAL) DBDump(fileName string, output chan string, db metastore.MetaStore) error {
+	w.Lock()
+	d, ok := w.pendingDumps[fileName]
+	delete(w.pendingDumps, fileName)
+	w.Unlock()
+	if !ok {
+		return w.dbDump(fileName, output, db, false)
+	}
+	if err := d.prev.result(); err != nil {
+		w.finishDump(d, fileName, err)
+		return err
+	}
+	err := w.dbDump(fileName, output, db, false)
+	if err == nil {
+		return w.finishDump(d, fileName, nil)
+	}
+	// later dumps wait for the file to reach the WAL database
+	w.g.Go(func() error {
+		err := w.retry(fileName, func() error { return w.dbDump(fileName, nil, nil, false) })
+		return w.finishDump(d, fileName, err)
+	})
+	return err
+}
+
+// dbDump writes entries of a WAL file not written yet to the WAL database and
+// db, the checkpoint is written with every batch. Writers put dentry entries
+// to the inode store before the file is rotated, redo writes them again for
+// files left by a crash. It must not be set once new entries are logged, a
+// later change of the same name would be undone. The stores are synced, so
+// the file can be removed.
+func (w *WAL) dbDump(fileName string, output chan string, db metastore.MetaStore, redo bool) error {
+	checkpoint, err := w.Checkpoint()
+	if err != nil {
+		return err
+	}
+	f, err := w.fsys.OpenFile(fileName, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	decoder := NewDecoder(f)
 
-	wb := new(leveldb.Batch)
-	entryCounter := 0
+	wb := new(metastore.Batch)
+	ib := new(metastore.Batch)
 	outputData := []string{}
+	// lsn of the last entry read, written is the checkpoint stored so far
+	lsn, written := checkpoint, checkpoint
+	flush := func() error {
+		if len(outputData) == 0 && ib.Len() == 0 && lsn == written {
+			return nil
+		}
+		if lsn > written {
+			wb.Put(CheckpointKey, utils.Uint64ToBytes(lsn))
+		}
+		// the checkpoint never passes dentries missing from the inode store
+		if ib.Len() > 0 {
+			if err := w.inodeDB.Write(ib); err != nil {
+				return err
+			}
+			ib.Reset()
+		}
+		if err := w.db.Write(wb); err != nil {
+			return err
+		}
+		if db != nil {
+			if err := db.Write(wb); err != nil {
+				return err
+			}
+		}
+		wb.Reset()
+		written = lsn
+		if output != nil {
+			for _, key := range outputData {
+				output <- key
+			}
+		}
+		outputData = []string{}
+		return nil
+	}
 	for {
 		var entry Entry
 		if err := decoder.Decode(&entry); err != nil {
-			if err.Error() == "EOF" {
+			// a torn tail was never acknowledged, the entries before it are complete
+			if err == io.EOF || errors.Is(err, ErrTorn) {
 				break
 			}
 			return err
 		}
-		entryCounter++
-		if entry.Tombstoned {
-			wb.Delete(entry.Key)
-			if db != nil {
-				outputData = append(outputData, string(entry.Key))
+		if applied(&entry, checkpoint) {
+			continue
+		}
+		if entry.LSN > lsn {
+			lsn = entry.LSN
+		}
+		if entry.Dentry {
+			// putting and deleting names again is harmless, they were written
+			// when logged unless a crash came in between
+			if redo && w.inodeDB != nil {
+				addToBatch(ib, &entry)
 			}
 		} else {
-			wb.Put(entry.Key, entry.Value)
-			if db != nil {
-				outputData = append(outputData, string(entry.Key))
-			}
+			addToBatch(wb, &entry)
+			outputData = append(outputData, string(entry.Key))
 		}
-		if entryCounter%WALBatchMaxSize == 0 && len(outputData) > 0 {
-			err = w.db.Write(wb, nil)
-			if err != nil {
+		if len(outputData)+ib.Len() >= WALBatchMaxSize {
+			if err := flush(); err != nil {
 				return err
 			}
-			if db != nil {
-				err = db.Write(wb, nil)
-				if err != nil {
-					return err
-				}
-			}
-			wb.Reset()
-			for _, key := range outputData {
-				output <- key
-			}
-			outputData = []string{}
 		}
 	}
 	f.Close()
-	if len(outputData) > 0 {
-		err = w.db.Write(wb, nil)
-		if err != nil {
-			return err
-		}
-		if db != nil {
-			err = db.Write(wb, nil)
-			if err != nil {
-				return err
-			}
+	if err := flush(); err != nil {
+		return err
+	}
+	// the file is removed once it is dumped
+	return syncStores(w.inodeDB, w.db, db)
+}
+
+// addToBatch stages the change of an entry
+func addToBatch(b *metastore.Batch, entry *Entry) {
+	if entry.Tombstoned {
+		b.Delete(entry.Key)
+	} else {
+		b.Put(entry.Key, entry.Value)
+	}
+}
+
+// syncStores makes changes written to stores durable, nil stores are skipped
+func syncStores(stores ...metastore.MetaStore) error {
+	for _, s := range stores {
+		if s == nil {
+			continue
 		}
-		for _, key := range outputData {
-			output <- key
+		if err := s.Sync(); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// Reply reads content of WAL file and return list of entries
+// Reply reads content of WAL file and return list of entries not written to
+// the WAL database yet, like Replay
 func (w *WAL) Reply() ([]Entry, error) {
-	decoder := NewDecoder(w.file)
 	var entries []Entry
+	err := w.Replay(func(entry *Entry) error {
+		entries = append(entries, *entry)
+		return nil
+	})
+	return entries, err
+}
+
+// Replay writes files left by a previous run before the current one to the
+// WAL database and calls fn for every entry of the current file not written
+// to it yet, entries are streamed so replay needs no more memory than a
+// record. A torn last record left by a crash is truncated, new entries are
+// appended after the last complete one.
+func (w *WAL) Replay(fn func(entry *Entry) error) error {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.dumpClosed(); err != nil {
+		return err
+	}
+	// entries dumped before a crash are skipped
+	checkpoint, err := w.Checkpoint()
+	if err != nil {
+		return err
+	}
+	var rw *rewriter
+	if w.encoder.legacy {
+		if rw, err = w.newRewriter(); err != nil {
+			return fmt.Errorf("converting legacy WAL file: %w", err)
+		}
+		defer rw.abort()
+	}
+	decoder := NewDecoder(w.file)
 	counter := 0
 	for {
 		counter += 1
 		var entry Entry
 		if err := decoder.Decode(&entry); err != nil {
-			if err.Error() == "EOF" {
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, ErrTorn) {
+				if err := w.fsys.Truncate(w.WalFilename(), decoder.Offset()); err != nil {
+					return fmt.Errorf("truncating torn WAL file entry %d: %w", counter, err)
+				}
+				if err := w.resetEncoder(); err != nil {
+					return err
+				}
 				break
 			}
-			return nil, fmt.Errorf("error while decoding WAL file entry %d : %w", counter, err)
+			return fmt.Errorf("error while decoding WAL file entry %d : %w", counter, err)
+		}
+		if rw != nil {
+			if err := rw.encoder.Encode(&entry); err != nil {
+				return fmt.Errorf("converting legacy WAL file: %w", err)
+			}
+		}
+		if applied(&entry, checkpoint) {
+			continue
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	if rw != nil {
+		if err := w.finishRewrite(rw); err != nil {
+			return fmt.Errorf("converting legacy WAL file: %w", err)
+		}
+	}
+	// the age of entries left by a previous run is counted from now
+	if w.encoder.size > 0 && w.fileStart.IsZero() {
+		w.fileStart = time.Now()
+	}
+	return nil
+}
+
+// dumpClosed writes files older than the current one to the WAL database and
+// their dentry entries to the inode store, then removes them. A crash may
+// have left them before their background dump finished. It must be called
+// with lock held before new entries are logged.
+func (w *WAL) dumpClosed() error {
+	files, err := w.Files()
+	if err != nil {
+		return err
+	}
+	current := w.WalFilename()
+	for _, name := range files {
+		fc, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".wal"))
+		if fc >= w.fileCounter || name == current {
+			continue
+		}
+		if _, ok := w.pendingDumps[name]; ok {
+			continue
+		}
+		if err := w.dbDump(name, nil, nil, true); err != nil {
+			return fmt.Errorf("dumping WAL file %s: %w", name, err)
+		}
+		if err := w.fsys.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriter writes the current file in the binary format to a temporary file,
+// so batches can be appended to a file written by an older version
+type rewriter struct {
+	fsys    FS
+	name    string
+	file    File
+	encoder *Encoder
+}
+
+// newRewriter creates the temporary file, must be called with lock held
+func (w *WAL) newRewriter() (*rewriter, error) {
+	name := w.WalFilename() + ".tmp"
+	f, err := w.fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &rewriter{fsys: w.fsys, name: name, file: f, encoder: NewEncoder(f)}, nil
+}
+
+// abort removes the temporary file unless it replaced the current one
+func (r *rewriter) abort() {
+	if r.file != nil {
+		r.file.Close()
+		r.fsys.Remove(r.name)
+	}
+}
+
+// finishRewrite replaces the current file by the rewritten one, must be
+// called with lock held
+func (w *WAL) finishRewrite(r *rewriter) error {
+	f := r.file
+	r.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	name := w.WalFilename()
+	if err := w.fsys.Rename(r.name, name); err != nil {
+		return err
+	}
+	w.file.Close()
+	var err error
+	if w.file, err = w.fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640); err != nil {
+		return err
+	}
+	return w.resetEncoder()
+}
+
+// Files returns WAL files ordered from the oldest one
+func (w *WAL) Files() ([]string, error) {
+	return ListFiles(w.fsys, w.path)
+}
+
+// ListFiles returns WAL files in dir of fsys ordered from the oldest one
+func ListFiles(fsys FS, dir string) ([]string, error) {
+	names, err := fsys.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	counters := map[string]int{}
+	files := []string{}
+	for _, name := range names {
+		fc, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".wal"))
+		if err != nil {
+			continue
+		}
+		counters[name] = fc
+		files = append(files, name)
+	}
+	sort.Slice(files, func(i, j int) bool { return counters[files[i]] < counters[files[j]] })
+	return files, nil
+}
+
+// ScanFile decodes entries of a WAL file up to the first damaged one, like the
+// package level ScanFile
+func (w *WAL) ScanFile(fileName string) ([]Entry, int64, error) {
+	return scanFile(w.fsys, fileName)
+}
+
+// FS returns the file system WAL files are kept in
+func (w *WAL) FS() FS {
+	return w.fsys
+}
+
+// Apply writes entries to the WAL database and dentry entries to the inode
+// store of an unmounted filesystem, both are synced so files holding the
+// entries can be removed. The checkpoint moves to the last entry, so changes
+// written over them afterwards aren't replayed away.
+func (w *WAL) Apply(entries []Entry) error {
+	checkpoint, err := w.Checkpoint()
+	if err != nil {
+		return err
+	}
+	lsn := checkpoint
+	wb := new(metastore.Batch)
+	ib := new(metastore.Batch)
+	for i := range entries {
+		if entries[i].LSN > lsn {
+			lsn = entries[i].LSN
 		}
-		entries = append(entries, entry)
+		if !entries[i].Dentry {
+			addToBatch(wb, &entries[i])
+		} else if w.inodeDB != nil {
+			addToBatch(ib, &entries[i])
+		}
+	}
+	if lsn > checkpoint {
+		wb.Put(CheckpointKey, utils.Uint64ToBytes(lsn))
+	}
+	if ib.Len() > 0 {
+		if err := w.inodeDB.Write(ib); err != nil {
+			return err
+		}
+	}
+	if err := w.db.Write(wb); err != nil {
+		return err
 	}
-	return entries, nil
+	return syncStores(w.inodeDB, w.db)
 }
 
 // WalFilename returns current WAL filename
@@ -1,18 +1,20 @@
 package wal
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path"
 	"testing"
 	"time"
 
+	"github.com/radek-ryckowski/monofs/fs/metastore"
 	"github.com/radek-ryckowski/monofs/fs/monocache"
 	"github.com/radek-ryckowski/monofs/utils"
 	"github.com/stretchr/testify/assert"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -36,7 +38,7 @@ func generateRandom() []byte {
 }
 
 func TestWalReply(t *testing.T) {
-	db, err := leveldb.OpenFile(path.Join(t.TempDir(), "testWalReply"), nil)
+	db, err := metastore.Open(path.Join(t.TempDir(), "testWalReply"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +75,7 @@ func TestWalReply(t *testing.T) {
 }
 
 func TestWAL(t *testing.T) {
-	db, err := leveldb.OpenFile(path.Join(t.TempDir(), "walTest"), nil)
+	db, err := metastore.Open(path.Join(t.TempDir(), "walTest"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,9 +106,11 @@ func TestWAL(t *testing.T) {
 		t.Fatal(err)
 	}
 	numberOfKeys := 0
-	iterator := db.NewIterator(nil, nil)
+	iterator := db.NewIterator(nil)
 	for iterator.Next() {
-		numberOfKeys++
+		if !bytes.Equal(iterator.Key(), CheckpointKey) {
+			numberOfKeys++
+		}
 	}
 	iterator.Release()
 	if err := iterator.Error(); err != nil {
@@ -127,7 +131,7 @@ func TestWALReplyLong(t *testing.T) {
 		t.Fatal(err)
 	}
 	f.Seek(0, 0)
-	db, err := leveldb.OpenFile(path.Join(t.TempDir(), "testWalReplyLong"), nil)
+	db, err := metastore.Open(path.Join(t.TempDir(), "testWalReplyLong"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,3 +165,267 @@ func TestWALReplyLong(t *testing.T) {
 	assert.Equal(t, 17, tombstoned)
 	assert.Equal(t, 79, live)
 }
+
+func memStore(t *testing.T) metastore.MetaStore {
+	db, err := metastore.Open("", &metastore.Options{Backend: metastore.Memory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func readWALFile(t *testing.T, fsys FS, name string) []byte {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeWALFile(t *testing.T, fsys FS, name string, data []byte) {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reopenWAL(t *testing.T, wal *WAL) []Entry {
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.OpenLastWALFile(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := wal.Reply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestWALTornTail(t *testing.T) {
+	for name, tail := range map[string]func(record []byte) []byte{
+		"partial header":  func(record []byte) []byte { return record[:5] },
+		"partial payload": func(record []byte) []byte { return record[:len(record)-3] },
+		"zeros":           func(record []byte) []byte { return make([]byte, len(record)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fsys := NewMemFS()
+			wal, err := NewWithFS(fsys, "/wal", memStore(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := wal.AddEntry(&Entry{Key: []byte{byte(i)}, Value: []byte("value"), Tombstoned: i == 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data := readWALFile(t, fsys, wal.WalFilename())
+			// the last record is torn by a crash
+			record := data[len(data)-(recordHeaderSize+1+1+1+1+5):]
+			writeWALFile(t, fsys, wal.WalFilename(), append(data[:len(data)-len(record)], tail(record)...))
+
+			entries := reopenWAL(t, wal)
+			assert.Len(t, entries, 2)
+			assert.Equal(t, []byte{1}, entries[1].Key)
+			assert.True(t, entries[1].Tombstoned)
+			size, err := wal.CheckFileSize()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(data)-len(record)), size)
+
+			// new entries follow the last intact one
+			assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{3}, Value: []byte("new")}))
+			entries = reopenWAL(t, wal)
+			assert.Len(t, entries, 3)
+			assert.Equal(t, []byte("new"), entries[2].Value)
+		})
+	}
+}
+
+func TestWALCorrupt(t *testing.T) {
+	fsys := NewMemFS()
+	wal, err := NewWithFS(fsys, "/wal", memStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := wal.AddEntry(&Entry{Key: []byte{byte(i)}, Value: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := readWALFile(t, fsys, wal.WalFilename())
+	recordSize := recordHeaderSize + 1 + 1 + 1 + 1 + 5
+	// damage the value of the second record
+	data[walHeaderSize+recordSize+recordHeaderSize+4] ^= 0xff
+	writeWALFile(t, fsys, wal.WalFilename(), data)
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.OpenLastWALFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = wal.Reply()
+	assert.ErrorIs(t, err, ErrCorrupt)
+	entries, size, err := wal.ScanFile(wal.WalFilename())
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, int64(walHeaderSize+recordSize), size)
+}
+
+func TestWALLegacyFormat(t *testing.T) {
+	fsys := NewMemFS()
+	db := memStore(t)
+	legacy := &bytes.Buffer{}
+	encoder := newAppendEncoder(legacy, 0, true)
+	for i := 0; i < 2; i++ {
+		if err := encoder.Encode(&Entry{Key: []byte{byte(i)}, Value: []byte("old")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a line torn by a crash
+	legacy.WriteString("AAAA#AA")
+	writeWALFile(t, fsys, "/wal/0.wal", legacy.Bytes())
+
+	wal, err := NewWithFS(fsys, "/wal", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := wal.Reply()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	// the replayed file is converted, so batches can follow
+	assert.Equal(t, walMagic, string(readWALFile(t, fsys, wal.WalFilename())[:len(walMagic)]))
+	assert.NoError(t, wal.AddBatch([]Entry{{Key: []byte{2}, Value: []byte("new")}}))
+	entries = reopenWAL(t, wal)
+	assert.Len(t, entries, 3)
+
+	output := make(chan string, 10)
+	_, err = wal.Dump(output, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Wait())
+	assert.Len(t, output, 3)
+	value, err := db.Get([]byte{2})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+}
+
+func TestWALBatch(t *testing.T) {
+	fsys := NewMemFS()
+	db := memStore(t)
+	wal, err := NewWithFS(fsys, "/wal", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := []Entry{
+		{Key: []byte("attrs"), Value: []byte("value")},
+		{Key: []byte("old name"), Value: []byte{}, Tombstoned: true, Dentry: true},
+		{Key: []byte("new name"), Value: []byte("inode"), Dentry: true},
+	}
+	single := &Entry{Key: []byte("single"), Value: []byte("value")}
+	assert.NoError(t, wal.AddEntry(single))
+	assert.NoError(t, wal.AddBatch(batch))
+	assert.Equal(t, uint64(2), batch[2].LSN)
+	entries := reopenWAL(t, wal)
+	assert.Equal(t, append([]Entry{*single}, batch...), entries)
+
+	// a torn batch is dropped as a whole
+	assert.NoError(t, wal.AddBatch(batch))
+	data := readWALFile(t, fsys, wal.WalFilename())
+	writeWALFile(t, fsys, wal.WalFilename(), data[:len(data)-4])
+	entries = reopenWAL(t, wal)
+	assert.Len(t, entries, 4)
+
+	// only attributes are dumped to the WAL database
+	output := make(chan string, 10)
+	_, err = wal.Dump(output, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Wait())
+	assert.Len(t, output, 2)
+	_, err = db.Get([]byte("new name"))
+	assert.ErrorIs(t, err, metastore.ErrNotFound)
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	fsys := NewMemFS()
+	db := memStore(t)
+	wal, err := NewWithFS(fsys, "/wal", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{byte(i)}, Value: []byte("value")}))
+	}
+	// a dump interrupted after the first two entries
+	assert.NoError(t, db.Put(CheckpointKey, utils.Uint64ToBytes(2)))
+	entries := reopenWAL(t, wal)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint64(3), entries[0].LSN)
+	entry := &Entry{Key: []byte{3}, Value: []byte("value")}
+	assert.NoError(t, wal.AddEntry(entry))
+	assert.Equal(t, uint64(4), entry.LSN)
+
+	output := make(chan string, 10)
+	_, err = wal.Dump(output, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Wait())
+	assert.Len(t, output, 2)
+	_, err = db.Get([]byte{0})
+	assert.ErrorIs(t, err, metastore.ErrNotFound)
+	checkpoint, err := wal.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), checkpoint)
+
+	// a dump for a snapshot holds back dumps of later files
+	snapshotDB := memStore(t)
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{4}, Value: []byte("value")}))
+	output = make(chan string, 10)
+	first, err := wal.Dump(output, snapshotDB)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{5}, Value: []byte("value")}))
+	_, err = wal.Dump(nil, nil)
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	checkpoint, _ = wal.Checkpoint()
+	assert.Equal(t, uint64(4), checkpoint)
+	assert.NoError(t, wal.DBDump(first, output, snapshotDB))
+	assert.NoError(t, wal.Wait())
+	checkpoint, _ = wal.Checkpoint()
+	assert.Equal(t, uint64(6), checkpoint)
+	checkpoint, err = ReadCheckpoint(snapshotDB)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), checkpoint)
+}
+
+func TestWALDumpClosesOutput(t *testing.T) {
+	wal, err := NewWithFS(NewMemFS(), "/wal", memStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	// nothing to rotate
+	output := make(chan string, 10)
+	_, err = wal.Dump(output, nil)
+	assert.NoError(t, err)
+	_, ok := <-output
+	assert.False(t, ok)
+
+	assert.NoError(t, wal.AddEntry(&Entry{Key: []byte{1}, Value: []byte("value")}))
+	output = make(chan string)
+	_, err = wal.Dump(output, nil)
+	assert.NoError(t, err)
+	keys := []string{}
+	for key := range output {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{string([]byte{1})}, keys)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+)
+
+// openOffline opens metadata stores of an unmounted filesystem
+func openOffline(inodePath string) (*fsdb.Fsdb, error) {
+	if _, err := os.Stat(inodePath); err != nil {
+		return nil, err
+	}
+	return fsdb.Open(&config.Config{
+		Path:            inodePath,
+		CacheSize:       *fCacheSize,
+		BloomFilterSize: *fBloomFilterSize,
+	})
+}
+
+// openReadOnly opens metadata stores of an unmounted filesystem without
+// changing them
+func openReadOnly(inodePath string) (*fsdb.Fsdb, error) {
+	return fsdb.OpenReadOnly(&config.Config{
+		Path:            inodePath,
+		CacheSize:       *fCacheSize,
+		BloomFilterSize: *fBloomFilterSize,
+	})
+}
+
+// runFsck checks metadata of an unmounted filesystem, exit code is 0 when no
+// problem is left, 1 when problems remain and 2 on failure
+func runFsck(args []string) int {
+	fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+	inodePath := fset.String("inode_path", *fInodePath, "Path to metadata store.")
+	repair := fset.Bool("repair", false, "Repair found problems.")
+	verbose := fset.Bool("v", false, "List attribute records left for garbage collection.")
+	fset.Parse(args)
+
+	db, err := openOffline(*inodePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		return 2
+	}
+	defer db.Close()
+	report, err := db.Fsck(*repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		return 2
+	}
+	for _, p := range report.Problems {
+		status := ""
+		if p.Repaired {
+			status = " (repaired)"
+		}
+		fmt.Printf("%-12s inode %d: %s%s\n", p.Kind, p.Inode, p.Message, status)
+	}
+	if *verbose {
+		for _, id := range report.Unreferenced {
+			fmt.Printf("%-12s inode %d: attributes without names\n", "unreferenced", id)
+		}
+	}
+	fmt.Printf("%d dentries, %d inodes, %d WAL entries, %d problems, %d unreferenced attribute records\n",
+		report.Dentries, report.Inodes, report.WALEntries, len(report.Problems), len(report.Unreferenced))
+	if !report.Clean() {
+		return 1
+	}
+	return 0
+}
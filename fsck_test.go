@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsckCommand(t *testing.T) {
+	file := fsdb.NewInode(11, fuseops.RootInodeID, "file", fsdb.InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 3, Mode: 0644},
+	})
+	p := newOfflineFS(t, file)
+	fsck := func(args ...string) (string, int) {
+		var code int
+		out := capture(t, func() {
+			code = runFsck(append([]string{"--inode_path", p}, args...))
+		})
+		return out, code
+	}
+
+	out, code := fsck()
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out, "inode 11:")
+	assert.Contains(t, out, " 1 problems,")
+	assert.NotContains(t, out, "(repaired)")
+
+	out, code = fsck("--repair")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "(repaired)")
+
+	out, code = fsck()
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, " 0 problems,")
+
+	_, code = fsck("--inode_path", p+"/missing")
+	assert.Equal(t, 2, code)
+	_, err := os.Stat(p + "/missing")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -13,6 +13,7 @@ require (
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/tidwall/btree v1.6.0
 	github.com/ztrue/tracerr v0.3.0
+	go.etcd.io/bbolt v1.3.7
 	go.uber.org/zap v1.24.0
 	golang.org/x/sync v0.2.0
 	google.golang.org/grpc v1.55.0
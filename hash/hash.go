@@ -1,6 +1,7 @@
 package hash
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/jacobsa/fuse/fuseops"
@@ -38,3 +39,45 @@ func (h *Hash) RLock(key fuseops.InodeID) {
 func (h *Hash) RUnlock(key fuseops.InodeID) {
 	h.hashMap[uint64(key)%h.size].RUnlock()
 }
+
+// LockPair locks two keys in a stable order, keys sharing a bucket are locked once
+func (h *Hash) LockPair(a, b fuseops.InodeID) {
+	h.LockSet(a, b)
+}
+
+// UnlockPair unlocks keys locked with LockPair
+func (h *Hash) UnlockPair(a, b fuseops.InodeID) {
+	h.UnlockSet(a, b)
+}
+
+// LockSet locks keys in a stable order, keys sharing a bucket are locked once
+func (h *Hash) LockSet(keys ...fuseops.InodeID) {
+	for _, bucket := range h.buckets(keys) {
+		h.hashMap[bucket].Lock()
+	}
+}
+
+// UnlockSet unlocks keys locked with LockSet
+func (h *Hash) UnlockSet(keys ...fuseops.InodeID) {
+	buckets := h.buckets(keys)
+	for i := len(buckets) - 1; i >= 0; i-- {
+		h.hashMap[buckets[i]].Unlock()
+	}
+}
+
+// buckets returns distinct buckets of keys in ascending order
+func (h *Hash) buckets(keys []fuseops.InodeID) []uint64 {
+	buckets := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		buckets = append(buckets, uint64(key)%h.size)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	n := 0
+	for i, bucket := range buckets {
+		if i == 0 || bucket != buckets[n-1] {
+			buckets[n] = bucket
+			n++
+		}
+	}
+	return buckets[:n]
+}
@@ -30,3 +30,48 @@ func TestHash(t *testing.T) {
 		}
 	}
 }
+
+func TestHashLockPair(t *testing.T) {
+	hash := New(10)
+	done := make(chan bool, 1)
+	go func() {
+		// 1 and 11 share a bucket, 12 and 3 are locked in reverse order
+		hash.LockPair(1, 11)
+		hash.UnlockPair(1, 11)
+		hash.LockPair(12, 3)
+		hash.UnlockPair(12, 3)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("TestHashLockPair deadlocked")
+	}
+}
+
+func TestHashLockSet(t *testing.T) {
+	hash := New(10)
+	done := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			for n := 0; n < 1000; n++ {
+				// the same buckets requested in a different order don't deadlock
+				if i == 0 {
+					hash.LockSet(7, 2, 12, 5)
+					hash.UnlockSet(7, 2, 12, 5)
+				} else {
+					hash.LockSet(5, 7, 2)
+					hash.UnlockSet(5, 7, 2)
+				}
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("TestHashLockSet deadlocked")
+		}
+	}
+}
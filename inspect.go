@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	msnapshot "github.com/radek-ryckowski/monofs/snapshot"
+)
+
+const inspectUsage = `usage: monofs inspect [--inode_path path] command [args]
+
+commands:
+  tree [path]   print the tree under path (default /)
+  inode <id>    print attributes and names of an inode
+  wal           list WAL files and their entry counts
+  snapshots     print snapshot names, hashes and copies
+`
+
+// runInspect prints metadata of an unmounted filesystem without changing it,
+// attributes logged in the WAL are shown as they will be once it is replayed
+func runInspect(args []string) int {
+	fset := flag.NewFlagSet("inspect", flag.ExitOnError)
+	inodePath := fset.String("inode_path", *fInodePath, "Path to metadata store.")
+	depth := fset.Int("depth", -1, "Maximum depth printed by tree, -1 is unlimited.")
+	fset.Usage = func() { fmt.Fprint(os.Stderr, inspectUsage) }
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return 2
+	}
+	db, err := openReadOnly(*inodePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect: %v\n", err)
+		return 2
+	}
+	defer db.Close()
+	cmdArgs := fset.Args()[1:]
+	switch fset.Arg(0) {
+	case "tree":
+		p := "/"
+		if len(cmdArgs) > 0 {
+			p = cmdArgs[0]
+		}
+		err = inspectTree(db, p, *depth)
+	case "inode":
+		if len(cmdArgs) != 1 {
+			fset.Usage()
+			return 2
+		}
+		err = inspectInode(db, cmdArgs[0])
+	case "wal":
+		err = inspectWAL(db, filepath.Join(*inodePath, "wal"))
+	case "snapshots":
+		err = inspectSnapshots(db)
+	default:
+		fset.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// lookupPath resolves a slash separated path from the root
+func lookupPath(db *fsdb.Fsdb, p string) (*fsdb.Inode, error) {
+	inode, err := db.GetInode(fuseops.RootInodeID-1, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("root: %w", err)
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		child, err := db.GetInode(inode.InodeID, name, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		inode = child
+	}
+	return inode, nil
+}
+
+func describe(inode *fsdb.Inode) string {
+	return fmt.Sprintf("[%d %v nlink=%d size=%d]", inode.InodeID, inode.Attrs.Mode, inode.Attrs.Nlink, inode.Attrs.Size)
+}
+
+func inspectTree(db *fsdb.Fsdb, p string, depth int) error {
+	inode, err := lookupPath(db, p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", p, describe(inode))
+	return printChildren(db, inode.InodeID, "  ", depth)
+}
+
+func printChildren(db *fsdb.Fsdb, parent uint64, indent string, depth int) error {
+	if depth == 0 {
+		return nil
+	}
+	after := ""
+	for {
+		children, err := db.GetChildren(parent, after, 1024)
+		if err != nil {
+			return err
+		}
+		if len(children) == 0 {
+			return nil
+		}
+		for _, child := range children {
+			fmt.Printf("%s%s %s\n", indent, child.Name, describe(child))
+			if child.Attrs.Mode.IsDir() {
+				if err := printChildren(db, child.InodeID, indent+"  ", depth-1); err != nil {
+					return err
+				}
+			}
+		}
+		after = children[len(children)-1].Name
+	}
+}
+
+func inspectInode(db *fsdb.Fsdb, arg string) error {
+	id, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return err
+	}
+	attrs, err := db.GetFsdbInodeAttributes(id)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(attrs, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("inode %d\n%s\n", id, buf)
+	names, err := db.FindNames(id)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		fmt.Printf("dentry %d:%q\n", n.ParentID, n.Name)
+	}
+	orphans, err := db.GetOrphans()
+	if err != nil {
+		return err
+	}
+	for _, o := range orphans {
+		if o == id {
+			fmt.Println("orphan: open but unlinked")
+		}
+	}
+	if attrs.Mode.IsDir() {
+		children, err := db.GetChildrenCount(id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("children %d\n", children)
+	}
+	return nil
+}
+
+func inspectWAL(db *fsdb.Fsdb, dir string) error {
+	files, err := wal.ListFiles(wal.OS, dir)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := db.WALCheckpoint()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("checkpoint lsn=%d\n", checkpoint)
+	for i, name := range files {
+		fileSize, err := wal.OS.Size(name)
+		if err != nil {
+			return err
+		}
+		entries, size, serr := wal.ScanFile(name)
+		tombstones := 0
+		for _, e := range entries {
+			if e.Tombstoned {
+				tombstones++
+			}
+		}
+		status := ""
+		// the newest file was written to when the filesystem was unmounted
+		if i == len(files)-1 {
+			status = " current"
+		}
+		if serr != nil {
+			status += fmt.Sprintf(" damaged at byte %d: %v", size, serr)
+		}
+		fmt.Printf("%s size=%d entries=%d tombstones=%d%s\n", filepath.Base(name), fileSize, len(entries), tombstones, status)
+	}
+	return nil
+}
+
+func inspectSnapshots(db *fsdb.Fsdb) error {
+	current, err := db.Snapshot.CurrentHash()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("current %s\n", current)
+	names, err := db.Snapshot.Names()
+	if err != nil {
+		return err
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	base := filepath.Join(db.Snapshot.SnapshotPath, msnapshot.SnapshostsDataPath)
+	for _, name := range sorted {
+		hash := names[name]
+		copyStatus := "no copy"
+		if _, err := os.Stat(filepath.Join(base, hash)); err == nil {
+			copyStatus = "copy present"
+		}
+		fmt.Printf("%s %s %s\n", name, hash, copyStatus)
+	}
+	return nil
+}
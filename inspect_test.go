@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOfflineFS returns the path of an unmounted filesystem holding inodes,
+// their attributes are only in the WAL
+func newOfflineFS(t *testing.T, inodes ...*fsdb.Inode) string {
+	t.Helper()
+	os.Setenv("MONOFS_DEV_RUN", "testing")
+	p := t.TempDir()
+	db, err := fsdb.New(&config.Config{
+		Path:           p,
+		FilesystemName: "test",
+		CacheSize:      10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := fsdb.NewInode(fuseops.RootInodeID, fuseops.RootInodeID-1, "", fsdb.InodeAttributes{
+		InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+	})
+	if err := db.AddInode(root, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, inode := range inodes {
+		if err := db.AddInode(inode, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// capture returns what fn prints to stdout
+func capture(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		out <- buf
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	fn()
+	w.Close()
+	return string(<-out)
+}
+
+// readTree returns contents of files under dir
+func readTree(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := os.ReadFile(name)
+		files[name] = buf
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestInspect(t *testing.T) {
+	p := newOfflineFS(t,
+		fsdb.NewInode(10, fuseops.RootInodeID, "dir", fsdb.InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 2, Mode: 0755 | os.ModeDir},
+		}),
+		fsdb.NewInode(11, 10, "file", fsdb.InodeAttributes{
+			InodeAttributes: fuseops.InodeAttributes{Nlink: 1, Mode: 0644, Size: 42},
+		}),
+	)
+	stored := readTree(t, p)
+	inspect := func(args ...string) (string, int) {
+		var code int
+		out := capture(t, func() {
+			code = runInspect(append([]string{"--inode_path", p}, args...))
+		})
+		return out, code
+	}
+
+	// attributes only in the WAL are shown without replaying it
+	out, code := inspect("tree")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "dir [10 ")
+	assert.Contains(t, out, "file [11 -rw-r--r-- nlink=1 size=42]")
+	out, code = inspect("tree", "/dir")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "/dir [10 ")
+	assert.NotContains(t, out, "  dir ")
+
+	out, code = inspect("inode", "11")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "inode 11\n")
+	assert.Contains(t, out, "dentry 10:\"file\"\n")
+
+	out, code = inspect("wal")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "checkpoint lsn=0\n")
+	assert.Contains(t, out, "entries=6 tombstones=0 current\n")
+
+	out, code = inspect("snapshots")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "current ")
+
+	_, code = inspect("inode")
+	assert.Equal(t, 2, code)
+	_, code = inspect("inode", "99")
+	assert.Equal(t, 1, code)
+
+	// nothing was replayed, dumped or rewritten
+	assert.Equal(t, stored, readTree(t, p))
+	db, err := fsdb.OpenReadOnly(&config.Config{Path: p, CacheSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkpoint, err := db.WALCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), checkpoint)
+}
+
+func TestInspectMissing(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "missing")
+	var code int
+	capture(t, func() {
+		code = runInspect([]string{"--inode_path", p, "tree"})
+	})
+	assert.Equal(t, 2, code)
+	_, err := os.Stat(p)
+	assert.True(t, os.IsNotExist(err))
+}
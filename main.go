@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"path"
 	"runtime/debug"
 	"time"
 
 	"github.com/jacobsa/fuse"
+	"github.com/radek-ryckowski/monofs/fs/atime"
 	"github.com/radek-ryckowski/monofs/fs/config"
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/radek-ryckowski/monofs/fs/monocache"
+	"github.com/radek-ryckowski/monofs/fs/wal"
 	monostat "github.com/radek-ryckowski/monofs/monoclient/stat"
 	monostatserver "github.com/radek-ryckowski/monofs/monoserver/stat"
 	"github.com/radek-ryckowski/monofs/worker"
@@ -20,16 +25,36 @@ import (
 var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
 var fInodePath = flag.String("inode_path", "/tmp/monofs", "Path to metadata store.")
 var fReadOnly = flag.Bool("read_only", false, "Mount in read-only mode.")
+var fSnapshot = flag.String("snapshot", "", "Mount the named snapshot of the filesystem in inode_path read-only instead of its head, the head may stay mounted. Files show the data they had when the snapshot was copied, the head copies data of earlier snapshots before writing it")
 var fStatServerAddress = flag.String("statAddress", "", "Address of stat backend server.")
 var fCertDir = flag.String("cert_dir", "", "Certificate directory")
 var fDev = flag.Bool("dev", false, "Run in development mode")
 var fFuseDebug = flag.Bool("fuse_debug", false, "Run in fuse debug mode")
 var fManagerPort = flag.String("manager_port", ":50052", "Manager port")
 var fCacheSize = flag.Int("cache_size", 100, "Cache size") //was 10000
+var fCacheBytes = flag.Int64("cache_bytes", 0, "Budget of cached attribute data in bytes, 0 bounds the cache by cache_size only")
+var fCachePolicy = flag.String("cache_policy", monocache.PolicyLRU, "Attribute cache eviction policy: lru, arc or 2q")
 var fShutdownTimeout = flag.Duration("shutdown_timeout", 60*time.Second, "Shutdown timeout")
 var fFilesystemName = flag.String("filesystem_name", "monofs#head", "Filesystem name")
 var fBloomFilterSize = flag.Int("bloom_filter_size", 10000, "Bloom filter size")
 var fLocalDataPath = flag.String("local_data_path", "", "Local data path")
+var fAtime = flag.String("atime", "relatime", "Access time policy: noatime, relatime or strictatime")
+var fAtimeFlushInterval = flag.Duration("atime_flush_interval", atime.DefaultFlushInterval, "How often access times are persisted")
+var fAttrCacheTTL = flag.Duration("attr_cache_ttl", time.Second, "How long the kernel caches inode attributes")
+var fEntryCacheTTL = flag.Duration("entry_cache_ttl", time.Second, "How long the kernel caches name lookups")
+var fNegativeEntryCacheTTL = flag.Duration("negative_entry_cache_ttl", 0, "How long the kernel caches failed name lookups")
+var fDentryCacheSize = flag.Int("dentry_cache_size", fsdb.DefaultDentryCacheSize, "How many name lookups are cached, 0 disables the cache")
+var fDentryCacheTTL = flag.Duration("dentry_cache_ttl", fsdb.DefaultDentryCacheTTL, "How long a found name is cached")
+var fNegativeDentryCacheTTL = flag.Duration("negative_dentry_cache_ttl", fsdb.DefaultNegativeDentryCacheTTL, "How long a missing name is cached, 0 disables negative entries")
+var fGCInterval = flag.Duration("gc_interval", fsdb.DefaultGCInterval, "How often unreferenced metadata and data files are collected, 0 disables it")
+var fGCGracePeriod = flag.Duration("gc_grace_period", fsdb.DefaultGCGracePeriod, "How long an item stays unreferenced before it is collected")
+var fMetaBackend = flag.String("meta_backend", "", "Metadata store backend: leveldb or bolt, empty keeps the backend of an existing store and uses leveldb for new ones")
+var fWALSync = flag.String("wal_sync", wal.SyncInterval, "When WAL files are synced: none, interval or always, always shares a sync between concurrent operations")
+var fWALSyncInterval = flag.Duration("wal_sync_interval", wal.DefaultSyncInterval, "How often WAL files are synced with --wal_sync=interval")
+var fWALSegmentSize = flag.Int64("wal_segment_size", wal.DefaultSegmentSize, "Size in bytes after which a new WAL file is started and the previous one is written to the attribute store, negative disables it")
+var fWALSegmentAge = flag.Duration("wal_segment_age", wal.DefaultSegmentAge, "How old entries of a WAL file get before a new one is started, negative disables it")
+var fWALMaxPendingFiles = flag.Int("wal_max_pending_files", wal.DefaultMaxPendingFiles, "How many rotated WAL files may wait to be written to the attribute store before writers are throttled, negative disables it")
+var fFsckRepair = flag.Bool("fsck_repair", false, "Repair problems found by the consistency check after a metadata failure instead of refusing to mount")
 
 func version() string {
 	var (
@@ -64,6 +89,16 @@ func getFreePort() (int, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(runFsck(os.Args[2:]))
+		case "inspect":
+			os.Exit(runInspect(os.Args[2:]))
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		}
+	}
 	flag.Parse()
 	logger, err := zap.NewProduction()
 	if *fDev {
@@ -97,6 +132,10 @@ func main() {
 			log.Fatalf("You must set --address.")
 		}
 	}
+	// snapshots are never written
+	if *fSnapshot != "" {
+		*fReadOnly = true
+	}
 	fuseCfg := &fuse.MountConfig{
 		ReadOnly:    *fReadOnly,
 		ErrorLogger: zap.NewStdLog(sugarlog.Desugar()),
@@ -112,24 +151,49 @@ func main() {
 		log.Fatalf("Stat connection : %v", err)
 	}
 
+	atimePolicy, err := atime.ParsePolicy(*fAtime)
+	if err != nil {
+		log.Fatalf("--atime: %v", err)
+	}
+
 	localDataPath := *fLocalDataPath
 	if localDataPath == "" {
 		localDataPath = path.Join(*fInodePath, "localDataPath")
 	}
 	// TODO  add possibility to read config from file instead from flags
 	worker, err := worker.New(&config.Config{
-		Path:            *fInodePath,
-		FilesystemName:  *fFilesystemName,
-		StatClient:      monostat.New(conn),
-		FuseCfg:         fuseCfg,
-		Mountpoint:      *fMountPoint,
-		DebugMode:       *fDev,
-		ReadOnly:        *fReadOnly,
-		ShutdownTimeout: *fShutdownTimeout,
-		CacheSize:       *fCacheSize,
-		ManagerPort:     *fManagerPort,
-		BloomFilterSize: *fBloomFilterSize,
-		LocalDataPath:   localDataPath,
+		Path:                   *fInodePath,
+		FilesystemName:         *fFilesystemName,
+		StatClient:             monostat.New(conn),
+		FuseCfg:                fuseCfg,
+		Mountpoint:             *fMountPoint,
+		DebugMode:              *fDev,
+		ReadOnly:               *fReadOnly,
+		ShutdownTimeout:        *fShutdownTimeout,
+		CacheSize:              *fCacheSize,
+		CacheBytes:             *fCacheBytes,
+		CachePolicy:            *fCachePolicy,
+		ManagerPort:            *fManagerPort,
+		BloomFilterSize:        *fBloomFilterSize,
+		LocalDataPath:          localDataPath,
+		AtimePolicy:            atimePolicy,
+		AtimeFlushInterval:     *fAtimeFlushInterval,
+		AttrCacheTTL:           *fAttrCacheTTL,
+		EntryCacheTTL:          *fEntryCacheTTL,
+		NegativeEntryCacheTTL:  *fNegativeEntryCacheTTL,
+		DentryCacheSize:        *fDentryCacheSize,
+		DentryCacheTTL:         *fDentryCacheTTL,
+		NegativeDentryCacheTTL: *fNegativeDentryCacheTTL,
+		GCInterval:             *fGCInterval,
+		GCGracePeriod:          *fGCGracePeriod,
+		FsckRepair:             *fFsckRepair,
+		WALSync:                *fWALSync,
+		WALSyncInterval:        *fWALSyncInterval,
+		WALSegmentSize:         *fWALSegmentSize,
+		WALSegmentAge:          *fWALSegmentAge,
+		WALMaxPendingFiles:     *fWALMaxPendingFiles,
+		MetaBackend:            *fMetaBackend,
+		Snapshot:               *fSnapshot,
 	}, sugarlog)
 	if err != nil {
 		log.Fatalf("makeFS: %v", err)
@@ -4,23 +4,14 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"sync"
-	"time"
 
+	"github.com/radek-ryckowski/monofs/fs/fsdb"
+	"github.com/radek-ryckowski/monofs/fs/wal"
 	pb "github.com/radek-ryckowski/monofs/proto"
 	"github.com/radek-ryckowski/monofs/snapshot"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// SnapshotResults is a struct with snapshot results
-type SnapshotResult struct {
-	Name    string
-	Id      string
-	Err     error
-	Created time.Time
-	Status  string
-}
-
 // SnapshotInput is a struct with snapshot input
 type SnapshotInput struct {
 	Name string
@@ -31,19 +22,19 @@ type SnapshotInput struct {
 type Manager struct {
 	pb.UnimplementedMonofsManagerServer
 	s         *snapshot.Snapshot
-	results   map[uint64]SnapshotResult
 	stopChan  chan bool
 	snapInput chan SnapshotInput
-	mu        sync.RWMutex
 	fsName    string
 	Port      string
+	gc        *fsdb.GC
+	wal       *wal.WAL
+	db        *fsdb.Fsdb
 }
 
 // New returns a new Manager.
 func New(fsName string, s *snapshot.Snapshot, port string) *Manager {
 	return &Manager{
 		s:         s,
-		results:   map[uint64]SnapshotResult{},
 		snapInput: make(chan SnapshotInput),
 		stopChan:  make(chan bool),
 		fsName:    fsName,
@@ -59,19 +50,8 @@ func (m *Manager) Start() {
 			case <-m.stopChan:
 				return
 			case input := <-m.snapInput:
-				sr := SnapshotResult{
-					Name:    input.Name,
-					Created: time.Now(),
-				}
-				hash, err := m.s.CreateSyncSnapshot(input.Name)
-				if err != nil {
-					sr.Err = err
-				}
-				sr.Id = hash
-				sr.Status = "done"
-				m.mu.Lock()
-				m.results[input.Id] = sr
-				m.mu.Unlock()
+				// the result is recorded in the snapshot metadata
+				m.s.CreateSyncSnapshot(input.Name)
 			}
 		}
 	}()
@@ -82,52 +62,216 @@ func (m *Manager) CreateSnapshot(ctx context.Context, in *pb.CreateSnapshotReque
 	if in.Name == "" || strings.EqualFold(in.Name, m.fsName) {
 		return nil, fmt.Errorf("wrong fs name")
 	}
-	m.mu.Lock()
-	id := uint64(len(m.results))
-	m.results[id] = SnapshotResult{
-		Name:   in.Name,
-		Status: "in progress",
+	md, err := m.s.Reserve(in.Name)
+	if err != nil {
+		return nil, err
 	}
-	m.mu.Unlock()
-	m.snapInput <- SnapshotInput{
-		Name: in.Name,
-		Id:   id,
+	// a request nobody takes must not keep the name reserved
+	select {
+	case m.snapInput <- SnapshotInput{Name: in.Name, Id: md.ID}:
+	case <-ctx.Done():
+		m.s.Cancel(md, ctx.Err())
+		return nil, ctx.Err()
+	case <-m.stopChan:
+		err := fmt.Errorf("manager stopped")
+		m.s.Cancel(md, err)
+		return nil, err
 	}
 	return &pb.CreateSnapshotResponse{
-		CreationId: id,
+		CreationId: md.ID,
 	}, nil
 
 }
 
-// GetSnapshot is a RPC for getting snapshot.
+// GetSnapshot is a RPC for getting snapshot by name, or by creation id when
+// the name is empty.
 func (m *Manager) GetSnapshot(ctx context.Context, in *pb.GetSnapshotRequest) (*pb.GetSnapshotResponse, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	sr, ok := m.results[in.CreationId]
-	if !ok {
-		return nil, fmt.Errorf("snapshot with id %d not found", in.CreationId)
+	var md *snapshot.Metadata
+	var err error
+	if in.Name != "" {
+		md, err = m.s.GetSnapshot(in.Name)
+	} else {
+		md, err = m.s.GetSnapshotByID(in.CreationId)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return &pb.GetSnapshotResponse{
-		Name:    sr.Name,
-		Id:      sr.Id,
-		Created: timestamppb.New(sr.Created),
-		Status:  sr.Status,
+		Id:         md.Hash,
+		Fs:         md.FS,
+		Name:       md.Name,
+		Created:    created(md),
+		Status:     md.Status,
+		CreationId: md.ID,
+		Size:       md.Size,
+		Parent:     md.Parent,
+		Error:      md.Error,
 	}, nil
 }
 
-// DeleteSnapshot is a RPC for deleting snapshot.
+// created returns creation time of a snapshot, unknown for snapshots
+// created by older versions
+func created(md *snapshot.Metadata) *timestamppb.Timestamp {
+	if md.Created.IsZero() {
+		return nil
+	}
+	return timestamppb.New(md.Created)
+}
+
+// DeleteSnapshot is a RPC for deleting snapshot, id is its name or hash. Data
+// files only the snapshot referenced are released when the GC is set.
 func (m *Manager) DeleteSnapshot(ctx context.Context, in *pb.DeleteSnapshotRequest) (*pb.DeleteSnapshotResponse, error) {
+	name, err := m.snapshotName(in.Id)
+	if err != nil {
+		return nil, err
+	}
+	if m.gc != nil {
+		_, err = m.gc.DeleteSnapshot(ctx, name)
+	} else {
+		err = m.s.DeleteSnapshot(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DeleteSnapshotResponse{
+		Id:     in.Id,
+		Fs:     m.fsName,
+		Status: "deleted",
+	}, nil
+}
 
-	return nil, fmt.Errorf("not implemented")
+// snapshotName returns name of the snapshot with name or hash id
+func (m *Manager) snapshotName(id string) (string, error) {
+	names, err := m.s.Names()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := names[id]; ok {
+		return id, nil
+	}
+	for name, hash := range names {
+		if hash == id {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", snapshot.ErrSnapshotNotFound, id)
 }
 
 // ListSnapshots is a RPC for listing stream of snapshots.
 func (m *Manager) ListSnapshots(in *pb.Empty, stream pb.MonofsManager_ListSnapshotsServer) error {
+	list, err := m.s.ListSnapshots(stream.Context())
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		md := &list[i]
+		if err := stream.Send(&pb.ListSnapshotsResponse{
+			Id:         md.Hash,
+			Fs:         md.FS,
+			Name:       md.Name,
+			Created:    created(md),
+			Status:     md.Status,
+			CreationId: md.ID,
+			Size:       md.Size,
+			Parent:     md.Parent,
+			Error:      md.Error,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetGC sets garbage collector run by GarbageCollect RPC.
+func (m *Manager) SetGC(gc *fsdb.GC) {
+	m.gc = gc
+}
 
-	return fmt.Errorf("not implemented")
+// GarbageCollect is a RPC for running garbage collector, dry run only reports unreferenced items.
+func (m *Manager) GarbageCollect(ctx context.Context, in *pb.GarbageCollectRequest) (*pb.GarbageCollectResponse, error) {
+	if m.gc == nil {
+		return nil, fmt.Errorf("garbage collector not configured")
+	}
+	report, err := m.gc.Collect(in.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GarbageCollectResponse{
+		Attrs:       report.Attrs,
+		DataFiles:   report.DataFiles,
+		Pending:     uint32(report.Pending),
+		DryRun:      report.DryRun,
+		DataSkipped: report.DataSkipped,
+		Started:     timestamppb.New(report.Started),
+	}, nil
+}
+
+// SetWAL sets WAL reported by Status RPC.
+func (m *Manager) SetWAL(w *wal.WAL) {
+	m.wal = w
+}
+
+// Status is a RPC for reporting health of the fs, it is degraded while WAL
+// files can't be written to the attribute store.
+func (m *Manager) Status(ctx context.Context, in *pb.StatusRequest) (*pb.StatusResponse, error) {
+	if m.wal == nil {
+		return nil, fmt.Errorf("WAL not configured")
+	}
+	status := m.wal.Status()
+	resp := &pb.StatusResponse{
+		Fs:              m.fsName,
+		Degraded:        status.Degraded,
+		PendingWalFiles: uint32(status.PendingFiles),
+		WalDumpFailures: uint32(status.Failures),
+	}
+	if status.Err != nil {
+		resp.Error = status.Err.Error()
+	}
+	return resp, nil
+}
+
+// SetFsdb sets metadata compared by DiffSnapshots RPC.
+func (m *Manager) SetFsdb(db *fsdb.Fsdb) {
+	m.db = db
+}
+
+// DiffSnapshots is a RPC streaming paths changed between two snapshots, or a
+// snapshot and head when to is empty, in path order.
+func (m *Manager) DiffSnapshots(in *pb.DiffSnapshotsRequest, stream pb.MonofsManager_DiffSnapshotsServer) error {
+	if m.db == nil {
+		return fmt.Errorf("metadata not configured")
+	}
+	return m.db.DiffSnapshots(in.From, in.To, func(e *fsdb.DiffEntry) error {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		return stream.Send(&pb.DiffSnapshotsResponse{
+			Kind:    e.Kind,
+			Inode:   e.Inode,
+			OldPath: e.OldPath,
+			NewPath: e.NewPath,
+			Old:     diffAttributes(e.Old),
+			New:     diffAttributes(e.New),
+		})
+	})
+}
+
+// diffAttributes converts attributes of a diff entry, nil stays nil
+func diffAttributes(a *fsdb.InodeAttributes) *pb.DiffAttributes {
+	if a == nil {
+		return nil
+	}
+	return &pb.DiffAttributes{
+		Hash:  a.Hash,
+		Size:  a.Size,
+		Mode:  uint32(a.Mode),
+		Uid:   a.Uid,
+		Gid:   a.Gid,
+		Mtime: timestamppb.New(a.Mtime),
+	}
 }
 
-// Stop stops the manager.
+// Stop stops the manager, pending snapshot requests are cancelled.
 func (m *Manager) Stop() {
-	m.stopChan <- true
+	close(m.stopChan)
 }
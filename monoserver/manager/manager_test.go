@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	pb "github.com/radek-ryckowski/monofs/proto"
+	"github.com/radek-ryckowski/monofs/snapshot"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	dir := t.TempDir()
+	inodeDB, err := metastore.Open(path.Join(dir, "inodes"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inodeDB.Close() })
+	attrDB, err := metastore.Open(path.Join(dir, "attrs"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { attrDB.Close() })
+	w, err := wal.NewWithFS(wal.NewMemFS(), "/wal", attrDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	s, err := snapshot.New(path.Join(dir, "snapshots"), inodeDB, attrDB, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return New("test", s, "")
+}
+
+func TestCreateSnapshotCancelled(t *testing.T) {
+	m := newTestManager(t)
+	// nobody takes the request before the manager is started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := m.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Name: "first"})
+	assert.ErrorIs(t, err, context.Canceled)
+	md, err := m.s.GetSnapshot("first")
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot.StatusFailed, md.Status)
+
+	m.Stop()
+	_, err = m.CreateSnapshot(context.Background(), &pb.CreateSnapshotRequest{Name: "first"})
+	assert.Error(t, err)
+	// the name is not held by the cancelled requests
+	_, err = m.s.Reserve("first")
+	assert.NoError(t, err)
+}
@@ -8,10 +8,10 @@ package proto
 
 import (
 	context "context"
-	empty "github.com/golang/protobuf/ptypes/empty"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 // This is a compile-time assertion to ensure that this generated file
@@ -223,9 +223,12 @@ var MonofsProxy_ServiceDesc = grpc.ServiceDesc{
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MonofsManagerClient interface {
 	CreateSnapshot(ctx context.Context, in *CreateSnapshotRequest, opts ...grpc.CallOption) (*CreateSnapshotResponse, error)
-	ListSnapshots(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (MonofsManager_ListSnapshotsClient, error)
+	ListSnapshots(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (MonofsManager_ListSnapshotsClient, error)
 	DeleteSnapshot(ctx context.Context, in *DeleteSnapshotRequest, opts ...grpc.CallOption) (*DeleteSnapshotResponse, error)
 	GetSnapshot(ctx context.Context, in *GetSnapshotRequest, opts ...grpc.CallOption) (*GetSnapshotResponse, error)
+	GarbageCollect(ctx context.Context, in *GarbageCollectRequest, opts ...grpc.CallOption) (*GarbageCollectResponse, error)
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	DiffSnapshots(ctx context.Context, in *DiffSnapshotsRequest, opts ...grpc.CallOption) (MonofsManager_DiffSnapshotsClient, error)
 }
 
 type monofsManagerClient struct {
@@ -245,7 +248,7 @@ func (c *monofsManagerClient) CreateSnapshot(ctx context.Context, in *CreateSnap
 	return out, nil
 }
 
-func (c *monofsManagerClient) ListSnapshots(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (MonofsManager_ListSnapshotsClient, error) {
+func (c *monofsManagerClient) ListSnapshots(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (MonofsManager_ListSnapshotsClient, error) {
 	stream, err := c.cc.NewStream(ctx, &MonofsManager_ServiceDesc.Streams[0], "/proto.MonofsManager/ListSnapshots", opts...)
 	if err != nil {
 		return nil, err
@@ -295,14 +298,67 @@ func (c *monofsManagerClient) GetSnapshot(ctx context.Context, in *GetSnapshotRe
 	return out, nil
 }
 
+func (c *monofsManagerClient) GarbageCollect(ctx context.Context, in *GarbageCollectRequest, opts ...grpc.CallOption) (*GarbageCollectResponse, error) {
+	out := new(GarbageCollectResponse)
+	err := c.cc.Invoke(ctx, "/proto.MonofsManager/GarbageCollect", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monofsManagerClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, "/proto.MonofsManager/Status", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monofsManagerClient) DiffSnapshots(ctx context.Context, in *DiffSnapshotsRequest, opts ...grpc.CallOption) (MonofsManager_DiffSnapshotsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MonofsManager_ServiceDesc.Streams[1], "/proto.MonofsManager/DiffSnapshots", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &monofsManagerDiffSnapshotsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MonofsManager_DiffSnapshotsClient interface {
+	Recv() (*DiffSnapshotsResponse, error)
+	grpc.ClientStream
+}
+
+type monofsManagerDiffSnapshotsClient struct {
+	grpc.ClientStream
+}
+
+func (x *monofsManagerDiffSnapshotsClient) Recv() (*DiffSnapshotsResponse, error) {
+	m := new(DiffSnapshotsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MonofsManagerServer is the server API for MonofsManager service.
 // All implementations must embed UnimplementedMonofsManagerServer
 // for forward compatibility
 type MonofsManagerServer interface {
 	CreateSnapshot(context.Context, *CreateSnapshotRequest) (*CreateSnapshotResponse, error)
-	ListSnapshots(*empty.Empty, MonofsManager_ListSnapshotsServer) error
+	ListSnapshots(*emptypb.Empty, MonofsManager_ListSnapshotsServer) error
 	DeleteSnapshot(context.Context, *DeleteSnapshotRequest) (*DeleteSnapshotResponse, error)
 	GetSnapshot(context.Context, *GetSnapshotRequest) (*GetSnapshotResponse, error)
+	GarbageCollect(context.Context, *GarbageCollectRequest) (*GarbageCollectResponse, error)
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	DiffSnapshots(*DiffSnapshotsRequest, MonofsManager_DiffSnapshotsServer) error
 	mustEmbedUnimplementedMonofsManagerServer()
 }
 
@@ -313,7 +369,7 @@ type UnimplementedMonofsManagerServer struct {
 func (UnimplementedMonofsManagerServer) CreateSnapshot(context.Context, *CreateSnapshotRequest) (*CreateSnapshotResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CreateSnapshot not implemented")
 }
-func (UnimplementedMonofsManagerServer) ListSnapshots(*empty.Empty, MonofsManager_ListSnapshotsServer) error {
+func (UnimplementedMonofsManagerServer) ListSnapshots(*emptypb.Empty, MonofsManager_ListSnapshotsServer) error {
 	return status.Errorf(codes.Unimplemented, "method ListSnapshots not implemented")
 }
 func (UnimplementedMonofsManagerServer) DeleteSnapshot(context.Context, *DeleteSnapshotRequest) (*DeleteSnapshotResponse, error) {
@@ -322,6 +378,15 @@ func (UnimplementedMonofsManagerServer) DeleteSnapshot(context.Context, *DeleteS
 func (UnimplementedMonofsManagerServer) GetSnapshot(context.Context, *GetSnapshotRequest) (*GetSnapshotResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetSnapshot not implemented")
 }
+func (UnimplementedMonofsManagerServer) GarbageCollect(context.Context, *GarbageCollectRequest) (*GarbageCollectResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GarbageCollect not implemented")
+}
+func (UnimplementedMonofsManagerServer) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
+func (UnimplementedMonofsManagerServer) DiffSnapshots(*DiffSnapshotsRequest, MonofsManager_DiffSnapshotsServer) error {
+	return status.Errorf(codes.Unimplemented, "method DiffSnapshots not implemented")
+}
 func (UnimplementedMonofsManagerServer) mustEmbedUnimplementedMonofsManagerServer() {}
 
 // UnsafeMonofsManagerServer may be embedded to opt out of forward compatibility for this service.
@@ -354,7 +419,7 @@ func _MonofsManager_CreateSnapshot_Handler(srv interface{}, ctx context.Context,
 }
 
 func _MonofsManager_ListSnapshots_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(empty.Empty)
+	m := new(emptypb.Empty)
 	if err := stream.RecvMsg(m); err != nil {
 		return err
 	}
@@ -410,6 +475,63 @@ func _MonofsManager_GetSnapshot_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MonofsManager_GarbageCollect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GarbageCollectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonofsManagerServer).GarbageCollect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.MonofsManager/GarbageCollect",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonofsManagerServer).GarbageCollect(ctx, req.(*GarbageCollectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonofsManager_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonofsManagerServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.MonofsManager/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonofsManagerServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonofsManager_DiffSnapshots_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DiffSnapshotsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MonofsManagerServer).DiffSnapshots(m, &monofsManagerDiffSnapshotsServer{stream})
+}
+
+type MonofsManager_DiffSnapshotsServer interface {
+	Send(*DiffSnapshotsResponse) error
+	grpc.ServerStream
+}
+
+type monofsManagerDiffSnapshotsServer struct {
+	grpc.ServerStream
+}
+
+func (x *monofsManagerDiffSnapshotsServer) Send(m *DiffSnapshotsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // MonofsManager_ServiceDesc is the grpc.ServiceDesc for MonofsManager service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -429,6 +551,14 @@ var MonofsManager_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetSnapshot",
 			Handler:    _MonofsManager_GetSnapshot_Handler,
 		},
+		{
+			MethodName: "GarbageCollect",
+			Handler:    _MonofsManager_GarbageCollect_Handler,
+		},
+		{
+			MethodName: "Status",
+			Handler:    _MonofsManager_Status_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -436,6 +566,11 @@ var MonofsManager_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _MonofsManager_ListSnapshots_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "DiffSnapshots",
+			Handler:       _MonofsManager_DiffSnapshots_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "proto/monoserver.proto",
 }
@@ -0,0 +1,50 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// copyLockName is the file in a copy directory locked while the copies are served
+const copyLockName = "mount.lock"
+
+// ErrSnapshotMounted is returned when copies of a served snapshot are deleted
+var ErrSnapshotMounted = errors.New("snapshot is mounted")
+
+// LockCopy holds the copies in dir while they are served, DeleteSnapshot
+// refuses to remove them until the returned file is closed
+func LockCopy(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, copyLockName), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("copies in %s are being deleted: %w", dir, err)
+	}
+	return f, nil
+}
+
+// lockCopyForDelete locks the copies in dir unless they are served, the lock
+// is held until the returned file is closed. Nothing is locked when dir is
+// missing.
+func lockCopyForDelete(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, copyLockName), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrSnapshotMounted
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,300 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/utils"
+)
+
+const (
+	// StatusInProgress snapshot requested but not created yet
+	StatusInProgress = "in progress"
+	// StatusCurrent the sync snapshot changes are made under
+	StatusCurrent = "current"
+	// StatusDone snapshot whose copies of the stores are written
+	StatusDone = "done"
+	// StatusFailed snapshot which couldn't be created
+	StatusFailed = "failed"
+
+	// internalPrefix starts keys of the snapshot db which aren't names
+	internalPrefix = "\x00"
+	// metadataPrefix followed by the hash of a snapshot keeps its metadata
+	metadataPrefix = internalPrefix + "meta/"
+	// nextIDKey keeps the next creation id
+	nextIDKey = internalPrefix + "next_id"
+)
+
+// Metadata describes a snapshot
+type Metadata struct {
+	// ID creation id, zero for snapshots created by older versions
+	ID   uint64 `json:"id"`
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	FS   string `json:"fs"`
+	// Created when the snapshot was requested
+	Created time.Time `json:"created"`
+	Status  string    `json:"status"`
+	// Error why a failed snapshot couldn't be created
+	Error string `json:"error,omitempty"`
+	// Size bytes taken by copies of the stores, known once the snapshot is done
+	Size int64 `json:"size"`
+	// Parent hash of the snapshot current when this one was created
+	Parent string `json:"parent"`
+}
+
+// hashName returns hash of snapshot name
+func hashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("%x", sum)
+}
+
+// internalKey reports whether key of the snapshot db isn't a snapshot name
+func internalKey(key []byte) bool {
+	return string(key) == CurrentSnapshotName || bytes.HasPrefix(key, []byte(internalPrefix))
+}
+
+func (s *Snapshot) putMetadata(md *Metadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(metadataPrefix+md.Hash), data)
+}
+
+// metadata returns metadata stored for hash, nil if there is none
+func (s *Snapshot) metadata(hash string) (*Metadata, error) {
+	data, err := s.db.Get([]byte(metadataPrefix + hash))
+	if err != nil {
+		if err == metastore.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	md := &Metadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, fmt.Errorf("metadata of snapshot %s: %w", hash, err)
+	}
+	return md, nil
+}
+
+// nextID allocates a creation id, must be called with idMu held
+func (s *Snapshot) nextID() (uint64, error) {
+	id := uint64(1)
+	v, err := s.db.Get([]byte(nextIDKey))
+	if err == nil {
+		id = utils.BytesToUint64(v)
+	} else if err != metastore.ErrNotFound {
+		return 0, err
+	}
+	if err := s.db.Put([]byte(nextIDKey), utils.Uint64ToBytes(id+1)); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Reserve allocates a creation id for a snapshot created later by
+// CreateSyncSnapshot and records it in progress. A name can't be reserved
+// while it names a snapshot or a reservation of it is pending, requests left
+// in progress by a crash and failed ones are replaced.
+func (s *Snapshot) Reserve(name string) (*Metadata, error) {
+	if name == "" || internalKey([]byte(name)) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	return s.reserve(name)
+}
+
+// claim reserves name for newSnapshot, a request already in progress keeps
+// its creation id
+func (s *Snapshot) claim(name string) (*Metadata, error) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	hash := hashName(name)
+	md, err := s.metadata(hash)
+	if err != nil {
+		return nil, err
+	}
+	if md != nil && md.Status == StatusInProgress {
+		s.reserved[hash] = true
+		return md, nil
+	}
+	return s.reserve(name)
+}
+
+// reserve records name in progress, idMu must be held
+func (s *Snapshot) reserve(name string) (*Metadata, error) {
+	hash := hashName(name)
+	md, err := s.metadata(hash)
+	if err != nil {
+		return nil, err
+	}
+	if s.reserved[hash] {
+		return nil, fmt.Errorf("snapshot %q is being created", name)
+	}
+	// snapshots created by older versions have a name only
+	_, err = s.db.Get([]byte(name))
+	if err != nil && err != metastore.ErrNotFound {
+		return nil, err
+	}
+	if err == nil || (md != nil && md.Status != StatusInProgress && md.Status != StatusFailed) {
+		return nil, fmt.Errorf("snapshot %q already exists", name)
+	}
+	id, err := s.nextID()
+	if err != nil {
+		return nil, err
+	}
+	md = &Metadata{
+		ID:      id,
+		Hash:    hash,
+		Name:    name,
+		FS:      s.FS,
+		Created: time.Now(),
+		Status:  StatusInProgress,
+	}
+	if err := s.putMetadata(md); err != nil {
+		return nil, err
+	}
+	s.reserved[hash] = true
+	return md, nil
+}
+
+// Cancel records a snapshot reserved by Reserve and never created failed with
+// err, so its name can be reserved again
+func (s *Snapshot) Cancel(md *Metadata, err error) error {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	delete(s.reserved, md.Hash)
+	failed := *md
+	failed.Status, failed.Error = StatusFailed, err.Error()
+	return s.putMetadata(&failed)
+}
+
+// release ends the reservation of hash once its snapshot is created or failed
+func (s *Snapshot) release(hash string) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	delete(s.reserved, hash)
+}
+
+// GetSnapshot returns metadata of snapshot name
+func (s *Snapshot) GetSnapshot(name string) (*Metadata, error) {
+	if internalKey([]byte(name)) {
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+	}
+	md, err := s.metadata(hashName(name))
+	if err != nil {
+		return nil, err
+	}
+	if md != nil {
+		return md, nil
+	}
+	hash, err := s.Hash(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.legacyMetadata(name, hash)
+}
+
+// GetSnapshotByID returns metadata of the snapshot with creation id
+func (s *Snapshot) GetSnapshotByID(id uint64) (*Metadata, error) {
+	list, err := s.ListSnapshots(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].ID == id && id != 0 {
+			return &list[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: creation id %d", ErrSnapshotNotFound, id)
+}
+
+// legacyMetadata describes a snapshot created without metadata
+func (s *Snapshot) legacyMetadata(name, hash string) (*Metadata, error) {
+	md := &Metadata{Hash: hash, Name: name, FS: s.FS, Status: StatusCurrent}
+	current, err := s.CurrentHash()
+	if err != nil {
+		return nil, err
+	}
+	if hash != current {
+		md.Status = StatusDone
+		if md.Size, err = dirSize(s.DataPath(hash)); err != nil {
+			return nil, err
+		}
+	}
+	return md, nil
+}
+
+// ListSnapshots returns metadata of all snapshots ordered by creation, those
+// created by older versions come first
+func (s *Snapshot) ListSnapshots(ctx context.Context) ([]Metadata, error) {
+	list := []Metadata{}
+	hashes := map[string]bool{}
+	iter := s.db.NewIterator([]byte(metadataPrefix))
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			iter.Release()
+			return nil, err
+		}
+		var md Metadata
+		if err := json.Unmarshal(iter.Value(), &md); err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("metadata %q: %w", iter.Key(), err)
+		}
+		hashes[md.Hash] = true
+		list = append(list, md)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	names, err := s.Names()
+	if err != nil {
+		return nil, err
+	}
+	for name, hash := range names {
+		if hashes[hash] {
+			continue
+		}
+		md, err := s.legacyMetadata(name, hash)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *md)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// dirSize returns the size of files in dir, zero if it doesn't exist
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
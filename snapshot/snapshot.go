@@ -2,15 +2,15 @@ package snapshot
 
 import (
 	"context"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/radek-ryckowski/monofs/fs/metastore"
 	"github.com/radek-ryckowski/monofs/fs/wal"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -20,6 +20,13 @@ const (
 	SnapshostsDataPath = "snapshots"
 )
 
+var (
+	// ErrSnapshotNotFound is returned for names without a snapshot
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrCurrentSnapshot is returned when the current sync snapshot is deleted
+	ErrCurrentSnapshot = errors.New("current sync snapshot can't be deleted")
+)
+
 type SnapshotResult struct {
 	Name     string
 	Id       string
@@ -31,18 +38,27 @@ type SnapshotResult struct {
 type Snapshot struct {
 	SnapshotPath string
 	Name         string
-	db           *leveldb.DB
-	inodeDB      *leveldb.DB
-	attrDB       *leveldb.DB
-	w            *wal.WAL
+	// FS name of the filesystem recorded in snapshot metadata
+	FS      string
+	db      metastore.MetaStore
+	inodeDB metastore.MetaStore
+	attrDB  metastore.MetaStore
+	w       *wal.WAL
+	// mu serializes creation and deletion of snapshots
+	mu sync.Mutex
+	// idMu serializes allocation of creation ids and guards reserved
+	idMu sync.Mutex
+	// reserved hashes of snapshots requested through Reserve and not created
+	// or failed yet
+	reserved map[string]bool
 }
 
-// New Create a new snapshot
-func New(spath string, inodeDB, attrDB *leveldb.DB, w *wal.WAL) (*Snapshot, error) {
+// New Create a new snapshot, snapshot copies use the backend of inodeDB
+func New(spath string, inodeDB, attrDB metastore.MetaStore, w *wal.WAL) (*Snapshot, error) {
 	if spath == "" {
 		return nil, errors.New("path cannot be empty")
 	}
-	db, err := leveldb.OpenFile(path.Join(spath, "db"), nil)
+	db, err := metastore.Open(path.Join(spath, "db"), &metastore.Options{Backend: inodeDB.Backend()})
 	if err != nil {
 		return nil, err
 	}
@@ -57,23 +73,41 @@ func New(spath string, inodeDB, attrDB *leveldb.DB, w *wal.WAL) (*Snapshot, erro
 		inodeDB:      inodeDB,
 		attrDB:       attrDB,
 		w:            w,
+		reserved:     map[string]bool{},
+	}, nil
+}
+
+// OpenReadOnly opens the snapshot db in spath read-only for tools inspecting
+// an unmounted filesystem, snapshots can be listed but not created or deleted
+func OpenReadOnly(spath string) (*Snapshot, error) {
+	db, err := metastore.Open(path.Join(spath, "db"), &metastore.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		SnapshotPath: spath,
+		db:           db,
+		reserved:     map[string]bool{},
 	}, nil
 }
 
-// newSnapshot Create a new snapshot
-func (s *Snapshot) newSnapshot(name string) (string, error) {
+// newSnapshot Create a new snapshot, its metadata is recorded current and the
+// previous current snapshot is done once its copies are written
+func (s *Snapshot) newSnapshot(name string) (_ string, err error) {
 	if name == "" {
 		return "", errors.New("name cannot be empty")
 	}
-	// create Snapshot hash
-	sha256 := sha256.New()
-	sha256.Write([]byte(name))
-	hash := fmt.Sprintf("%x", sha256.Sum(nil))
+	if internalKey([]byte(name)) {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := hashName(name)
 
 	ok := false
-	cSnapshot, err := s.db.Get([]byte(CurrentSnapshotName), nil)
+	cSnapshot, err := s.db.Get([]byte(CurrentSnapshotName))
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == metastore.ErrNotFound {
 			ok = true
 		} else {
 			return "", err
@@ -85,67 +119,127 @@ func (s *Snapshot) newSnapshot(name string) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("snapshot %q already exists", name)
 	}
-
-	inodeSnapshot, err := s.inodeDB.GetSnapshot()
+	// a snapshot requested through Reserve keeps its creation id
+	md, err := s.claim(name)
 	if err != nil {
 		return "", err
 	}
-	attrSnapshot, err := s.attrDB.GetSnapshot()
+	defer s.release(hash)
+	parent := ""
+	defer func() {
+		if err != nil {
+			md.Status, md.Error = StatusFailed, err.Error()
+			s.putMetadata(md)
+			return
+		}
+		// copies of the parent are closed by now, so their size is known
+		err = s.parentDone(parent)
+	}()
+
+	inodeSnapshot, err := s.inodeDB.Snapshot()
 	if err != nil {
 		return "", err
 	}
-	inodeSnapshotDB, err := leveldb.OpenFile(path.Join(s.SnapshotPath, SnapshostsDataPath, string(cSnapshot), "inode"), nil)
+	defer inodeSnapshot.Release()
+	opts := &metastore.Options{Backend: s.inodeDB.Backend()}
+	inodeSnapshotDB, err := metastore.Open(path.Join(s.DataPath(string(cSnapshot)), "inode"), opts)
 	if err != nil {
 		return "", fmt.Errorf("cannot open inode snapshot: %v", err)
 	}
 	defer inodeSnapshotDB.Close()
-	attrSnapshotDB, err := leveldb.OpenFile(path.Join(s.SnapshotPath, SnapshostsDataPath, string(cSnapshot), "attrs"), nil)
+	attrSnapshotDB, err := metastore.Open(path.Join(s.DataPath(string(cSnapshot)), "attrs"), opts)
 	if err != nil {
 		return "", fmt.Errorf("cannot open attr snapshot: %v", err)
 	}
 	defer attrSnapshotDB.Close()
 	s.Name = name
-	walFileName, err := s.w.Dump(make(chan string), attrSnapshotDB)
+	// keys written by the dump aren't tracked by anyone here
+	output := make(chan string)
+	go func() {
+		for range output {
+		}
+	}()
+	defer close(output)
+	walFileName, err := s.w.Dump(output, attrSnapshotDB)
 	if err != nil {
 		return "", fmt.Errorf("cannot dump wal: %v", err)
 	}
-	is := inodeSnapshot.NewIterator(nil, nil)
-	batch := new(leveldb.Batch)
+	dumped := walFileName == ""
+	defer func() {
+		// later dumps wait for this one, the file has to reach attrDB anyway
+		if !dumped {
+			s.w.DBDump(walFileName, output, nil)
+		}
+	}()
+	// files rotated before are dumped to attrDB in the background, the copy
+	// has to hold them as it gets the checkpoint of the rotated file
+	if err = s.w.WaitPrevious(walFileName); err != nil {
+		return "", err
+	}
+	attrSnapshot, err := s.attrDB.Snapshot()
+	if err != nil {
+		return "", err
+	}
+	defer attrSnapshot.Release()
+	is := inodeSnapshot.NewIterator(nil)
+	batch := new(metastore.Batch)
 	for is.Next() {
 		batch.Put(is.Key(), is.Value())
 	}
 	is.Release()
-	err = inodeSnapshotDB.Write(batch, nil)
+	err = inodeSnapshotDB.Write(batch)
 	if err != nil {
 		return "", err
 	}
-	as := attrSnapshot.NewIterator(nil, nil)
-	batch = new(leveldb.Batch)
+	as := attrSnapshot.NewIterator(nil)
+	batch = new(metastore.Batch)
 	for as.Next() {
 		batch.Put(as.Key(), as.Value())
 	}
 	as.Release()
-	err = attrSnapshotDB.Write(batch, nil)
+	err = attrSnapshotDB.Write(batch)
 	if err != nil {
 		return "", err
 	}
-	err = s.db.Put([]byte(CurrentSnapshotName), []byte(hash), nil)
+	err = s.db.Put([]byte(CurrentSnapshotName), []byte(hash))
 	if err != nil {
 		return "", err
 	}
-	err = s.db.Put([]byte(name), []byte(hash), nil)
+	err = s.db.Put([]byte(name), []byte(hash))
 	if err != nil {
 		return "", err
 	}
 	if len(walFileName) > 0 {
-		if err := s.w.DBDump(walFileName, make(chan string), attrSnapshotDB); err != nil {
+		dumped = true
+		if err := s.w.DBDump(walFileName, output, attrSnapshotDB); err != nil {
 			return "", fmt.Errorf("cannot DBDump wal: %v", err)
 		}
 	}
 	s.Name = name
+	md.Status, md.Parent = StatusCurrent, string(cSnapshot)
+	if err := s.putMetadata(md); err != nil {
+		return "", err
+	}
+	parent = string(cSnapshot)
 	return hash, nil
 }
 
+// parentDone records the snapshot which was current before as done
+func (s *Snapshot) parentDone(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	md, err := s.metadata(hash)
+	if err != nil || md == nil {
+		return err
+	}
+	md.Status = StatusDone
+	if md.Size, err = dirSize(s.DataPath(hash)); err != nil {
+		return err
+	}
+	return s.putMetadata(md)
+}
+
 // CreateSyncSnapshot Create a new snapshot
 func (s *Snapshot) CreateSyncSnapshot(name string) (string, error) {
 	return s.newSnapshot(name)
@@ -156,9 +250,9 @@ func (s *Snapshot) GetCurrentSnapshot() (string, error) {
 	if s.Name != "" {
 		return s.Name, nil
 	}
-	n, err := s.db.Get([]byte(CurrentSnapshotName), nil)
+	n, err := s.db.Get([]byte(CurrentSnapshotName))
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == metastore.ErrNotFound {
 			return "", nil
 		}
 		return "", err
@@ -167,18 +261,116 @@ func (s *Snapshot) GetCurrentSnapshot() (string, error) {
 	return s.Name, nil
 }
 
-// DeleteSnapshot delete snapshot
-func (s *Snapshot) DeleteSnapshot(ctx context.Context, name string) error {
-	return fmt.Errorf("not implemented")
+// CurrentHash returns hash of the current sync snapshot as stored in the
+// snapshot db, data created under it isn't referenced by any snapshot copy yet
+func (s *Snapshot) CurrentHash() (string, error) {
+	n, err := s.db.Get([]byte(CurrentSnapshotName))
+	if err != nil {
+		if err == metastore.ErrNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(n), nil
 }
 
-// ListSnapshots list snapshots
-func (s *Snapshot) ListSnapshots(ctx context.Context) ([]string, error) {
-	l := []string{}
-	iter := s.db.NewIterator(nil, nil)
+// LSN returns the sequence number of the last WAL entry the snapshot copy
+// with hash contains
+func (s *Snapshot) LSN(hash string) (uint64, error) {
+	db, err := metastore.Open(path.Join(s.DataPath(hash), "attrs"), &metastore.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return wal.ReadCheckpoint(db)
+}
+
+// DataPath returns the directory holding copies of the stores taken for the
+// snapshot with hash, they are written when the next snapshot is created
+func (s *Snapshot) DataPath(hash string) string {
+	return path.Join(s.SnapshotPath, SnapshostsDataPath, hash)
+}
+
+// CopyPath returns the directory holding copies of the stores taken for the
+// snapshot name of the filesystem in spath, the snapshot db isn't opened so
+// it works while the filesystem is mounted
+func CopyPath(spath, name string) string {
+	return path.Join(spath, SnapshostsDataPath, hashName(name))
+}
+
+// Hash returns hash of the snapshot name
+func (s *Snapshot) Hash(name string) (string, error) {
+	if name == CurrentSnapshotName {
+		return "", fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+	}
+	hash, err := s.db.Get([]byte(name))
+	if err != nil {
+		if err == metastore.ErrNotFound {
+			return "", fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+		}
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Names returns hashes of snapshots by their names
+func (s *Snapshot) Names() (map[string]string, error) {
+	names := map[string]string{}
+	iter := s.db.NewIterator(nil)
 	for iter.Next() {
-		l = append(l, string(iter.Key()))
+		if internalKey(iter.Key()) {
+			continue
+		}
+		names[string(iter.Key())] = string(iter.Value())
 	}
 	iter.Release()
-	return l, nil
+	return names, iter.Error()
+}
+
+// Close closes the snapshot db
+func (s *Snapshot) Close() error {
+	return s.db.Close()
+}
+
+// DeleteSnapshot removes the name of a snapshot and copies of the stores taken
+// for it, the current sync snapshot can't be deleted
+func (s *Snapshot) DeleteSnapshot(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hash, err := s.Hash(name)
+	if err != nil {
+		return err
+	}
+	current, err := s.CurrentHash()
+	if err != nil {
+		return err
+	}
+	if hash == current {
+		return fmt.Errorf("%w: %q", ErrCurrentSnapshot, name)
+	}
+	if hash == "" {
+		return fmt.Errorf("snapshot %q has no hash", name)
+	}
+	lock, err := lockCopyForDelete(s.DataPath(hash))
+	if err != nil {
+		if errors.Is(err, ErrSnapshotMounted) {
+			return fmt.Errorf("%w: %q", ErrSnapshotMounted, name)
+		}
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	// the name goes first, a crash leaves copies nothing refers to instead
+	// of a name without them
+	if err := s.db.Delete([]byte(name)); err != nil {
+		return err
+	}
+	if err := s.db.Delete([]byte(metadataPrefix + hash)); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.DataPath(hash))
 }
@@ -1,8 +1,211 @@
 package snapshot
 
 import (
+	"context"
+	"os"
+	"path"
 	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/monofs/fs/metastore"
+	"github.com/radek-ryckowski/monofs/fs/wal"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSnapshot(t *testing.T) {
 }
+
+func newTestSnapshot(t *testing.T) (*Snapshot, metastore.MetaStore) {
+	dir := t.TempDir()
+	inodeDB, err := metastore.Open(path.Join(dir, "inodes"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inodeDB.Close() })
+	attrDB, err := metastore.Open(path.Join(dir, "attrs"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { attrDB.Close() })
+	w, err := wal.NewWithFS(wal.NewMemFS(), "/wal", attrDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	s, err := New(path.Join(dir, "snapshots"), inodeDB, attrDB, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, attrDB
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s, attrDB := newTestSnapshot(t)
+	first, err := s.CreateSyncSnapshot("first")
+	assert.NoError(t, err)
+	assert.NoError(t, attrDB.Put([]byte("key"), []byte("value")))
+	second, err := s.CreateSyncSnapshot("second")
+	assert.NoError(t, err)
+	// copies of the first snapshot are taken when the second one is created
+	_, err = os.Stat(s.DataPath(first))
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, s.DeleteSnapshot(ctx, "second"), ErrCurrentSnapshot)
+	assert.ErrorIs(t, s.DeleteSnapshot(ctx, "missing"), ErrSnapshotNotFound)
+	assert.ErrorIs(t, s.DeleteSnapshot(ctx, CurrentSnapshotName), ErrSnapshotNotFound)
+
+	assert.NoError(t, s.DeleteSnapshot(ctx, "first"))
+	_, err = os.Stat(s.DataPath(first))
+	assert.True(t, os.IsNotExist(err))
+	names, err := s.Names()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"second": second}, names)
+	assert.ErrorIs(t, s.DeleteSnapshot(ctx, "first"), ErrSnapshotNotFound)
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	ctx := context.Background()
+	s, attrDB := newTestSnapshot(t)
+	s.FS = "test"
+	reserved, err := s.Reserve("first")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusInProgress, reserved.Status)
+	md, err := s.GetSnapshotByID(reserved.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", md.Name)
+
+	first, err := s.CreateSyncSnapshot("first")
+	assert.NoError(t, err)
+	md, err = s.GetSnapshot("first")
+	assert.NoError(t, err)
+	assert.Equal(t, reserved.ID, md.ID)
+	assert.Equal(t, first, md.Hash)
+	assert.Equal(t, StatusCurrent, md.Status)
+	assert.Equal(t, "test", md.FS)
+	_, err = s.Reserve("first")
+	assert.Error(t, err)
+
+	assert.NoError(t, attrDB.Put([]byte("key"), []byte("value")))
+	_, err = s.CreateSyncSnapshot("second")
+	assert.NoError(t, err)
+	md, err = s.GetSnapshot("first")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusDone, md.Status)
+	assert.Greater(t, md.Size, int64(0))
+	second, err := s.GetSnapshot("second")
+	assert.NoError(t, err)
+	assert.Equal(t, reserved.ID+1, second.ID)
+	assert.Equal(t, first, second.Parent)
+
+	// a snapshot created by an older version has only its name
+	assert.NoError(t, s.db.Put([]byte("legacy"), []byte(hashName("legacy"))))
+	list, err := s.ListSnapshots(ctx)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, md := range list {
+		names = append(names, md.Name)
+	}
+	assert.Equal(t, []string{"legacy", "first", "second"}, names)
+	assert.Equal(t, StatusDone, list[0].Status)
+
+	assert.NoError(t, s.DeleteSnapshot(ctx, "first"))
+	_, err = s.GetSnapshot("first")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	_, err = s.GetSnapshotByID(reserved.ID)
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+// gatedStore blocks writes until gate is closed
+type gatedStore struct {
+	metastore.MetaStore
+	gate chan struct{}
+}
+
+func (s *gatedStore) Write(b *metastore.Batch) error {
+	<-s.gate
+	return s.MetaStore.Write(b)
+}
+
+func TestSnapshotCopyHoldsPendingDumps(t *testing.T) {
+	dir := t.TempDir()
+	inodeDB, err := metastore.Open(path.Join(dir, "inodes"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inodeDB.Close()
+	attrDB, err := metastore.Open(path.Join(dir, "attrs"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attrDB.Close()
+	gated := &gatedStore{MetaStore: attrDB, gate: make(chan struct{})}
+	w, err := wal.NewWithFS(wal.NewMemFS(), "/wal", gated, wal.WithRotation(-1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s, err := New(path.Join(dir, "snapshots"), inodeDB, attrDB, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	first, err := s.CreateSyncSnapshot("first")
+	assert.NoError(t, err)
+
+	// the dump of a rotated file is still running when the next snapshot starts
+	assert.NoError(t, w.AddEntry(&wal.Entry{Key: []byte("rotated"), Value: []byte("1")}))
+	_, err = w.Dump(nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddEntry(&wal.Entry{Key: []byte("current"), Value: []byte("2")}))
+	done := make(chan error)
+	go func() {
+		_, err := s.CreateSyncSnapshot("second")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(gated.gate)
+	assert.NoError(t, <-done)
+
+	copyDB, err := metastore.Open(path.Join(s.DataPath(first), "attrs"), &metastore.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copyDB.Close()
+	for _, key := range []string{"rotated", "current"} {
+		_, err := copyDB.Get([]byte(key))
+		assert.NoError(t, err, key)
+	}
+}
+
+func TestReserveRejectsDuplicates(t *testing.T) {
+	s, _ := newTestSnapshot(t)
+	reserved, err := s.Reserve("first")
+	assert.NoError(t, err)
+	_, err = s.Reserve("first")
+	assert.Error(t, err)
+
+	_, err = s.CreateSyncSnapshot("first")
+	assert.NoError(t, err)
+	md, err := s.GetSnapshot("first")
+	assert.NoError(t, err)
+	assert.Equal(t, reserved.ID, md.ID)
+	_, err = s.Reserve("first")
+	assert.Error(t, err)
+
+	// a snapshot created by an older version has only its name
+	assert.NoError(t, s.db.Put([]byte("legacy"), []byte(hashName("legacy"))))
+	_, err = s.Reserve("legacy")
+	assert.Error(t, err)
+
+	// a failed request can be replaced
+	failed, err := s.Reserve("failed")
+	assert.NoError(t, err)
+	s.release(failed.Hash)
+	failed.Status = StatusFailed
+	assert.NoError(t, s.putMetadata(failed))
+	again, err := s.Reserve("failed")
+	assert.NoError(t, err)
+	assert.Greater(t, again.ID, failed.ID)
+}